@@ -2,26 +2,77 @@
 
 const PubSub = require('@google-cloud/pubsub');
 const Storage = require('@google-cloud/storage');
+const api = require('@opentelemetry/api');
+const { W3CTraceContextPropagator } = require('@opentelemetry/core');
+const { OTLPTraceExporter } = require('@opentelemetry/exporter-trace-otlp-http');
+const { resourceFromAttributes } = require('@opentelemetry/resources');
+const { BasicTracerProvider, BatchSpanProcessor } = require('@opentelemetry/sdk-trace-base');
 
 const pubsub = PubSub();
 const storage = Storage();
 
 const Buffer = require('safe-buffer').Buffer;
 
+// Spans are only exported when an OTLP endpoint is configured, as the service does
+const endpoint = process.env.OTEL_EXPORTER_OTLP_TRACES_ENDPOINT || process.env.OTEL_EXPORTER_OTLP_ENDPOINT;
+const provider = new BasicTracerProvider({
+    resource: resourceFromAttributes({ 'service.name': 'uploadly-function' }),
+    spanProcessors: endpoint ? [new BatchSpanProcessor(new OTLPTraceExporter())] : []
+});
+const tracer = provider.getTracer('uploadly-function');
+const propagator = new W3CTraceContextPropagator();
+
 exports.subscribe = function subscribe (event, callback) {
     const pubsubMessage = event.data;
+    const attributes = pubsubMessage.attributes;
+
+    // Continue the trace of the upload from the traceparent the service published
+    const parent = propagator.extract(api.ROOT_CONTEXT, attributes, api.defaultTextMapGetter);
+    const file = storage.bucket("cloud-project-1").file(attributes.profile + "/" + attributes.name);
+    const span = tracer.startSpan('storage.write', {
+        kind: api.SpanKind.CLIENT,
+        attributes: {
+            'uploadly.profile': attributes.profile,
+            'uploadly.file': attributes.name
+        }
+    }, parent);
+
+    const metadata = {
+        contentType: attributes.contentType
+    };
+
+    // Carry the uploader's trace context onto the object so the write can be correlated
+    if (attributes.traceparent) {
+        metadata.metadata = { traceparent: attributes.traceparent };
+    }
 
-    // We're just going to log the message to prove that it worked!
-    const file = storage.bucket("cloud-project-1").file(pubsubMessage.attributes.profile + "/" + pubsubMessage.attributes.name);
     const stream = file.createWriteStream({
-        metadata:{
-            contentType: pubsubMessage.attributes.contentType
+        metadata: metadata
+    });
+
+    // Spans must be exported before returning, as the function may be frozen after
+    let ended = false;
+    const done = function (err) {
+        if (ended) {
+            return;
         }
+        ended = true;
+        if (err) {
+            span.recordException(err);
+            span.setStatus({ code: api.SpanStatusCode.ERROR, message: err.message });
+        }
+        span.end();
+        provider.forceFlush().then(function () {
+            callback(err);
+        }, function () {
+            callback(err);
+        });
+    };
+    stream.on('error', done);
+    stream.on('finish', function () {
+        done();
     });
 
     stream.write(Buffer.from(pubsubMessage.data, 'base64'))
     stream.end()
-
-    // Don't forget to call the callback!
-    callback();
 };
@@ -0,0 +1,74 @@
+package apierror
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+const REQUEST_ID = "X-Request-ID"
+
+type Error struct {
+	// Machine readable error code derived from the status code
+	Code string `json:"code"`
+	// Human readable description of the error
+	Message string `json:"message"`
+	// ID of the request that failed, if one was assigned
+	RequestID string `json:"request_id,omitempty"`
+	// Additional context such as the offending field
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type envelope struct {
+	Error Error `json:"error"`
+}
+
+var codes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "unprocessable_entity",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// Write responds to the request with the JSON error envelope.
+func Write(w http.ResponseWriter, r *http.Request, status int, message string) {
+	WriteDetails(w, r, status, message, nil)
+}
+
+// WriteDetails responds to the request with the JSON error envelope including
+// the given details.
+func WriteDetails(w http.ResponseWriter, r *http.Request, status int, message string, details map[string]string) {
+	code, ok := codes[status]
+	if !ok {
+		code = "error"
+	}
+
+	requestID := w.Header().Get(REQUEST_ID)
+	if requestID == "" {
+		requestID = r.Header.Get(REQUEST_ID)
+	}
+
+	bytes, err := json.Marshal(envelope{Error: Error{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID,
+		Details:   details,
+	}})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Unable to marshal error response", "error", err)
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
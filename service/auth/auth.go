@@ -1,69 +1,304 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
+	"github.com/vjsamuel/uploadly/service/apierror"
 	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"github.com/vjsamuel/uploadly/service/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
 	"github.com/vjsamuel/uploadly/service/cache"
+	"github.com/vjsamuel/uploadly/service/storage"
 )
 
 const AUTH_TOKEN = "X-CloudProject-Token"
+const API_KEY = "X-CloudProject-Key"
 const TOKEN_API = "https://www.googleapis.com/oauth2/v3/tokeninfo?id_token="
+const KEY_PREFIX = "upl_"
+const PUBLIC_KEY_PREFIX = "ssh:"
+
+// Authenticator guards the routes of the API and identifies the user of
+// requests it let through.
+type Authenticator interface {
+	// AuthenticatedHandler only requires the request to carry a valid credential
+	AuthenticatedHandler(http.HandlerFunc) http.Handler
+	// AuthorizedHandler requires the credential to be granted the scope
+	AuthorizedHandler(scope string, handlerFunc http.HandlerFunc) http.Handler
+	// User returns the user authenticated for the request, if any
+	User(*http.Request) *common.User
+}
 
 type  AuthHandler struct {
-	users *cache.EvictableMap
+	users    *cache.EvictableMap
+	keys     storage.KeyStore
+	profiles storage.ProfileStore
+	admins   map[string]bool
+	limits   *ratelimit.Limits
 }
 
-func NewAuthHandler(users *cache.EvictableMap) *AuthHandler{
-	return &AuthHandler{users: users}
+// NewAuthHandler authenticates Google ID tokens and the API keys in the key
+// store. The key and profile stores may be nil, in which case API keys are
+// rejected and profiles can not be disabled.
+func NewAuthHandler(users *cache.EvictableMap, keys storage.KeyStore, profiles storage.ProfileStore, admins []string, limits *ratelimit.Limits) *AuthHandler{
+	a := &AuthHandler{users: users, keys: keys, profiles: profiles, admins: map[string]bool{}, limits: limits}
+	for _, admin := range admins {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			a.admins[admin] = true
+		}
+	}
+	return a
 }
 
+// AuthenticatedHandler only requires the request to carry a valid credential.
 func (a *AuthHandler) AuthenticatedHandler(handlerFunc http.HandlerFunc) http.Handler {
-	return a.checkAuthHeaders(http.HandlerFunc(handlerFunc))
+	return a.checkAuthHeaders("", http.HandlerFunc(handlerFunc))
+}
+
+// AuthorizedHandler requires the credential passed with the request to be
+// granted the given scope.
+func (a *AuthHandler) AuthorizedHandler(scope string, handlerFunc http.HandlerFunc) http.Handler {
+	return a.checkAuthHeaders(scope, http.HandlerFunc(handlerFunc))
+}
+
+// IsAdmin reports whether the profile is configured as an admin.
+func (a *AuthHandler) IsAdmin(profile string) bool {
+	return a.admins[profile]
 }
 
-func (a *AuthHandler) checkAuthHeaders(h http.Handler) http.Handler {
+func (a *AuthHandler) checkAuthHeaders(scope string, h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		// Check for the auth header in the request
-		token := GetAuthToken(r)
-		if token != "" {
-			if a.validateToken(token) {
-				h.ServeHTTP(w, r)
-			} else {
-				http.Error(w, fmt.Sprintf("Invalid %s", AUTH_TOKEN), http.StatusForbidden)
-			}
+		var header, credential string
+		if token := r.Header.Get(AUTH_TOKEN); token != "" {
+			header, credential = AUTH_TOKEN, token
+		} else if apiKey := r.Header.Get(API_KEY); apiKey != "" {
+			header, credential = API_KEY, apiKey
+		} else {
+			apierror.Write(w, r, http.StatusUnauthorized, fmt.Sprintf("%s or %s needs to be passed with all requests", AUTH_TOKEN, API_KEY))
+			return
+		}
+
+		// Clients that keep failing to authenticate are turned away before
+		// their credentials reach the token API or the key store
+		ip := a.limits.ClientIP(r)
+		if a.users.Get(credential) == nil && a.limits.Exhausted(w, r, ratelimit.AUTH_FAILURE, ip) {
+			return
+		}
+
+		var valid bool
+		if header == AUTH_TOKEN {
+			valid = a.validateToken(r.Context(), credential)
 		} else {
-			http.Error(w, fmt.Sprintf("%s needs to be passed with all requests", AUTH_TOKEN), http.StatusForbidden)
+			valid = a.validateKey(r.Context(), credential)
+		}
+
+		usr := a.users.Get(credential)
+		if !valid || usr == nil {
+			a.limits.Record(r.Context(), ratelimit.AUTH_FAILURE, ip)
+			apierror.Write(w, r, http.StatusUnauthorized, fmt.Sprintf("Invalid %s", header))
+			return
+		}
+
+		if scope != "" && !usr.HasScope(scope) {
+			apierror.WriteDetails(w, r, http.StatusForbidden, fmt.Sprintf("%s does not grant the %s scope", header, scope), map[string]string{"scope": scope})
+			return
 		}
+		logging.SetUser(r.Context(), *usr)
+		h.ServeHTTP(w, r)
 	}
 
 	return http.HandlerFunc(fn)
 }
 
+// User returns the user the credential passed with the request was validated
+// for.
+func (a *AuthHandler) User(r *http.Request) *common.User {
+	return a.users.Get(GetAuthToken(r))
+}
+
+// GetAuthToken returns the credential passed with the request. The token takes
+// precedence over the API key when both are passed.
 func GetAuthToken(r *http.Request) string {
-	return r.Header.Get(AUTH_TOKEN)
+	if token := r.Header.Get(AUTH_TOKEN); token != "" {
+		return token
+	}
+	return r.Header.Get(API_KEY)
+}
+
+// GenerateAPIKey returns a new random API key along with the hash that is
+// persisted for it. The key itself is never stored.
+func GenerateAPIKey() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	apiKey := KEY_PREFIX + hex.EncodeToString(buf)
+	return apiKey, HashAPIKey(apiKey), nil
+}
+
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// HashPublicKey returns the hash an SSH public key is stored under. It is told
+// apart from the hashes of secret keys by its prefix, so that a public key can
+// never be presented as an API key.
+func HashPublicKey(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return PUBLIC_KEY_PREFIX + hex.EncodeToString(sum[:])
+}
+
+func (a *AuthHandler) cached(credential string) bool {
+	hit := a.users.Get(credential) != nil
+	metrics.ObserveTokenCache(hit)
+	return hit
+}
+
+// grants returns the scopes available to the profile. API keys are limited to
+// the intersection of these and the scopes they were created with.
+func (a *AuthHandler) grants(profile string) []string {
+	scopes := append([]string{}, common.Scopes...)
+	if a.IsAdmin(profile) {
+		scopes = append(scopes, common.SCOPE_ADMIN)
+	}
+	return scopes
+}
+
+// disabled reports whether the profile of the user is disabled. A profile
+// that can not be looked up is treated as disabled, so that a disabled user
+// is not let in while the profile store is failing.
+func (a *AuthHandler) disabled(ctx context.Context, usr common.User) bool {
+	if a.profiles == nil {
+		return false
+	}
+	disabled, err := a.profiles.Disabled(ctx, common.Holder{User: usr})
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Unable to check whether profile is disabled", "profile", usr.Profile, "error", err)
+		return true
+	}
+	return disabled
+}
+
+// validateKey checks the API key against the key store. Valid keys are cached
+// like tokens, so a revoked or expired key can be honoured until its cache
+// entry is evicted.
+func (a *AuthHandler) validateKey(ctx context.Context, apiKey string) (valid bool) {
+	ctx, span := tracing.Start(ctx, "auth.validateKey")
+	defer func() {
+		span.SetAttributes(attribute.Bool("auth.valid", valid))
+		span.End()
+	}()
+
+	if a.cached(apiKey) {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return true
+	}
+
+	if a.keys == nil || !strings.HasPrefix(apiKey, KEY_PREFIX) {
+		return false
+	}
+
+	usr := a.KeyUser(ctx, HashAPIKey(apiKey))
+	if usr == nil {
+		return false
+	}
+
+	a.users.Insert(apiKey, *usr)
+	return true
+}
+
+// KeyUser looks up the API key stored under the hash and returns the user it
+// grants access to, if it is valid. The result is not cached.
+func (a *AuthHandler) KeyUser(ctx context.Context, hash string) *common.User {
+	if a.keys == nil {
+		return nil
+	}
+
+	holder, record, err := a.keys.Lookup(ctx, hash)
+	if err != nil || holder == nil {
+		return nil
+	}
+
+	if record.Expired() {
+		logging.From(ctx).InfoContext(ctx, "Rejecting expired key", "key", holder.File, "profile", holder.GetProfileID())
+		return nil
+	}
+
+	if a.disabled(ctx, holder.User) {
+		logging.From(ctx).InfoContext(ctx, "Rejecting key of disabled profile", "key", holder.File, "profile", holder.GetProfileID())
+		return nil
+	}
+
+	scopes := record.Scopes
+	if len(scopes) == 0 {
+		scopes = common.Scopes
+	}
+	owner := common.User{Scopes: a.grants(holder.GetProfileID())}
+	holder.User.Scopes = []string{}
+	for _, scope := range scopes {
+		if owner.HasScope(scope) {
+			holder.User.Scopes = append(holder.User.Scopes, scope)
+		}
+	}
+
+	if err := a.keys.Touch(ctx, *holder); err != nil {
+		logging.From(ctx).WarnContext(ctx, "Unable to update last used time of key", "key", holder.File, "error", err)
+	}
+
+	return &holder.User
 }
 
-func (a *AuthHandler) validateToken(token string) bool {
-	if a.users.Get(token) != nil {
+func (a *AuthHandler) validateToken(ctx context.Context, token string) (valid bool) {
+	ctx, span := tracing.Start(ctx, "auth.validateToken")
+	defer func() {
+		span.SetAttributes(attribute.Bool("auth.valid", valid))
+		span.End()
+	}()
+
+	if a.cached(token) {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
 		return true
 	}
 	client := http.Client{
 		Timeout: time.Second * 3,
 	}
 
-	resp, err := client.Get(fmt.Sprintf("%s%s", TOKEN_API, token))
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", TOKEN_API, token), nil)
 	if err != nil {
-		log.Println("Token validation failed with err: ", err)
+		logging.From(ctx).ErrorContext(ctx, "Token validation request creation failed", "error", err)
 		return false
-	} else if resp.StatusCode == 200 {
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		// The request URL carries the token, so only the underlying error is logged
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		logging.From(ctx).WarnContext(ctx, "Token validation failed", "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 {
 		bytes, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			log.Println("Response token read failed with err: ", err)
+			logging.From(ctx).WarnContext(ctx, "Response token read failed", "error", err)
 			return false
 		}
 
@@ -72,7 +307,7 @@ func (a *AuthHandler) validateToken(token string) bool {
 			err := json.Unmarshal(bytes, &out)
 
 			if err != nil {
-				log.Println("Response token parse failed with err: ", err)
+				logging.From(ctx).WarnContext(ctx, "Response token parse failed", "error", err)
 				return false
 			}
 
@@ -84,9 +319,15 @@ func (a *AuthHandler) validateToken(token string) bool {
 				LastName:  last,
 				Profile: prof,
 			}
+			u.Scopes = a.grants(prof)
+
+			if a.disabled(ctx, u) {
+				logging.From(ctx).InfoContext(ctx, "Rejecting token of disabled profile", "profile", prof)
+				return false
+			}
 
 			a.users.Insert(token, u)
-			log.Println("Inserting user: ", u)
+			logging.From(ctx).DebugContext(ctx, "Caching validated user", "user", u)
 			return true
 		}
 	}
@@ -0,0 +1,331 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/cache"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+// keyStore holds API keys in memory by their hash.
+type keyStore struct {
+	mu      sync.Mutex
+	keys    map[string]common.APIKey
+	owners  map[string]common.Holder
+	lookups int
+}
+
+func newKeyStore() *keyStore {
+	return &keyStore{keys: map[string]common.APIKey{}, owners: map[string]common.Holder{}}
+}
+
+// add stores a new key of the profile under the name and returns it.
+func (k *keyStore) add(t *testing.T, profile, name string, key common.APIKey) string {
+	t.Helper()
+	apiKey, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Hash = hash
+	k.Insert(context.Background(), common.Holder{User: common.User{Profile: profile}, File: name}, key)
+	return apiKey
+}
+
+func (k *keyStore) Get(ctx context.Context, holder common.Holder) (*common.KeyResponse, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for hash, owner := range k.owners {
+		if owner.GetProfileID() == holder.GetProfileID() && owner.File == holder.File {
+			return &common.KeyResponse{Name: owner.File, Scopes: k.keys[hash].Scopes}, nil
+		}
+	}
+	return nil, storage.ErrNotFound
+}
+
+func (k *keyStore) List(ctx context.Context, holder common.Holder) ([]common.KeyResponse, error) {
+	return nil, nil
+}
+
+func (k *keyStore) Insert(ctx context.Context, holder common.Holder, key common.APIKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.Hash] = key
+	k.owners[key.Hash] = holder
+	return nil
+}
+
+func (k *keyStore) Touch(context.Context, common.Holder) error {
+	return nil
+}
+
+func (k *keyStore) Delete(ctx context.Context, holder common.Holder) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for hash, owner := range k.owners {
+		if owner.GetProfileID() == holder.GetProfileID() && owner.File == holder.File {
+			delete(k.keys, hash)
+			delete(k.owners, hash)
+			return nil
+		}
+	}
+	return storage.ErrNotFound
+}
+
+func (k *keyStore) Lookup(ctx context.Context, hash string) (*common.Holder, *common.APIKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.lookups++
+	key, ok := k.keys[hash]
+	if !ok {
+		return nil, nil, storage.ErrNotFound
+	}
+	owner := k.owners[hash]
+	return &owner, &key, nil
+}
+
+func (k *keyStore) Close() error {
+	return nil
+}
+
+// profileStore knows which profiles are disabled, and fails every lookup
+// while err is set.
+type profileStore struct {
+	storage.ProfileStore
+	mu       sync.Mutex
+	disabled map[string]bool
+	err      error
+}
+
+func (p *profileStore) SetDisabled(ctx context.Context, holder common.Holder, disabled bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disabled[holder.GetProfileID()] = disabled
+	return nil
+}
+
+func (p *profileStore) Disabled(ctx context.Context, holder common.Holder) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.disabled[holder.GetProfileID()], p.err
+}
+
+type authenticator struct {
+	*auth.AuthHandler
+	keys     *keyStore
+	profiles *profileStore
+}
+
+func newAuthenticator(ttl time.Duration, limits *ratelimit.Limits, admins ...string) *authenticator {
+	keys, profiles := newKeyStore(), &profileStore{disabled: map[string]bool{}}
+	a := auth.NewAuthHandler(cache.NewEvictableMap(100, ttl), keys, profiles, admins, limits)
+	return &authenticator{AuthHandler: a, keys: keys, profiles: profiles}
+}
+
+// serve calls a handler guarded for the scope with the API key, and returns
+// the status and the user the handler saw.
+func (a *authenticator) serve(scope, apiKey string) (int, *common.User) {
+	var usr *common.User
+	handler := a.AuthorizedHandler(scope, func(w http.ResponseWriter, r *http.Request) {
+		usr = a.User(r)
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if apiKey != "" {
+		r.Header.Set(auth.API_KEY, apiKey)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code, usr
+}
+
+func TestGenerateAPIKey(t *testing.T) {
+	apiKey, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(apiKey, auth.KEY_PREFIX) {
+		t.Errorf("expected the key to start with %s, got %s", auth.KEY_PREFIX, apiKey)
+	}
+	if hash != auth.HashAPIKey(apiKey) || strings.Contains(hash, apiKey) {
+		t.Errorf("expected the hash of the key, got %s", hash)
+	}
+	if another, _, _ := auth.GenerateAPIKey(); another == apiKey {
+		t.Error("expected keys to be random")
+	}
+}
+
+func TestKeyScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  string
+		scopes   []string
+		expected []string
+	}{
+		{"all scopes by default", "user", nil, common.Scopes},
+		{"limited to its scopes", "user", []string{common.SCOPE_READ}, []string{common.SCOPE_READ}},
+		{"admin of a user", "user", []string{common.SCOPE_READ, common.SCOPE_ADMIN}, []string{common.SCOPE_READ}},
+		{"admin of an admin", "admin", []string{common.SCOPE_ADMIN}, []string{common.SCOPE_ADMIN}},
+		{"admin not by default", "admin", nil, common.Scopes},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newAuthenticator(time.Minute, nil, "admin")
+			apiKey := a.keys.add(t, test.profile, "key", common.APIKey{Scopes: test.scopes})
+
+			usr := a.KeyUser(context.Background(), auth.HashAPIKey(apiKey))
+			if usr == nil {
+				t.Fatal("expected the key to be valid")
+			}
+			if usr.Profile != test.profile || !reflect.DeepEqual(usr.Scopes, test.expected) {
+				t.Errorf("expected %s with scopes %v, got %s with %v", test.profile, test.expected, usr.Profile, usr.Scopes)
+			}
+		})
+	}
+}
+
+func TestAuthorizedHandler(t *testing.T) {
+	a := newAuthenticator(time.Minute, nil, "admin")
+	reader := a.keys.add(t, "user", "reader", common.APIKey{Scopes: []string{common.SCOPE_READ}})
+	user := a.keys.add(t, "user", "all", common.APIKey{})
+	admin := a.keys.add(t, "admin", "admin", common.APIKey{Scopes: []string{common.SCOPE_READ, common.SCOPE_ADMIN}})
+
+	tests := []struct {
+		name   string
+		scope  string
+		apiKey string
+		status int
+	}{
+		{"granted scope", common.SCOPE_READ, reader, http.StatusOK},
+		{"missing scope", common.SCOPE_WRITE, reader, http.StatusForbidden},
+		{"any valid key", "", reader, http.StatusOK},
+		{"admin scope of a user", common.SCOPE_ADMIN, user, http.StatusForbidden},
+		{"admin scope of an admin", common.SCOPE_ADMIN, admin, http.StatusOK},
+		{"scope not granted to an admin key", common.SCOPE_DELETE, admin, http.StatusForbidden},
+		{"no key", common.SCOPE_READ, "", http.StatusUnauthorized},
+		{"unknown key", common.SCOPE_READ, auth.KEY_PREFIX + "unknown", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, _ := a.serve(test.scope, test.apiKey); status != test.status {
+				t.Errorf("expected status %d, got %d", test.status, status)
+			}
+		})
+	}
+}
+
+func TestKeysWithoutPrefixAreNotLookedUp(t *testing.T) {
+	a := newAuthenticator(time.Minute, nil)
+	apiKey := a.keys.add(t, "user", "key", common.APIKey{})
+
+	if status, _ := a.serve("", strings.TrimPrefix(apiKey, auth.KEY_PREFIX)); status != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+	if a.keys.lookups != 0 {
+		t.Errorf("expected no lookup, got %d", a.keys.lookups)
+	}
+}
+
+func TestUserOfRequest(t *testing.T) {
+	a := newAuthenticator(time.Minute, nil)
+	apiKey := a.keys.add(t, "user", "key", common.APIKey{Scopes: []string{common.SCOPE_READ}})
+
+	status, usr := a.serve(common.SCOPE_READ, apiKey)
+	if status != http.StatusOK || usr == nil {
+		t.Fatalf("expected the user of the key, got %d and %v", status, usr)
+	}
+	if usr.Profile != "user" || !usr.HasScope(common.SCOPE_READ) || usr.HasScope(common.SCOPE_WRITE) {
+		t.Errorf("expected the user with the scopes of the key, got %+v", usr)
+	}
+}
+
+func TestExpiredKeys(t *testing.T) {
+	a := newAuthenticator(time.Minute, nil)
+	expired := a.keys.add(t, "user", "expired", common.APIKey{Expiry: time.Now().Add(-time.Minute)})
+	valid := a.keys.add(t, "user", "valid", common.APIKey{Expiry: time.Now().Add(time.Hour)})
+
+	if status, _ := a.serve("", expired); status != http.StatusUnauthorized {
+		t.Errorf("expected an expired key to be rejected, got %d", status)
+	}
+	if status, _ := a.serve("", valid); status != http.StatusOK {
+		t.Errorf("expected a key that did not expire to be valid, got %d", status)
+	}
+}
+
+func TestDisabledUsers(t *testing.T) {
+	a := newAuthenticator(time.Minute, nil)
+	apiKey := a.keys.add(t, "user", "key", common.APIKey{})
+	a.profiles.SetDisabled(context.Background(), common.Holder{User: common.User{Profile: "user"}}, true)
+
+	if status, _ := a.serve("", apiKey); status != http.StatusUnauthorized {
+		t.Errorf("expected the key of a disabled user to be rejected, got %d", status)
+	}
+
+	a.profiles.SetDisabled(context.Background(), common.Holder{User: common.User{Profile: "user"}}, false)
+	a.profiles.err = errors.New("unreachable")
+	if status, _ := a.serve("", apiKey); status != http.StatusUnauthorized {
+		t.Errorf("expected keys to be rejected while profiles can not be checked, got %d", status)
+	}
+
+	a.profiles.err = nil
+	if status, _ := a.serve("", apiKey); status != http.StatusOK {
+		t.Errorf("expected the key of an enabled user to be valid, got %d", status)
+	}
+}
+
+func TestRevokedKeys(t *testing.T) {
+	a := newAuthenticator(50*time.Millisecond, nil)
+	apiKey := a.keys.add(t, "user", "key", common.APIKey{})
+	if status, _ := a.serve("", apiKey); status != http.StatusOK {
+		t.Fatalf("expected the key to be valid, got %d", status)
+	}
+
+	if err := a.keys.Delete(context.Background(), common.Holder{User: common.User{Profile: "user"}, File: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	// Validated keys are honoured until they leave the cache
+	if status, _ := a.serve("", apiKey); status != http.StatusOK {
+		t.Errorf("expected the cached key to be honoured, got %d", status)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if status, _ := a.serve("", apiKey); status != http.StatusUnauthorized {
+		t.Errorf("expected the revoked key to be rejected, got %d", status)
+	}
+}
+
+func TestAuthFailuresAreLimited(t *testing.T) {
+	limits := ratelimit.NewLimits(config.RateLimitConfig{AuthFailure: config.Limit{Requests: 2, Period: time.Hour}}, nil)
+	a := newAuthenticator(time.Minute, limits)
+	cached := a.keys.add(t, "user", "cached", common.APIKey{})
+	uncached := a.keys.add(t, "user", "uncached", common.APIKey{})
+	if status, _ := a.serve("", cached); status != http.StatusOK {
+		t.Fatalf("expected the key to be valid, got %d", status)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status, _ := a.serve("", auth.KEY_PREFIX+"wrong"); status != http.StatusUnauthorized {
+			t.Fatalf("expected a wrong key to be rejected, got %d", status)
+		}
+	}
+	lookups := a.keys.lookups
+	if status, _ := a.serve("", uncached); status != http.StatusTooManyRequests {
+		t.Errorf("expected the client to be turned away, got %d", status)
+	}
+	if a.keys.lookups != lookups {
+		t.Error("expected a turned away key not to be looked up")
+	}
+	if status, _ := a.serve("", cached); status != http.StatusOK {
+		t.Errorf("expected an already validated key to be let in, got %d", status)
+	}
+}
@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+// LRU keeps responses in memory, up to a number of entries, each for a ttl.
+// Every replica holds its own entries, so responses invalidated on another
+// replica are served until they expire.
+type LRU struct {
+	cache gcache.Cache
+	ttl   time.Duration
+	mu    sync.Mutex
+}
+
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{cache: gcache.New(size).LRU().Build(), ttl: ttl}
+}
+
+func (l *LRU) Get(ctx context.Context, holder common.Holder) ([]byte, error) {
+	return l.get(recordKey(holder))
+}
+
+func (l *LRU) Set(ctx context.Context, holder common.Holder, value []byte) error {
+	return l.cache.SetWithExpire(recordKey(holder), value, l.ttl)
+}
+
+func (l *LRU) Delete(ctx context.Context, holder common.Holder) error {
+	l.cache.Remove(recordKey(holder))
+	return l.increment(fileVersionKey(holder))
+}
+
+func (l *LRU) FileVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	return l.version(fileVersionKey(holder))
+}
+
+func (l *LRU) ListVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	return l.version(versionKey(holder))
+}
+
+func (l *LRU) GetList(ctx context.Context, holder common.Holder, version uint64) ([]byte, error) {
+	return l.get(listKey(holder, version))
+}
+
+func (l *LRU) SetList(ctx context.Context, holder common.Holder, version uint64, value []byte) error {
+	return l.cache.SetWithExpire(listKey(holder, version), value, l.ttl)
+}
+
+func (l *LRU) DeleteList(ctx context.Context, holder common.Holder) error {
+	return l.increment(versionKey(holder))
+}
+
+func (l *LRU) Ping(ctx context.Context) error {
+	return nil
+}
+
+// version returns the version stored under the key. A version that was
+// evicted starts again from the clock, above the versions responses were
+// cached under before.
+func (l *LRU) version(key string) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if raw, err := l.cache.GetIFPresent(key); err == nil {
+		return raw.(uint64), nil
+	}
+	version := uint64(time.Now().UnixNano())
+	return version, l.cache.Set(key, version)
+}
+
+// increment moves the version stored under the key to the next one. When
+// there is no version, the next one is started by version.
+func (l *LRU) increment(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if raw, err := l.cache.GetIFPresent(key); err == nil {
+		return l.cache.Set(key, raw.(uint64)+1)
+	}
+	return nil
+}
+
+func (l *LRU) get(key string) ([]byte, error) {
+	raw, err := l.cache.GetIFPresent(key)
+	if err != nil {
+		return nil, storage.ErrNotFound
+	}
+	return raw.([]byte), nil
+}
+
+func recordKey(holder common.Holder) string {
+	return "file:" + holder.GetProfileID() + ":" + holder.File
+}
+
+func listKey(holder common.Holder, version uint64) string {
+	return "list:" + holder.GetProfileID() + ":" + strconv.FormatUint(version, 10)
+}
+
+func versionKey(holder common.Holder) string {
+	return "listversion:" + holder.GetProfileID()
+}
+
+func fileVersionKey(holder common.Holder) string {
+	return "fileversion:" + holder.GetProfileID() + ":" + holder.File
+}
+
+// None caches nothing, so every response is read from the metadata store. It
+// still keeps the versions of files and listings in memory, up to a number of
+// them, so that concurrent reads of the metadata store are only shared when
+// no change came between them.
+type None struct {
+	versions *LRU
+}
+
+func NewNone(size int) *None {
+	return &None{versions: NewLRU(size, 0)}
+}
+
+func (n *None) Get(context.Context, common.Holder) ([]byte, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (n *None) Set(context.Context, common.Holder, []byte) error {
+	return nil
+}
+
+func (n *None) Delete(ctx context.Context, holder common.Holder) error {
+	return n.versions.increment(fileVersionKey(holder))
+}
+
+func (n *None) FileVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	return n.versions.FileVersion(ctx, holder)
+}
+
+func (n *None) ListVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	return n.versions.ListVersion(ctx, holder)
+}
+
+func (n *None) GetList(context.Context, common.Holder, uint64) ([]byte, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (n *None) SetList(context.Context, common.Holder, uint64, []byte) error {
+	return nil
+}
+
+func (n *None) DeleteList(ctx context.Context, holder common.Holder) error {
+	return n.versions.DeleteList(ctx, holder)
+}
+
+func (n *None) Ping(context.Context) error {
+	return nil
+}
+
+// SHARED_BACKOFF is how long Tiered serves from its local tier alone after
+// the shared tier failed, so that requests do not each wait for the shared
+// tier to time out while it is down.
+const SHARED_BACKOFF = 10 * time.Second
+
+// Tiered serves responses from a local LRU in front of a shared cache such as
+// memcache. Responses read from the shared cache are kept locally, where
+// invalidations from other replicas do not reach them, so the local ttl should
+// be short. Listings and files are versioned by the shared cache, so a
+// response changed on any replica is not served again.
+//
+// When the shared cache fails, Tiered falls back to the versions kept by the
+// local tier and does not read from the shared cache for SHARED_BACKOFF. Until
+// then it behaves like the LRU alone, and changes made on other replicas are
+// only seen once the local responses expire. Deletes still reach the shared
+// cache, so that it does not serve what was changed while it was skipped.
+type Tiered struct {
+	local   *LRU
+	shared  storage.Cache
+	backoff time.Duration
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func NewTiered(local *LRU, shared storage.Cache) *Tiered {
+	return &Tiered{local: local, shared: shared, backoff: SHARED_BACKOFF}
+}
+
+func (t *Tiered) Get(ctx context.Context, holder common.Holder) ([]byte, error) {
+	if value, err := t.local.Get(ctx, holder); err == nil {
+		return value, nil
+	}
+	if !t.available() {
+		return nil, storage.ErrNotFound
+	}
+	value, err := t.shared.Get(ctx, holder)
+	if err != nil {
+		t.failed(ctx, err)
+		return nil, err
+	}
+	t.local.Set(ctx, holder, value)
+	return value, nil
+}
+
+func (t *Tiered) Set(ctx context.Context, holder common.Holder, value []byte) error {
+	t.local.Set(ctx, holder, value)
+	if !t.available() {
+		return nil
+	}
+	return t.failed(ctx, t.shared.Set(ctx, holder, value))
+}
+
+func (t *Tiered) Delete(ctx context.Context, holder common.Holder) error {
+	t.local.Delete(ctx, holder)
+	return t.failed(ctx, t.shared.Delete(ctx, holder))
+}
+
+func (t *Tiered) FileVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	if t.available() {
+		version, err := t.shared.FileVersion(ctx, holder)
+		if t.failed(ctx, err) == nil {
+			return version, nil
+		}
+	}
+	return t.local.FileVersion(ctx, holder)
+}
+
+func (t *Tiered) ListVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	if t.available() {
+		version, err := t.shared.ListVersion(ctx, holder)
+		if t.failed(ctx, err) == nil {
+			return version, nil
+		}
+	}
+	return t.local.ListVersion(ctx, holder)
+}
+
+func (t *Tiered) GetList(ctx context.Context, holder common.Holder, version uint64) ([]byte, error) {
+	if value, err := t.local.GetList(ctx, holder, version); err == nil {
+		return value, nil
+	}
+	if !t.available() {
+		return nil, storage.ErrNotFound
+	}
+	value, err := t.shared.GetList(ctx, holder, version)
+	if err != nil {
+		t.failed(ctx, err)
+		return nil, err
+	}
+	t.local.SetList(ctx, holder, version, value)
+	return value, nil
+}
+
+// SetList only stores the listing locally while the shared cache is skipped,
+// as the version it was read under is then one of the local tier.
+func (t *Tiered) SetList(ctx context.Context, holder common.Holder, version uint64, value []byte) error {
+	t.local.SetList(ctx, holder, version, value)
+	if !t.available() {
+		return nil
+	}
+	return t.failed(ctx, t.shared.SetList(ctx, holder, version, value))
+}
+
+func (t *Tiered) DeleteList(ctx context.Context, holder common.Holder) error {
+	t.local.DeleteList(ctx, holder)
+	return t.failed(ctx, t.shared.DeleteList(ctx, holder))
+}
+
+// Ping checks the shared cache, as the local one is always available.
+func (t *Tiered) Ping(ctx context.Context) error {
+	return t.shared.Ping(ctx)
+}
+
+// available reports whether the shared cache should be read, that is whether
+// it did not fail within the backoff.
+func (t *Tiered) available() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return !time.Now().Before(t.downUntil)
+}
+
+// failed skips the shared cache for the backoff if err is a failure of it.
+// Misses are not failures. It returns err.
+func (t *Tiered) failed(ctx context.Context, err error) error {
+	if err == nil || err == storage.ErrNotFound {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !time.Now().Before(t.downUntil) {
+		logging.From(ctx).WarnContext(ctx, "Serving from the local cache while the shared cache is unavailable",
+			"backoff", t.backoff, "error", err)
+	}
+	t.downUntil = time.Now().Add(t.backoff)
+	return err
+}
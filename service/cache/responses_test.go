@@ -0,0 +1,345 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+var (
+	holder  = common.Holder{User: common.User{Profile: "profile"}, File: "file.txt"}
+	another = common.Holder{User: common.User{Profile: "profile"}, File: "another.txt"}
+)
+
+var errUnreachable = errors.New("unreachable")
+
+// sharedCache is a shared tier kept in an LRU that fails every call with err
+// while it is set, and counts the calls that reached it.
+type sharedCache struct {
+	*LRU
+
+	mu    sync.Mutex
+	err   error
+	calls int
+}
+
+func newSharedCache() *sharedCache {
+	return &sharedCache{LRU: NewLRU(100, time.Minute)}
+}
+
+func (s *sharedCache) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *sharedCache) called() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func (s *sharedCache) call() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	return s.err
+}
+
+func (s *sharedCache) Get(ctx context.Context, holder common.Holder) ([]byte, error) {
+	if err := s.call(); err != nil {
+		return nil, err
+	}
+	return s.LRU.Get(ctx, holder)
+}
+
+func (s *sharedCache) Set(ctx context.Context, holder common.Holder, value []byte) error {
+	if err := s.call(); err != nil {
+		return err
+	}
+	return s.LRU.Set(ctx, holder, value)
+}
+
+func (s *sharedCache) Delete(ctx context.Context, holder common.Holder) error {
+	if err := s.call(); err != nil {
+		return err
+	}
+	return s.LRU.Delete(ctx, holder)
+}
+
+func (s *sharedCache) FileVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	if err := s.call(); err != nil {
+		return 0, err
+	}
+	return s.LRU.FileVersion(ctx, holder)
+}
+
+func (s *sharedCache) ListVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	if err := s.call(); err != nil {
+		return 0, err
+	}
+	return s.LRU.ListVersion(ctx, holder)
+}
+
+func (s *sharedCache) GetList(ctx context.Context, holder common.Holder, version uint64) ([]byte, error) {
+	if err := s.call(); err != nil {
+		return nil, err
+	}
+	return s.LRU.GetList(ctx, holder, version)
+}
+
+func (s *sharedCache) SetList(ctx context.Context, holder common.Holder, version uint64, value []byte) error {
+	if err := s.call(); err != nil {
+		return err
+	}
+	return s.LRU.SetList(ctx, holder, version, value)
+}
+
+func (s *sharedCache) DeleteList(ctx context.Context, holder common.Holder) error {
+	if err := s.call(); err != nil {
+		return err
+	}
+	return s.LRU.DeleteList(ctx, holder)
+}
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(100, time.Minute)
+
+	if _, err := l.Get(ctx, holder); err != storage.ErrNotFound {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	l.Set(ctx, holder, []byte("info"))
+	l.Set(ctx, another, []byte("another"))
+	if value, err := l.Get(ctx, holder); err != nil || string(value) != "info" {
+		t.Fatalf("expected the info, got %q, %v", value, err)
+	}
+
+	version, _ := l.FileVersion(ctx, holder)
+	if err := l.Delete(ctx, holder); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Get(ctx, holder); err != storage.ErrNotFound {
+		t.Errorf("expected the info to be removed, got %v", err)
+	}
+	if next, _ := l.FileVersion(ctx, holder); next != version+1 {
+		t.Errorf("expected file version %d after the delete, got %d", version+1, next)
+	}
+	if value, err := l.Get(ctx, another); err != nil || string(value) != "another" {
+		t.Errorf("expected other files to stay cached, got %q, %v", value, err)
+	}
+}
+
+func TestLRUListVersions(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(100, time.Minute)
+
+	version, _ := l.ListVersion(ctx, holder)
+	if again, _ := l.ListVersion(ctx, holder); again != version {
+		t.Fatalf("expected the version to stay %d, got %d", version, again)
+	}
+	l.SetList(ctx, holder, version, []byte("list"))
+	if value, err := l.GetList(ctx, holder, version); err != nil || string(value) != "list" {
+		t.Fatalf("expected the listing, got %q, %v", value, err)
+	}
+
+	l.DeleteList(ctx, holder)
+	next, _ := l.ListVersion(ctx, holder)
+	if next != version+1 {
+		t.Fatalf("expected version %d after the delete, got %d", version+1, next)
+	}
+	if _, err := l.GetList(ctx, holder, next); err != storage.ErrNotFound {
+		t.Errorf("expected no listing for the new version, got %v", err)
+	}
+}
+
+func TestLRUExpires(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(100, 10*time.Millisecond)
+
+	l.Set(ctx, holder, []byte("info"))
+	l.SetList(ctx, holder, 1, []byte("list"))
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := l.Get(ctx, holder); err != storage.ErrNotFound {
+		t.Errorf("expected the info to expire, got %v", err)
+	}
+	if _, err := l.GetList(ctx, holder, 1); err != storage.ErrNotFound {
+		t.Errorf("expected the listing to expire, got %v", err)
+	}
+}
+
+func TestLRUEvictedVersionsRestartAbove(t *testing.T) {
+	ctx := context.Background()
+	l := NewLRU(1, time.Minute)
+
+	version, _ := l.ListVersion(ctx, holder)
+	l.DeleteList(ctx, holder)
+	l.Set(ctx, another, []byte("another"))
+
+	if next, _ := l.ListVersion(ctx, holder); next <= version+1 {
+		t.Errorf("expected an evicted version to restart above %d, got %d", version+1, next)
+	}
+}
+
+func TestNone(t *testing.T) {
+	ctx := context.Background()
+	n := NewNone(100)
+
+	n.Set(ctx, holder, []byte("info"))
+	if _, err := n.Get(ctx, holder); err != storage.ErrNotFound {
+		t.Errorf("expected nothing to be cached, got %v", err)
+	}
+	n.SetList(ctx, holder, 1, []byte("list"))
+	if _, err := n.GetList(ctx, holder, 1); err != storage.ErrNotFound {
+		t.Errorf("expected no listing to be cached, got %v", err)
+	}
+
+	file, _ := n.FileVersion(ctx, holder)
+	list, _ := n.ListVersion(ctx, holder)
+	n.Delete(ctx, holder)
+	n.DeleteList(ctx, holder)
+	if next, _ := n.FileVersion(ctx, holder); next != file+1 {
+		t.Errorf("expected file version %d after the delete, got %d", file+1, next)
+	}
+	if next, _ := n.ListVersion(ctx, holder); next != list+1 {
+		t.Errorf("expected list version %d after the delete, got %d", list+1, next)
+	}
+}
+
+func TestTieredReadsThroughShared(t *testing.T) {
+	ctx := context.Background()
+	shared := newSharedCache()
+	tiered := NewTiered(NewLRU(100, time.Minute), shared)
+
+	shared.Set(ctx, holder, []byte("info"))
+	if value, err := tiered.Get(ctx, holder); err != nil || string(value) != "info" {
+		t.Fatalf("expected the shared info, got %q, %v", value, err)
+	}
+	calls := shared.called()
+	if value, err := tiered.Get(ctx, holder); err != nil || string(value) != "info" {
+		t.Fatalf("expected the local info, got %q, %v", value, err)
+	}
+	if shared.called() != calls {
+		t.Error("expected the second read to be served locally")
+	}
+}
+
+func TestTieredVersionsAreShared(t *testing.T) {
+	ctx := context.Background()
+	shared := newSharedCache()
+	first := NewTiered(NewLRU(100, time.Minute), shared)
+	second := NewTiered(NewLRU(100, time.Minute), shared)
+
+	version, _ := first.ListVersion(ctx, holder)
+	first.SetList(ctx, holder, version, []byte("list"))
+	second.DeleteList(ctx, holder)
+
+	next, err := first.ListVersion(ctx, holder)
+	if err != nil || next != version+1 {
+		t.Fatalf("expected version %d after a delete on another replica, got %d, %v", version+1, next, err)
+	}
+	if _, err := first.GetList(ctx, holder, next); err != storage.ErrNotFound {
+		t.Errorf("expected no listing for the new version, got %v", err)
+	}
+
+	file, _ := first.FileVersion(ctx, holder)
+	second.Delete(ctx, holder)
+	if next, _ := first.FileVersion(ctx, holder); next != file+1 {
+		t.Errorf("expected file version %d after a delete on another replica, got %d", file+1, next)
+	}
+}
+
+func TestTieredFallsBackToLocalVersions(t *testing.T) {
+	ctx := context.Background()
+	shared := newSharedCache()
+	tiered := NewTiered(NewLRU(100, time.Minute), shared)
+	shared.fail(errUnreachable)
+
+	version, err := tiered.ListVersion(ctx, holder)
+	if err != nil {
+		t.Fatalf("expected a local version, got %v", err)
+	}
+	tiered.SetList(ctx, holder, version, []byte("list"))
+	if value, err := tiered.GetList(ctx, holder, version); err != nil || string(value) != "list" {
+		t.Fatalf("expected the local listing, got %q, %v", value, err)
+	}
+
+	if err := tiered.DeleteList(ctx, holder); err != errUnreachable {
+		t.Errorf("expected the shared failure, got %v", err)
+	}
+	if next, err := tiered.ListVersion(ctx, holder); err != nil || next != version+1 {
+		t.Errorf("expected local version %d after the delete, got %d, %v", version+1, next, err)
+	}
+
+	file, err := tiered.FileVersion(ctx, holder)
+	if err != nil {
+		t.Fatalf("expected a local file version, got %v", err)
+	}
+	tiered.Delete(ctx, holder)
+	if next, err := tiered.FileVersion(ctx, holder); err != nil || next != file+1 {
+		t.Errorf("expected local file version %d after the delete, got %d, %v", file+1, next, err)
+	}
+}
+
+func TestTieredSkipsFailedShared(t *testing.T) {
+	ctx := context.Background()
+	shared := newSharedCache()
+	tiered := NewTiered(NewLRU(100, time.Minute), shared)
+	shared.fail(errUnreachable)
+
+	tiered.ListVersion(ctx, holder)
+	calls := shared.called()
+
+	tiered.ListVersion(ctx, holder)
+	tiered.FileVersion(ctx, holder)
+	tiered.Get(ctx, holder)
+	tiered.Set(ctx, holder, []byte("info"))
+	tiered.GetList(ctx, holder, 1)
+	tiered.SetList(ctx, holder, 1, []byte("list"))
+	if shared.called() != calls {
+		t.Errorf("expected reads and writes to skip the shared cache, got %d calls", shared.called()-calls)
+	}
+
+	tiered.Delete(ctx, holder)
+	tiered.DeleteList(ctx, holder)
+	if shared.called() != calls+2 {
+		t.Errorf("expected deletes to reach the shared cache, got %d calls", shared.called()-calls)
+	}
+}
+
+func TestTieredMissesDoNotSkipShared(t *testing.T) {
+	ctx := context.Background()
+	shared := newSharedCache()
+	tiered := NewTiered(NewLRU(100, time.Minute), shared)
+
+	if _, err := tiered.Get(ctx, holder); err != storage.ErrNotFound {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	shared.Set(ctx, holder, []byte("info"))
+	if value, err := tiered.Get(ctx, holder); err != nil || string(value) != "info" {
+		t.Errorf("expected the shared info after a miss, got %q, %v", value, err)
+	}
+}
+
+func TestTieredReturnsToShared(t *testing.T) {
+	ctx := context.Background()
+	shared := newSharedCache()
+	tiered := NewTiered(NewLRU(100, time.Minute), shared)
+	tiered.backoff = 10 * time.Millisecond
+
+	version, _ := shared.ListVersion(ctx, holder)
+	shared.fail(errUnreachable)
+	tiered.ListVersion(ctx, holder)
+	shared.fail(nil)
+
+	time.Sleep(20 * time.Millisecond)
+	if next, err := tiered.ListVersion(ctx, holder); err != nil || next != version {
+		t.Errorf("expected the shared version %d after the backoff, got %d, %v", version, next, err)
+	}
+}
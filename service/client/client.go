@@ -0,0 +1,270 @@
+// Package client calls the upload.ly REST API.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/apierror"
+)
+
+const (
+	// Header carrying Google ID tokens
+	AUTH_TOKEN = "X-CloudProject-Token"
+	// Header carrying API keys
+	API_KEY = "X-CloudProject-Key"
+	// Prefix of API keys, used to tell them apart from tokens
+	KEY_PREFIX = "upl_"
+
+	// Retries of a failed request after the first attempt
+	DEFAULT_RETRIES = 3
+	// Wait before the first retry. It doubles on every retry.
+	DEFAULT_MIN_BACKOFF = 500 * time.Millisecond
+	// Longest wait between retries
+	DEFAULT_MAX_BACKOFF = 10 * time.Second
+)
+
+// TokenSource supplies the credential sent with every request. It is called
+// before every attempt, so it can refresh tokens that expire.
+type TokenSource interface {
+	Token(context.Context) (string, error)
+}
+
+// TokenSourceFunc adapts a function to a TokenSource.
+type TokenSourceFunc func(context.Context) (string, error)
+
+func (f TokenSourceFunc) Token(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// StaticToken always sends the same Google ID token or API key.
+func StaticToken(credential string) TokenSource {
+	return TokenSourceFunc(func(context.Context) (string, error) {
+		return credential, nil
+	})
+}
+
+type Client struct {
+	endpoint   string
+	http       *http.Client
+	tokens     TokenSource
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sends requests with the given client instead of
+// http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.http = c
+	}
+}
+
+// WithTokenSource authenticates requests with credentials from the source.
+func WithTokenSource(tokens TokenSource) Option {
+	return func(client *Client) {
+		client.tokens = tokens
+	}
+}
+
+// WithRetries sets how many times failed requests are retried. Zero disables
+// retries.
+func WithRetries(retries int) Option {
+	return func(client *Client) {
+		client.retries = retries
+	}
+}
+
+// WithBackoff sets the wait before the first retry and the longest wait
+// between retries.
+func WithBackoff(min, max time.Duration) Option {
+	return func(client *Client) {
+		client.minBackoff, client.maxBackoff = min, max
+	}
+}
+
+// New creates a client for the API served at the endpoint, such as
+// https://uploadly.vjsamuel.me/api/v1.
+func New(endpoint string, opts ...Option) (*Client, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("endpoint %q must be an http or https URL", endpoint)
+	}
+
+	c := &Client{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		http:       http.DefaultClient,
+		retries:    DEFAULT_RETRIES,
+		minBackoff: DEFAULT_MIN_BACKOFF,
+		maxBackoff: DEFAULT_MAX_BACKOFF,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.tokens == nil {
+		return nil, fmt.Errorf("a token source is required")
+	}
+	if c.retries < 0 || c.minBackoff < 0 || c.maxBackoff < c.minBackoff {
+		return nil, fmt.Errorf("retries and backoff must not be negative, and the max backoff must not be below the min")
+	}
+	return c, nil
+}
+
+// Error is returned for requests the API responded to with an error status.
+type Error struct {
+	StatusCode int
+	// Machine readable error code such as not_found or rate_limited
+	Code      string
+	Message   string
+	RequestID string
+	Details   map[string]string
+	// Time to wait before retrying, set on 429 responses
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%d %s: %s (request %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound reports whether the error is a 404 from the API.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// body creates the body of an attempt along with its content type and its
+// length, or -1 when the length is unknown.
+type body func() (io.Reader, string, int64, error)
+
+// do sends the request, retrying on network errors, 5xx and 429 responses
+// while the body can be recreated. Error responses are returned as *Error.
+func (c *Client) do(ctx context.Context, method, path string, newBody body, replayable bool) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := c.request(ctx, method, path, newBody)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.http.Do(req)
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			return resp, nil
+		}
+
+		// Requests that failed to reach the API are always retried
+		var wait time.Duration
+		if err == nil {
+			apiErr := decodeError(resp)
+			resp.Body.Close()
+			if apiErr.StatusCode != http.StatusTooManyRequests && apiErr.StatusCode < http.StatusInternalServerError {
+				return nil, apiErr
+			}
+			err, wait = apiErr, apiErr.RetryAfter
+		}
+		if !replayable || attempt >= c.retries {
+			return nil, err
+		}
+
+		if backoff := c.backoff(attempt); backoff > wait {
+			wait = backoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) request(ctx context.Context, method, path string, newBody body) (*http.Request, error) {
+	var reader io.Reader
+	var contentType string
+	length := int64(-1)
+	if newBody != nil {
+		var err error
+		if reader, contentType, length, err = newBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if length >= 0 {
+		req.ContentLength = length
+	}
+
+	credential, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get credential: %w", err)
+	}
+	if strings.HasPrefix(credential, KEY_PREFIX) {
+		req.Header.Set(API_KEY, credential)
+	} else {
+		req.Header.Set(AUTH_TOKEN, credential)
+	}
+	return req, nil
+}
+
+// backoff doubles the wait on every retry, with jitter so that clients
+// rejected together do not retry together.
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.minBackoff << uint(attempt)
+	if wait > c.maxBackoff || wait <= 0 {
+		wait = c.maxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func decodeError(resp *http.Response) *Error {
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+
+	var envelope struct {
+		Error apierror.Error `json:"error"`
+	}
+	bytes, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(bytes, &envelope); err == nil && envelope.Error.Code != "" {
+		apiErr.Code = envelope.Error.Code
+		apiErr.Message = envelope.Error.Message
+		apiErr.RequestID = envelope.Error.RequestID
+		apiErr.Details = envelope.Error.Details
+	} else if text := strings.TrimSpace(string(bytes)); text != "" {
+		apiErr.Message = text
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get(apierror.REQUEST_ID)
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
@@ -0,0 +1,286 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/client"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/uploadly"
+	"github.com/vjsamuel/uploadly/service/uploadly/uploadlytest"
+)
+
+var (
+	owner  = common.User{Profile: "owner", Scopes: common.Scopes}
+	reader = common.User{Profile: "owner", Scopes: []string{common.SCOPE_READ}}
+)
+
+// flaky fails the requests matching fail with the status before passing them
+// on to the router, and counts every request it receives.
+type flaky struct {
+	next http.Handler
+
+	mu         sync.Mutex
+	requests   int
+	failures   int
+	status     int
+	retryAfter string
+	fail       func(*http.Request) bool
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests++
+	failing := f.failures > 0 && (f.fail == nil || f.fail(r))
+	if failing {
+		f.failures--
+	}
+	f.mu.Unlock()
+
+	if failing {
+		// Read the body like a server that failed while storing it
+		io.Copy(io.Discard, r.Body)
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		w.WriteHeader(f.status)
+		return
+	}
+	f.next.ServeHTTP(w, r)
+}
+
+// failNext fails the next requests matching fail with the status.
+func (f *flaky) failNext(failures, status int, retryAfter string, fail func(*http.Request) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests, f.failures, f.status, f.retryAfter, f.fail = 0, failures, status, retryAfter, fail
+}
+
+func (f *flaky) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// serve starts the real router on in-memory backends and returns a client of
+// it sending the token, "owner" or "reader".
+func serve(t *testing.T, token string) (*client.Client, *flaky, *uploadlytest.Store) {
+	t.Helper()
+
+	store := uploadlytest.NewStore()
+	opts := store.Options(map[string]common.User{"owner": owner, "reader": reader})
+	opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	server, err := uploadly.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	handler := &flaky{next: server.Router()}
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	c, err := client.New(ts.URL+"/api/v1",
+		client.WithTokenSource(client.StaticToken(token)),
+		client.WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, handler, store
+}
+
+func isUpload(r *http.Request) bool {
+	return r.URL.Path == "/api/v1/files" && r.Method != http.MethodGet
+}
+
+func TestFiles(t *testing.T) {
+	c, _, store := serve(t, "owner")
+	ctx := context.Background()
+
+	err := c.Upload(ctx, "notes.txt", strings.NewReader("first"), &client.UploadOptions{Description: "Notes", ContentType: "text/plain"})
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if data, _ := store.Object(common.Holder{File: "notes.txt", User: owner}); string(data) != "first" {
+		t.Errorf("stored %q, expected %q", data, "first")
+	}
+
+	info, err := c.Info(ctx, "notes.txt")
+	if err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	if info.File != "notes.txt" || info.Size != 5 || info.Version != 1 || info.Description != "Notes" || info.Type != "text/plain" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	if err := c.Update(ctx, "notes.txt", strings.NewReader("second"), nil); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	var contents bytes.Buffer
+	n, err := c.Get(ctx, "notes.txt", &contents)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if contents.String() != "second" || n != 6 {
+		t.Errorf("got %q (%d bytes), expected %q", contents.String(), n, "second")
+	}
+
+	files, err := c.List(ctx)
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if len(files) != 1 || files[0].File != "notes.txt" || files[0].Version != 2 {
+		t.Errorf("unexpected listing %+v", files)
+	}
+
+	if err := c.Delete(ctx, "notes.txt"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err := c.Info(ctx, "notes.txt"); !client.IsNotFound(err) {
+		t.Errorf("expected the deleted file to be missing, got %v", err)
+	}
+	if files, err := c.List(ctx); err != nil || len(files) != 0 {
+		t.Errorf("expected no files, got %+v, %v", files, err)
+	}
+}
+
+func TestUpdateMissing(t *testing.T) {
+	c, _, _ := serve(t, "owner")
+
+	err := c.Update(context.Background(), "missing.txt", strings.NewReader("data"), nil)
+	if !client.IsNotFound(err) {
+		t.Errorf("expected updating a missing file to fail with a 404, got %v", err)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	c, handler, _ := serve(t, "reader")
+
+	err := c.Upload(context.Background(), "notes.txt", strings.NewReader("data"), nil)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an API error, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusForbidden || apiErr.Code != "forbidden" || apiErr.Message == "" {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+	if apiErr.RequestID == "" {
+		t.Error("expected the request ID of the failed request")
+	}
+	if requests := handler.count(); requests != 1 {
+		t.Errorf("expected client errors not to be retried, got %d requests", requests)
+	}
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	c, handler, _ := serve(t, "owner")
+	ctx := context.Background()
+	if err := c.Upload(ctx, "notes.txt", strings.NewReader("data"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	handler.failNext(2, http.StatusServiceUnavailable, "", nil)
+	files, err := c.List(ctx)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected the listing after retries, got %+v, %v", files, err)
+	}
+	if requests := handler.count(); requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+
+	handler.failNext(10, http.StatusInternalServerError, "", nil)
+	_, err = c.Info(ctx, "notes.txt")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the last 500 once retries ran out, got %v", err)
+	}
+	if requests := handler.count(); requests != client.DEFAULT_RETRIES+1 {
+		t.Errorf("expected %d requests, got %d", client.DEFAULT_RETRIES+1, requests)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	c, handler, _ := serve(t, "owner")
+
+	handler.failNext(1, http.StatusTooManyRequests, "1", nil)
+	start := time.Now()
+	if _, err := c.List(context.Background()); err != nil {
+		t.Fatalf("expected the listing after the rate limit, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected the retry to wait for Retry-After, waited %v", elapsed)
+	}
+	if requests := handler.count(); requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestRetriesSeekableUpload(t *testing.T) {
+	c, handler, store := serve(t, "owner")
+
+	var mu sync.Mutex
+	var progress [][2]int64
+	opts := &client.UploadOptions{
+		Size: 5,
+		Progress: func(sent, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			progress = append(progress, [2]int64{sent, total})
+		},
+	}
+
+	handler.failNext(1, http.StatusBadGateway, "", isUpload)
+	if err := c.Upload(context.Background(), "notes.txt", bytes.NewReader([]byte("hello")), opts); err != nil {
+		t.Fatalf("expected the upload to be retried, got %v", err)
+	}
+	if requests := handler.count(); requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+	if data, _ := store.Object(common.Holder{File: "notes.txt", User: owner}); string(data) != "hello" {
+		t.Errorf("stored %q, expected %q", data, "hello")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(progress) == 0 || progress[len(progress)-1] != [2]int64{5, 5} {
+		t.Errorf("expected progress to end at 5 of 5, got %v", progress)
+	}
+	restarts := 0
+	for i := 1; i < len(progress); i++ {
+		if progress[i][0] <= progress[i-1][0] {
+			restarts++
+		}
+	}
+	if restarts != 1 {
+		t.Errorf("expected progress to start over once for the retry, got %v", progress)
+	}
+}
+
+func TestDoesNotRetryStreamedUpload(t *testing.T) {
+	c, handler, store := serve(t, "owner")
+
+	// A reader that is not an io.Seeker can not be sent again
+	file := io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo"))
+	handler.failNext(1, http.StatusServiceUnavailable, "", isUpload)
+	err := c.Upload(context.Background(), "notes.txt", file, nil)
+
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the 503 of the only attempt, got %v", err)
+	}
+	if requests := handler.count(); requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+	if _, ok := store.Object(common.Holder{File: "notes.txt", User: owner}); ok {
+		t.Error("expected nothing to be stored")
+	}
+}
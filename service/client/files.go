@@ -0,0 +1,230 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// UploadOptions describes an uploaded file. All fields are optional.
+type UploadOptions struct {
+	Description string
+	// Content type of the file. Defaults to application/octet-stream
+	ContentType string
+	// Size of the file. When set it must be exact, so that the request can
+	// carry a Content-Length, and it is passed to Progress as the total
+	Size int64
+	// Progress is called as the file is sent with the bytes sent so far. It
+	// starts over from zero when the upload is retried.
+	Progress func(sent, total int64)
+}
+
+// Upload stores a new file under the name, streaming it from the reader.
+// Uploads are only retried when the reader is an io.Seeker, since the file has
+// to be sent again from the start.
+func (c *Client) Upload(ctx context.Context, name string, file io.Reader, opts *UploadOptions) error {
+	return c.upload(ctx, http.MethodPost, name, file, opts)
+}
+
+// Update replaces the contents of an existing file. It fails with a 404 error
+// when the file does not exist.
+func (c *Client) Update(ctx context.Context, name string, file io.Reader, opts *UploadOptions) error {
+	return c.upload(ctx, http.MethodPut, name, file, opts)
+}
+
+// List returns the metadata of all files of the user.
+func (c *Client) List(ctx context.Context) ([]common.Response, error) {
+	var files []common.Response
+	if err := c.getJSON(ctx, "/files", &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Info returns the metadata of a file.
+func (c *Client) Info(ctx context.Context, name string) (*common.Response, error) {
+	var file common.Response
+	if err := c.getJSON(ctx, "/file/"+url.PathEscape(name)+"/info", &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// Get writes the contents of a file to w and returns the number of bytes
+// written. Failed requests are retried until the file starts downloading.
+func (c *Client) Get(ctx context.Context, name string, w io.Writer) (int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/file/"+url.PathEscape(name), nil, true)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// Delete removes a file. It fails with a 404 error when the file does not
+// exist.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/file/"+url.PathEscape(name), nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) upload(ctx context.Context, method, name string, file io.Reader, opts *UploadOptions) error {
+	if name == "" {
+		return fmt.Errorf("a file name is required")
+	}
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+
+	seeker, replayable := file.(io.Seeker)
+	var start int64
+	if replayable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			replayable = false
+		}
+	}
+
+	// The previous attempt may still be reading the file after its request
+	// failed, so it is stopped and waited for before the file is rewound
+	var pipe *io.PipeReader
+	var written chan struct{}
+	finish := func() {
+		if pipe != nil {
+			pipe.Close()
+			<-written
+		}
+	}
+	newBody := func() (io.Reader, string, int64, error) {
+		if pipe != nil {
+			finish()
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, "", 0, fmt.Errorf("unable to rewind file: %w", err)
+			}
+		}
+
+		done := make(chan struct{})
+		reader, writer := io.Pipe()
+		form := multipart.NewWriter(writer)
+		length := int64(-1)
+		if opts.Size > 0 {
+			overhead, err := formOverhead(form.Boundary(), name, opts)
+			if err != nil {
+				return nil, "", 0, err
+			}
+			length = overhead + opts.Size
+		}
+
+		pipe, written = reader, done
+		go func() {
+			defer close(done)
+			writer.CloseWithError(writeForm(form, name, file, opts))
+		}()
+		return reader, form.FormDataContentType(), length, nil
+	}
+
+	resp, err := c.do(ctx, method, "/files", newBody, replayable)
+	finish()
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// writeForm writes the multipart form the upload routes expect.
+func writeForm(form *multipart.Writer, name string, file io.Reader, opts *UploadOptions) error {
+	if opts.Description != "" {
+		if err := form.WriteField("description", opts.Description); err != nil {
+			return err
+		}
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, quoteEscaper.Replace(name)))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	if opts.Progress != nil {
+		file = &progressReader{reader: file, total: opts.Size, progress: opts.Progress}
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return err
+	}
+	return form.Close()
+}
+
+// formOverhead returns the length of the form without the contents of the
+// file, so that the length of the whole form is known before it is streamed.
+func formOverhead(boundary, name string, opts *UploadOptions) (int64, error) {
+	counter := &countingWriter{}
+	form := multipart.NewWriter(counter)
+	if err := form.SetBoundary(boundary); err != nil {
+		return 0, err
+	}
+	empty := *opts
+	empty.Progress = nil
+	if err := writeForm(form, name, strings.NewReader(""), &empty); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
+
+type progressReader struct {
+	reader   io.Reader
+	sent     int64
+	total    int64
+	progress func(sent, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		p.sent += int64(n)
+		p.progress(p.sent, p.total)
+	}
+	return n, err
+}
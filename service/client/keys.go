@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// CreateKey creates an API key limited to the scopes, or granted all files
+// scopes when none are passed. A zero expiry creates a key that does not
+// expire. The key is only returned here and can not be retrieved later. Keys
+// can only be managed with a Google ID token.
+func (c *Client) CreateKey(ctx context.Context, name string, scopes []string, expiry time.Time) (*common.KeyResponse, error) {
+	return c.createKey(ctx, url.Values{"name": {name}}, scopes, expiry)
+}
+
+// RegisterPublicKey registers an SSH public key, in authorized_keys format,
+// for signing in over SFTP. It is limited to the scopes and expires like an
+// API key does.
+func (c *Client) RegisterPublicKey(ctx context.Context, name, publicKey string, scopes []string, expiry time.Time) (*common.KeyResponse, error) {
+	return c.createKey(ctx, url.Values{"name": {name}, "ssh_public_key": {publicKey}}, scopes, expiry)
+}
+
+func (c *Client) createKey(ctx context.Context, form url.Values, scopes []string, expiry time.Time) (*common.KeyResponse, error) {
+	if len(scopes) > 0 {
+		form.Set("scopes", strings.Join(scopes, ","))
+	}
+	if !expiry.IsZero() {
+		form.Set("expiry", expiry.UTC().Format(time.RFC3339))
+	}
+	encoded := form.Encode()
+	newBody := func() (io.Reader, string, int64, error) {
+		return strings.NewReader(encoded), "application/x-www-form-urlencoded", int64(len(encoded)), nil
+	}
+
+	// A retry could conflict with the key created by the failed attempt
+	resp, err := c.do(ctx, http.MethodPost, "/keys", newBody, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var key common.KeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return nil, fmt.Errorf("unable to decode response: %w", err)
+	}
+	return &key, nil
+}
+
+// ListKeys returns the API keys of the user, without the keys themselves.
+func (c *Client) ListKeys(ctx context.Context) ([]common.KeyResponse, error) {
+	var keys []common.KeyResponse
+	if err := c.getJSON(ctx, "/keys", &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeKey deletes the named API key.
+func (c *Client) RevokeKey(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/key/"+url.PathEscape(name), nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/client"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/dirsync"
+)
+
+func login(ctx context.Context, args []string) error {
+	fs := flags("login", "")
+	endpoint := fs.String("endpoint", "", "API endpoint, defaults to the stored one or "+DEFAULT_ENDPOINT)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	if *endpoint != "" {
+		creds.Endpoint = *endpoint
+	}
+
+	// Read from stdin so that the credential stays out of the shell history
+	fmt.Fprint(os.Stderr, "Paste a Google ID token or an API key: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("unable to read credential: %v", err)
+	}
+	creds.Credential = strings.TrimSpace(line)
+
+	c, err := creds.client()
+	if err != nil {
+		return err
+	}
+	if _, err := c.List(ctx); err != nil {
+		return fmt.Errorf("credential was not accepted: %v", err)
+	}
+
+	path, err := creds.save()
+	if err != nil {
+		return fmt.Errorf("unable to store credentials: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Logged in to %s, credentials stored in %s\n", creds.Endpoint, path)
+	return nil
+}
+
+func list(ctx context.Context, args []string) error {
+	fs := flags("ls", "[pattern...]")
+	asJSON := fs.Bool("json", false, "Print the files as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, _, err := newClient()
+	if err != nil {
+		return err
+	}
+	files, err := c.List(ctx)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		if files, err = match(files, fs.Args(), false); err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		return printJSON(files)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tVERSION\tTYPE\tLAST MODIFIED\tDESCRIPTION")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", f.File, size(f.Size), f.Version, f.Type,
+			f.LastModified.Local().Format(time.DateTime), f.Description)
+	}
+	return w.Flush()
+}
+
+func put(ctx context.Context, args []string) error {
+	return upload(ctx, "put", args, (*client.Client).Upload)
+}
+
+func update(ctx context.Context, args []string) error {
+	return upload(ctx, "update", args, (*client.Client).Update)
+}
+
+type uploadFunc func(*client.Client, context.Context, string, io.Reader, *client.UploadOptions) error
+
+func upload(ctx context.Context, name string, args []string, send uploadFunc) error {
+	fs := flags(name, "file...")
+	description := fs.String("d", "", "Description of the files")
+	contentType := fs.String("t", "", "Content type of the files, guessed from the extension by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no files given")
+	}
+
+	paths, err := expand(fs.Args())
+	if err != nil {
+		return err
+	}
+	c, _, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if err := uploadFile(ctx, c, send, p, *description, *contentType); err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func uploadFile(ctx context.Context, c *client.Client, send uploadFunc, p, description, contentType string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("is a directory")
+	}
+
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(p))
+	}
+	name := filepath.Base(p)
+	bar := newProgress(name)
+	err = send(c, ctx, name, f, &client.UploadOptions{
+		Description: description,
+		ContentType: contentType,
+		Size:        stat.Size(),
+		Progress:    bar.update,
+	})
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Uploaded %s\n", name)
+	return nil
+}
+
+func get(ctx context.Context, args []string) error {
+	fs := flags("get", "name|pattern...")
+	dir := fs.String("o", ".", "Directory files are written to, or - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no files given")
+	}
+
+	c, _, err := newClient()
+	if err != nil {
+		return err
+	}
+	files, err := c.List(ctx)
+	if err != nil {
+		return err
+	}
+	if files, err = match(files, fs.Args(), true); err != nil {
+		return err
+	}
+
+	if *dir == "-" {
+		for _, f := range files {
+			if _, err := c.Get(ctx, f.File, os.Stdout); err != nil {
+				return fmt.Errorf("%s: %v", f.File, err)
+			}
+		}
+		return nil
+	}
+
+	for _, f := range files {
+		if err := download(ctx, c, f, *dir); err != nil {
+			return fmt.Errorf("%s: %v", f.File, err)
+		}
+	}
+	return nil
+}
+
+// download writes the file to a temporary file in the directory that is only
+// renamed once it is complete, so that failed downloads leave nothing behind.
+func download(ctx context.Context, c *client.Client, f common.Response, dir string) error {
+	// Names come from the server and must not escape the directory
+	name := filepath.Base(filepath.Clean("/" + f.File))
+	if name == "/" || name == "." {
+		return fmt.Errorf("unsafe file name")
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bar := newProgress(f.File)
+	_, err = c.Get(ctx, f.File, bar.writer(tmp, f.Size))
+	bar.finish()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Downloaded %s\n", f.File)
+	return nil
+}
+
+func remove(ctx context.Context, args []string) error {
+	fs := flags("rm", "name|pattern...")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no files given")
+	}
+
+	c, _, err := newClient()
+	if err != nil {
+		return err
+	}
+	files, err := c.List(ctx)
+	if err != nil {
+		return err
+	}
+	if files, err = match(files, fs.Args(), true); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := c.Delete(ctx, f.File); err != nil {
+			return fmt.Errorf("%s: %v", f.File, err)
+		}
+		fmt.Fprintf(os.Stderr, "Deleted %s\n", f.File)
+	}
+	return nil
+}
+
+func info(ctx context.Context, args []string) error {
+	fs := flags("info", "name...")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no files given")
+	}
+
+	c, _, err := newClient()
+	if err != nil {
+		return err
+	}
+	for _, name := range fs.Args() {
+		file, err := c.Info(ctx, name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := printJSON(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func share(ctx context.Context, args []string) error {
+	fs := flags("share", "name")
+	expires := fs.Duration("expires", 24*time.Hour, "How long the file can be downloaded")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one file must be given")
+	}
+	if *expires <= 0 {
+		return fmt.Errorf("expires must be positive")
+	}
+
+	c, creds, err := newClient()
+	if err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	if _, err := c.Info(ctx, name); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	// The API has no per-file grants, so the file is shared with a read-only
+	// key that expires
+	expiry := time.Now().Add(*expires)
+	keyName := fmt.Sprintf("share-%s-%d", name, expiry.Unix())
+	key, err := c.CreateKey(ctx, keyName, []string{common.SCOPE_READ}, expiry)
+	if err != nil {
+		return fmt.Errorf("unable to create key: %v", err)
+	}
+
+	link := strings.TrimSuffix(creds.Endpoint, "/") + "/file/" + url.PathEscape(name)
+	fmt.Printf("curl -H '%s: %s' -o '%s' '%s'\n", client.API_KEY, key.Key, path.Base(name), link)
+	fmt.Fprintf(os.Stderr, "The key %s can read all of your files until %s. Revoke it early with DELETE /key/%s.\n",
+		keyName, expiry.Local().Format(time.DateTime), url.PathEscape(keyName))
+	return nil
+}
+
+func syncDir(ctx context.Context, args []string) error {
+	fs := flags("sync", "[directory]")
+	opts := dirsync.Options{}
+	fs.StringVar(&opts.Direction, "direction", dirsync.PUSH, "push to upload, pull to download or both to carry changes either way")
+	fs.BoolVar(&opts.Delete, "delete", false, "Delete files missing on the side synced from")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Print the actions without taking them")
+	fs.Var((*patterns)(&opts.Include), "include", "Comma separated glob patterns of the names synced, repeatable")
+	fs.Var((*patterns)(&opts.Exclude), "exclude", "Comma separated glob patterns of the names left alone, repeatable")
+	fs.IntVar(&opts.Concurrency, "concurrency", dirsync.DEFAULT_CONCURRENCY, "Transfers run at the same time")
+	fs.StringVar(&opts.StateFile, "state", "", "State file, defaults to "+dirsync.STATE_FILE+" in the directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("only one directory can be synced")
+	}
+	dir := "."
+	if fs.NArg() == 1 {
+		dir = fs.Arg(0)
+	}
+
+	c, _, err := newClient()
+	if err != nil {
+		return err
+	}
+	actions, err := dirsync.Sync(ctx, c, dir, opts)
+
+	conflicts := 0
+	for _, a := range actions {
+		switch {
+		case a.Err != nil:
+			fmt.Fprintf(os.Stderr, "%-13s %s: %v\n", a.Op, a.Name, a.Err)
+		case a.Op == dirsync.CONFLICT:
+			conflicts++
+			fmt.Fprintf(os.Stderr, "%-13s %s (%s)\n", a.Op, a.Name, a.Reason)
+		default:
+			fmt.Printf("%-13s %s (%s)\n", a.Op, a.Name, a.Reason)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(actions) == 0 {
+		fmt.Fprintln(os.Stderr, "Already in sync")
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("conflicts left unresolved: %d", conflicts)
+	}
+	return nil
+}
+
+// patterns collects comma separated patterns from repeated flags.
+type patterns []string
+
+func (p *patterns) String() string { return strings.Join(*p, ",") }
+
+func (p *patterns) Set(raw string) error {
+	for _, pattern := range strings.Split(raw, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			*p = append(*p, pattern)
+		}
+	}
+	return nil
+}
+
+// expand replaces glob patterns among local paths with the files matching
+// them.
+func expand(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			if _, err := os.Stat(arg); err != nil {
+				return nil, err
+			}
+			matches = []string{arg}
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// match keeps the files matching any of the names or glob patterns. When
+// strict, every argument must match at least one file.
+func match(files []common.Response, args []string, strict bool) ([]common.Response, error) {
+	matched := map[string]bool{}
+	var result []common.Response
+	for _, arg := range args {
+		found := false
+		for _, f := range files {
+			ok, err := path.Match(arg, f.File)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+			if !ok && arg != f.File {
+				continue
+			}
+			found = true
+			if !matched[f.File] {
+				matched[f.File] = true
+				result = append(result, f)
+			}
+		}
+		if strict && !found {
+			return nil, fmt.Errorf("no file matches %q", arg)
+		}
+	}
+	return result, nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
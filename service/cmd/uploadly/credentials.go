@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vjsamuel/uploadly/service/client"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DEFAULT_ENDPOINT = "https://uploadly.vjsamuel.me/api/v1"
+
+	// Environment variables overriding the stored credentials
+	ENV_CONFIG     = "UPLOADLY_CONFIG"
+	ENV_ENDPOINT   = "UPLOADLY_ENDPOINT"
+	ENV_CREDENTIAL = "UPLOADLY_CREDENTIAL"
+)
+
+// credentials are stored by login and used by all other commands.
+type credentials struct {
+	Endpoint string `yaml:"endpoint"`
+	// Google ID token or API key
+	Credential string `yaml:"credential"`
+}
+
+// credentialsPath returns the file credentials are stored in, which is
+// uploadly/credentials.yml in the user's config directory by default.
+func credentialsPath() (string, error) {
+	if path := os.Getenv(ENV_CONFIG); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "uploadly", "credentials.yml"), nil
+}
+
+func loadCredentials() (*credentials, error) {
+	creds := &credentials{Endpoint: DEFAULT_ENDPOINT}
+
+	path, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(bytes, creds); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+		}
+	}
+
+	if endpoint := os.Getenv(ENV_ENDPOINT); endpoint != "" {
+		creds.Endpoint = endpoint
+	}
+	if credential := os.Getenv(ENV_CREDENTIAL); credential != "" {
+		creds.Credential = credential
+	}
+	return creds, nil
+}
+
+// save writes the credentials readable by the user only.
+func (c *credentials) save() (string, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+
+	bytes, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, bytes, 0600); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of an existing file
+	return path, os.Chmod(path, 0600)
+}
+
+func (c *credentials) client() (*client.Client, error) {
+	if c.Credential == "" {
+		return nil, fmt.Errorf("not logged in, run 'uploadly login' or set %s", ENV_CREDENTIAL)
+	}
+	return client.New(c.Endpoint, client.WithTokenSource(client.StaticToken(c.Credential)))
+}
+
+// newClient creates a client from the stored credentials.
+func newClient() (*client.Client, *credentials, error) {
+	creds, err := loadCredentials()
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := creds.client()
+	return c, creds, err
+}
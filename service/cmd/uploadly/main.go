@@ -0,0 +1,84 @@
+// Command uploadly manages files stored in upload.ly from the command line.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `Usage: uploadly <command> [flags] [arguments]
+
+Commands:
+  login    Store the endpoint and credential used by the other commands
+  ls       List files, optionally matching glob patterns
+  put      Upload local files, expanding glob patterns
+  update   Replace the contents of existing files
+  get      Download files by name or glob pattern
+  rm       Delete files by name or glob pattern
+  info     Show the metadata of files
+  share    Create an expiring read-only key to download a file
+  sync     Sync a directory with the files in either or both directions
+
+Run 'uploadly <command> -h' for the flags of a command.
+`
+
+type command func(ctx context.Context, args []string) error
+
+var commands = map[string]command{
+	"login":  login,
+	"ls":     list,
+	"put":    put,
+	"update": update,
+	"get":    get,
+	"rm":     remove,
+	"info":   info,
+	"share":  share,
+	"sync":   syncDir,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		fmt.Print(usage)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "uploadly: unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd(ctx, os.Args[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "uploadly %s: %v\n", name, err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+// flags creates the flag set of a command. Parse errors are returned rather
+// than exiting so that main reports them.
+func flags(name, arguments string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: uploadly %s [flags] %s\n", name, arguments)
+		fs.PrintDefaults()
+	}
+	return fs
+}
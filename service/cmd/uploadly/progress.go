@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Width of the bar in characters
+	BAR_WIDTH = 30
+	// Shortest time between redraws
+	REDRAW_INTERVAL = 100 * time.Millisecond
+)
+
+// progress draws a progress bar for a transfer on stderr. Nothing is drawn
+// when stderr is not a terminal.
+type progress struct {
+	name    string
+	out     io.Writer
+	enabled bool
+	drawn   time.Time
+}
+
+func newProgress(name string) *progress {
+	stat, err := os.Stderr.Stat()
+	return &progress{
+		name:    name,
+		out:     os.Stderr,
+		enabled: err == nil && stat.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+// update redraws the bar. A total of zero means the size is unknown.
+func (p *progress) update(done, total int64) {
+	if !p.enabled || (time.Since(p.drawn) < REDRAW_INTERVAL && (total == 0 || done < total)) {
+		return
+	}
+	p.drawn = time.Now()
+
+	if total <= 0 {
+		fmt.Fprintf(p.out, "\r%s %s", p.name, size(done))
+		return
+	}
+	if done > total {
+		done = total
+	}
+	filled := int(done * BAR_WIDTH / total)
+	fmt.Fprintf(p.out, "\r%s [%s%s] %3d%% %s/%s", p.name, strings.Repeat("=", filled), strings.Repeat(" ", BAR_WIDTH-filled),
+		done*100/total, size(done), size(total))
+}
+
+// finish ends the line of the bar.
+func (p *progress) finish() {
+	if p.enabled && !p.drawn.IsZero() {
+		fmt.Fprintln(p.out)
+	}
+}
+
+// writer counts the bytes written through it towards the bar.
+func (p *progress) writer(w io.Writer, total int64) io.Writer {
+	return &progressWriter{writer: w, total: total, progress: p}
+}
+
+type progressWriter struct {
+	writer   io.Writer
+	written  int64
+	total    int64
+	progress *progress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.writer.Write(b)
+	p.written += int64(n)
+	p.progress.update(p.written, p.total)
+	return n, err
+}
+
+// size formats a byte count for people.
+func size(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
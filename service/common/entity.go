@@ -14,6 +14,20 @@ type Entity struct {
 type Profile struct {
 	FirstName string `datastore:"first_name"`
 	LastName  string `datastore:"last_name"`
+	Disabled  bool   `datastore:"disabled"`
+}
+
+type UserResponse struct {
+	Profile   string `json:"profile"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Disabled  bool   `json:"disabled"`
+}
+
+type UsageResponse struct {
+	Profile string `json:"profile"`
+	Files   int    `json:"files"`
+	Size    int64  `json:"size"`
 }
 
 type Response struct {
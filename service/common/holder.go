@@ -1,12 +1,13 @@
 package common
 
+// Holder identifies a file of a user along with the metadata passed when it
+// was uploaded.
 type Holder struct {
 	File string
 	Size int64
 	User User
 	ContentType string
 	Description string
-	Object interface{}
 }
 
 func (h *Holder) GetProfileID() string {
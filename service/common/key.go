@@ -0,0 +1,36 @@
+package common
+
+import "time"
+
+type APIKey struct {
+	Hash     string    `datastore:"hash"`
+	Scopes   []string  `datastore:"scopes"`
+	Created  time.Time `datastore:"created"`
+	Expiry   time.Time `datastore:"expiry"`
+	LastUsed time.Time `datastore:"last_used"`
+	// Fingerprint of the SSH public key of keys registered for SFTP
+	Fingerprint string `datastore:"fingerprint,noindex"`
+}
+
+type KeyResponse struct {
+	Name     string     `json:"name"`
+	Key      string     `json:"key,omitempty"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expiry   *time.Time `json:"expiry,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	// Set for SSH public keys rather than secret keys
+	Fingerprint string `json:"ssh_fingerprint,omitempty"`
+	// Credentials for the S3 compatible API, only returned when the key is
+	// created
+	S3 *S3Credentials `json:"s3,omitempty"`
+}
+
+type S3Credentials struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+func (k *APIKey) Expired() bool {
+	return !k.Expiry.IsZero() && time.Now().After(k.Expiry)
+}
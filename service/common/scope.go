@@ -0,0 +1,28 @@
+package common
+
+const (
+	// Scope allowing files to be listed and downloaded
+	SCOPE_READ = "files:read"
+	// Scope allowing files to be uploaded and updated
+	SCOPE_WRITE = "files:write"
+	// Scope allowing files to be deleted
+	SCOPE_DELETE = "files:delete"
+	// Scope allowing users to be listed and disabled
+	SCOPE_ADMIN = "admin"
+)
+
+// Scopes granted to every user
+var Scopes = []string{SCOPE_READ, SCOPE_WRITE, SCOPE_DELETE}
+
+func ValidScope(scope string) bool {
+	if scope == SCOPE_ADMIN {
+		return true
+	}
+
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
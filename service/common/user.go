@@ -1,5 +1,7 @@
 package common
 
+import "log/slog"
+
 type User struct {
 	// First name of the user
 	FirstName string
@@ -7,4 +9,26 @@ type User struct {
 	LastName  string
 	// ID of the user's profile
 	Profile   string
+	// Scopes granted to the credential used
+	Scopes    []string
+	// Set when the user was authenticated with an API key
+	APIKey    bool
+}
+
+func (u *User) HasScope(scope string) bool {
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// LogValue identifies the user in logs by profile only, leaving out their name.
+func (u User) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("profile", u.Profile),
+		slog.Any("scopes", u.Scopes),
+		slog.Bool("api_key_auth", u.APIKey),
+	)
 }
@@ -0,0 +1,499 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variable holding the path of the config file when --config is
+// not passed
+const CONFIG_FILE = "UPLOADLY_CONFIG"
+
+// Longest expiration memcached takes as a duration. Longer ones are read as
+// Unix times
+const MAX_MEMCACHE_TTL = Duration(30 * 24 * time.Hour)
+
+type Config struct {
+	// Address the HTTP server listens on
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr"`
+	// Directory the webapp is served from
+	WebappDir string `yaml:"webapp_dir" toml:"webapp_dir"`
+	// Google Cloud project hosting the backends
+	ProjectID string `yaml:"project_id" toml:"project_id"`
+	// Bucket files are stored in. Also used as the Pub/Sub topic
+	Bucket string `yaml:"bucket" toml:"bucket"`
+	// Path Prometheus metrics are served on. Empty disables the endpoint
+	MetricsPath string `yaml:"metrics_path" toml:"metrics_path"`
+	// Profiles granted the admin scope
+	AdminProfiles []string `yaml:"admin_profiles" toml:"admin_profiles"`
+
+	Server     ServerConfig     `yaml:"server" toml:"server"`
+	Upload     UploadConfig     `yaml:"upload" toml:"upload"`
+	Memcache   MemcacheConfig   `yaml:"memcache" toml:"memcache"`
+	Cache      CacheConfig      `yaml:"cache" toml:"cache"`
+	TokenCache TokenCacheConfig `yaml:"token_cache" toml:"token_cache"`
+	Timeouts   TimeoutsConfig   `yaml:"timeouts" toml:"timeouts"`
+	Tracing    TracingConfig    `yaml:"tracing" toml:"tracing"`
+	Logging    LoggingConfig    `yaml:"logging" toml:"logging"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit" toml:"rate_limit"`
+	CORS       CORSConfig       `yaml:"cors" toml:"cors"`
+	S3         S3Config         `yaml:"s3" toml:"s3"`
+	SFTP       SFTPConfig       `yaml:"sftp" toml:"sftp"`
+	GRPC       GRPCConfig       `yaml:"grpc" toml:"grpc"`
+
+	// Print the effective configuration and exit
+	PrintConfig bool `yaml:"-" toml:"-"`
+}
+
+type ServerConfig struct {
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	// Bounds reading the whole request including uploads
+	ReadTimeout Duration `yaml:"read_timeout" toml:"read_timeout"`
+	// Bounds writing the response including downloads
+	WriteTimeout Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout  Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// How long in-flight requests are given to finish on shutdown
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// Certificate and key files. TLS is served when both are set and the files
+	// are reloaded when they change
+	TLSCert string `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key" toml:"tls_key"`
+	// Serve HTTP/2 without TLS, for use behind a load balancer
+	H2C bool `yaml:"h2c" toml:"h2c"`
+}
+
+type UploadConfig struct {
+	// Largest request body accepted for uploads in bytes
+	MaxSize int64 `yaml:"max_size" toml:"max_size"`
+}
+
+type MemcacheConfig struct {
+	Host string `yaml:"host" toml:"host"`
+	Port string `yaml:"port" toml:"port"`
+	// How long the info of a file is cached
+	FileTTL Duration `yaml:"file_ttl" toml:"file_ttl"`
+	// How long file listings are cached
+	ListTTL Duration `yaml:"list_ttl" toml:"list_ttl"`
+	// Largest item memcached stores, set with its -I flag. Larger responses
+	// are not cached
+	MaxItemSize int `yaml:"max_item_size" toml:"max_item_size"`
+}
+
+type CacheConfig struct {
+	// Where file metadata responses are cached: memcache, local to the
+	// replica, tiered for a local cache in front of memcache, or none
+	Backend string `yaml:"backend" toml:"backend"`
+	// Number of responses kept in memory by the local and tiered backends, and
+	// of versions of files and listings kept by none
+	Size int `yaml:"size" toml:"size"`
+	// How long responses are kept in memory. Responses invalidated on other
+	// replicas are served from memory until then
+	LocalTTL Duration `yaml:"local_ttl" toml:"local_ttl"`
+}
+
+type TokenCacheConfig struct {
+	// Number of validated credentials kept in memory
+	Size int `yaml:"size" toml:"size"`
+	// How long a validated credential is trusted without checking it again
+	TTL Duration `yaml:"ttl" toml:"ttl"`
+}
+
+type TimeoutsConfig struct {
+	// Timeouts of storage calls. Reading and writing file contents is only
+	// bounded by them until the stream is opened
+	StorageRead  Duration `yaml:"storage_read" toml:"storage_read"`
+	StorageWrite Duration `yaml:"storage_write" toml:"storage_write"`
+	Publish      Duration `yaml:"publish" toml:"publish"`
+	// Time each backend is given to answer a readiness probe
+	Health Duration `yaml:"health" toml:"health"`
+}
+
+type TracingConfig struct {
+	// OTLP gRPC endpoint spans are exported to, such as localhost:4317. Empty
+	// disables tracing
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// Connect to the endpoint without TLS, as is common for a local collector
+	Insecure bool `yaml:"insecure" toml:"insecure"`
+	// Fraction of new traces that are sampled
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+type LoggingConfig struct {
+	// Lowest level written: debug, info, warn or error
+	Level string `yaml:"level" toml:"level"`
+	// Either json or text
+	Format string `yaml:"format" toml:"format"`
+}
+
+type RateLimitConfig struct {
+	// Where request counts are kept: local to the replica, or memcache to
+	// share them between replicas
+	Backend string `yaml:"backend" toml:"backend"`
+	// Number of proxies in front of the service that append to
+	// X-Forwarded-For. Clients are identified by their address otherwise.
+	// Use 2 behind a Google Cloud load balancer
+	TrustedProxies int `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	// Requests to the API across all users
+	Global Limit `yaml:"global" toml:"global"`
+	// Uploads and updates per profile
+	Upload Limit `yaml:"upload" toml:"upload"`
+	// Downloads per profile
+	Download Limit `yaml:"download" toml:"download"`
+	// Listings, file info, deletes, keys and admin calls per profile
+	Metadata Limit `yaml:"metadata" toml:"metadata"`
+	// Requests to unauthenticated routes per client address
+	Anonymous Limit `yaml:"anonymous" toml:"anonymous"`
+	// Failed authentications per client address. Once exhausted credentials
+	// from the address are not validated until the limit recovers
+	AuthFailure Limit `yaml:"auth_failure" toml:"auth_failure"`
+}
+
+type CORSConfig struct {
+	// Origins browsers may call the API from, such as https://app.example.com.
+	// A leading "*." matches any subdomain and "*" matches every origin. Empty
+	// disables CORS
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins"`
+	AllowedMethods []string `yaml:"allowed_methods" toml:"allowed_methods"`
+	// Request headers cross-origin requests may send
+	AllowedHeaders []string `yaml:"allowed_headers" toml:"allowed_headers"`
+	// Response headers exposed to cross-origin callers
+	ExposedHeaders []string `yaml:"exposed_headers" toml:"exposed_headers"`
+	// Allow requests with cookies or HTTP authentication
+	AllowCredentials bool `yaml:"allow_credentials" toml:"allow_credentials"`
+	// How long browsers may cache the result of a preflight request
+	MaxAge Duration `yaml:"max_age" toml:"max_age"`
+}
+
+type S3Config struct {
+	// Address the S3 compatible API listens on, such as :9000. Empty disables
+	// it
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr"`
+	// Region clients sign their requests for
+	Region string `yaml:"region" toml:"region"`
+	// Secret the S3 secret access keys of API keys are derived from. Changing
+	// it invalidates the S3 credentials of every key
+	SigningSecret string `yaml:"signing_secret" toml:"signing_secret"`
+}
+
+type SFTPConfig struct {
+	// Address the SFTP server listens on, such as :2022. Empty disables it
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr"`
+	// PEM file holding the private host key of the server
+	HostKey string `yaml:"host_key" toml:"host_key"`
+	// Connections without any request for this long are closed
+	IdleTimeout Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+}
+
+type GRPCConfig struct {
+	// Address the gRPC API listens on, such as :9090. Empty disables it. TLS
+	// is served with the certificate of the server when one is set
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr"`
+	// Size of the chunks files are downloaded in
+	ChunkSize int `yaml:"chunk_size" toml:"chunk_size"`
+}
+
+// Limit allows a number of requests per period and is read and written as a
+// string like "60/1m". An empty or zero limit is unlimited.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l Limit) Unlimited() bool {
+	return l.Requests <= 0 || l.Period <= 0
+}
+
+func (l Limit) MarshalText() ([]byte, error) {
+	if l.Unlimited() {
+		return []byte{}, nil
+	}
+	return []byte(fmt.Sprintf("%d/%s", l.Requests, l.Period)), nil
+}
+
+func (l *Limit) UnmarshalText(text []byte) error {
+	raw := strings.TrimSpace(string(text))
+	if raw == "" || raw == "0" {
+		*l = Limit{}
+		return nil
+	}
+
+	parts := strings.SplitN(raw, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("limit %q must look like 60/1m", raw)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 0 {
+		return fmt.Errorf("limit %q must start with a number of requests", raw)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return fmt.Errorf("limit %q must end with a positive period", raw)
+	}
+
+	*l = Limit{Requests: requests, Period: period}
+	return nil
+}
+
+// Duration is a time.Duration that is read and written as a string like "10s".
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func Default() *Config {
+	return &Config{
+		ListenAddr:  ":8080",
+		WebappDir:   "../webapp",
+		MetricsPath: "/metrics",
+		Server: ServerConfig{
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(5 * time.Minute),
+			WriteTimeout:      Duration(5 * time.Minute),
+			IdleTimeout:       Duration(2 * time.Minute),
+			ShutdownTimeout:   Duration(30 * time.Second),
+		},
+		Upload: UploadConfig{
+			MaxSize: 1024 * 1024 * 10,
+		},
+		Memcache: MemcacheConfig{
+			Host:        "localhost",
+			Port:        "11211",
+			FileTTL:     Duration(24 * time.Hour),
+			ListTTL:     Duration(time.Hour),
+			MaxItemSize: 1024 * 1024,
+		},
+		Cache: CacheConfig{
+			Backend:  "memcache",
+			Size:     1000,
+			LocalTTL: Duration(10 * time.Second),
+		},
+		TokenCache: TokenCacheConfig{
+			Size: 100,
+			TTL:  Duration(time.Minute),
+		},
+		Timeouts: TimeoutsConfig{
+			StorageRead:  Duration(10 * time.Second),
+			StorageWrite: Duration(30 * time.Second),
+			Publish:      Duration(time.Minute),
+			Health:       Duration(2 * time.Second),
+		},
+		Tracing: TracingConfig{
+			Insecure:    true,
+			SampleRatio: 1,
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Content-Type", "X-CloudProject-Token", "X-CloudProject-Key", "X-Request-ID"},
+			ExposedHeaders: []string{"X-Request-ID", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
+			MaxAge:         Duration(10 * time.Minute),
+		},
+		RateLimit: RateLimitConfig{
+			Backend:     "local",
+			Upload:      Limit{Requests: 30, Period: time.Minute},
+			Download:    Limit{Requests: 300, Period: time.Minute},
+			Metadata:    Limit{Requests: 600, Period: time.Minute},
+			Anonymous:   Limit{Requests: 600, Period: time.Minute},
+			AuthFailure: Limit{Requests: 10, Period: time.Minute},
+		},
+		S3: S3Config{
+			Region: "us-east-1",
+		},
+		SFTP: SFTPConfig{
+			IdleTimeout: Duration(10 * time.Minute),
+		},
+		GRPC: GRPCConfig{
+			ChunkSize: 64 * 1024,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment and the command line arguments. Later sources take precedence
+// over earlier ones. The returned configuration has been validated.
+func Load(args []string) (*Config, error) {
+	// Flags are parsed first to find the config file, but are applied last
+	fs := flag.NewFlagSet("uploadly", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(CONFIG_FILE), "Path of a YAML or TOML config file")
+	printConfig := fs.Bool("print-config", false, "Print the effective configuration and exit")
+	for _, s := range settings(Default()) {
+		fs.Var(s.value, s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings(cfg) {
+		if raw, ok := os.LookupEnv(s.env); ok {
+			if err := s.value.Set(raw); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %v", raw, s.env, err)
+			}
+		}
+	}
+
+	visited := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		visited[f.Name] = true
+	})
+	for _, s := range settings(cfg) {
+		if visited[s.flag] {
+			s.value.Set(fs.Lookup(s.flag).Value.String())
+		}
+	}
+	cfg.PrintConfig = *printConfig
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports the first setting that can not be used to start the service.
+func (c *Config) Validate() error {
+	switch {
+	case c.ListenAddr == "":
+		return fmt.Errorf("listen_addr must be set")
+	case c.ProjectID == "":
+		return fmt.Errorf("project_id must be set with --project-id or PROJECT_ID")
+	case c.Bucket == "":
+		return fmt.Errorf("bucket must be set with --bucket or BUCKET")
+	case c.Upload.MaxSize <= 0:
+		return fmt.Errorf("upload.max_size must be positive, got %d", c.Upload.MaxSize)
+	case c.usesMemcache() && (c.Memcache.Host == "" || c.Memcache.Port == ""):
+		return fmt.Errorf("memcache.host and memcache.port must be set")
+	case c.Memcache.FileTTL < Duration(time.Second) || c.Memcache.FileTTL > MAX_MEMCACHE_TTL ||
+		c.Memcache.ListTTL < Duration(time.Second) || c.Memcache.ListTTL > MAX_MEMCACHE_TTL:
+		return fmt.Errorf("memcache.file_ttl and memcache.list_ttl must be between 1s and %s", MAX_MEMCACHE_TTL.Duration())
+	case c.Memcache.MaxItemSize <= 0:
+		return fmt.Errorf("memcache.max_item_size must be positive, got %d", c.Memcache.MaxItemSize)
+	case c.Cache.Backend != "memcache" && c.Cache.Backend != "local" && c.Cache.Backend != "tiered" && c.Cache.Backend != "none":
+		return fmt.Errorf("cache.backend must be memcache, local, tiered or none, got %q", c.Cache.Backend)
+	case c.Cache.Size <= 0:
+		return fmt.Errorf("cache.size must be positive, got %d", c.Cache.Size)
+	case c.Cache.LocalTTL <= 0:
+		return fmt.Errorf("cache.local_ttl must be positive, got %s", c.Cache.LocalTTL.Duration())
+	case c.TokenCache.Size <= 0:
+		return fmt.Errorf("token_cache.size must be positive, got %d", c.TokenCache.Size)
+	case c.TokenCache.TTL <= 0:
+		return fmt.Errorf("token_cache.ttl must be positive, got %s", c.TokenCache.TTL.Duration())
+	case c.Timeouts.StorageRead < 0 || c.Timeouts.StorageWrite < 0 || c.Timeouts.Publish < 0 || c.Timeouts.Health < 0:
+		return fmt.Errorf("timeouts can not be negative")
+	case c.Server.ReadHeaderTimeout < 0 || c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 ||
+		c.Server.IdleTimeout < 0 || c.Server.ShutdownTimeout < 0:
+		return fmt.Errorf("server timeouts can not be negative")
+	case (c.Server.TLSCert == "") != (c.Server.TLSKey == ""):
+		return fmt.Errorf("server.tls_cert and server.tls_key must be set together")
+	case c.Server.H2C && c.Server.TLSCert != "":
+		return fmt.Errorf("server.h2c can not be used with TLS")
+	case c.Logging.Format != "json" && c.Logging.Format != "text":
+		return fmt.Errorf("logging.format must be json or text, got %q", c.Logging.Format)
+	case new(slog.Level).UnmarshalText([]byte(c.Logging.Level)) != nil:
+		return fmt.Errorf("logging.level must be debug, info, warn or error, got %q", c.Logging.Level)
+	case c.RateLimit.Backend != "local" && c.RateLimit.Backend != "memcache":
+		return fmt.Errorf("rate_limit.backend must be local or memcache, got %q", c.RateLimit.Backend)
+	case c.RateLimit.TrustedProxies < 0:
+		return fmt.Errorf("rate_limit.trusted_proxies can not be negative")
+	case c.CORS.AllowCredentials && contains(c.CORS.AllowedOrigins, "*"):
+		return fmt.Errorf("cors.allowed_origins can not be * when cors.allow_credentials is set")
+	case c.CORS.MaxAge < 0:
+		return fmt.Errorf("cors.max_age can not be negative")
+	case c.S3.ListenAddr != "" && c.S3.SigningSecret == "":
+		return fmt.Errorf("s3.signing_secret must be set when s3.listen_addr is")
+	case c.S3.ListenAddr != "" && c.S3.Region == "":
+		return fmt.Errorf("s3.region must be set when s3.listen_addr is")
+	case c.SFTP.ListenAddr != "" && c.SFTP.HostKey == "":
+		return fmt.Errorf("sftp.host_key must be set when sftp.listen_addr is")
+	case c.SFTP.IdleTimeout < 0:
+		return fmt.Errorf("sftp.idle_timeout can not be negative")
+	case c.GRPC.ChunkSize <= 0 || c.GRPC.ChunkSize > 4*1024*1024-1024:
+		return fmt.Errorf("grpc.chunk_size must be positive and below the 4MB message limit, got %d", c.GRPC.ChunkSize)
+	case c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1:
+		return fmt.Errorf("tracing.sample_ratio must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	}
+	return nil
+}
+
+// Write prints the configuration as YAML. Secrets are left out.
+func (c *Config) Write(w io.Writer) error {
+	redacted := *c
+	if redacted.S3.SigningSecret != "" {
+		redacted.S3.SigningSecret = "REDACTED"
+	}
+	bytes, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
+
+func (c *Config) loadFile(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(bytes, c)
+	case ".toml":
+		err = toml.Unmarshal(bytes, c)
+	default:
+		return fmt.Errorf("config file %s must end in .yml, .yaml or .toml", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// usesMemcache reports whether responses or rate limit counts are kept in
+// memcache.
+func (c *Config) usesMemcache() bool {
+	return c.Cache.Backend == "memcache" || c.Cache.Backend == "tiered" || c.RateLimit.Backend == "memcache"
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting binds a field of the config to its flag and environment variable.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	value value
+}
+
+type value interface {
+	String() string
+	Set(string) error
+}
+
+func settings(c *Config) []setting {
+	return []setting{
+		{"listen-addr", "LISTEN_ADDR", "Address to listen on", (*stringValue)(&c.ListenAddr)},
+		{"webapp-dir", "WEBAPP_DIR", "Directory the webapp is served from", (*stringValue)(&c.WebappDir)},
+		{"metrics-path", "METRICS_PATH", "Path metrics are served on, empty to disable", (*stringValue)(&c.MetricsPath)},
+		{"project-id", "PROJECT_ID", "Google Cloud project ID", (*stringValue)(&c.ProjectID)},
+		{"bucket", "BUCKET", "Bucket and Pub/Sub topic files are written to", (*stringValue)(&c.Bucket)},
+		{"admin-profiles", "ADMIN_PROFILES", "Comma separated profiles granted the admin scope", (*listValue)(&c.AdminProfiles)},
+		{"read-header-timeout", "READ_HEADER_TIMEOUT", "Timeout for reading request headers", (*durationValue)(&c.Server.ReadHeaderTimeout)},
+		{"read-timeout", "READ_TIMEOUT", "Timeout for reading whole requests", (*durationValue)(&c.Server.ReadTimeout)},
+		{"write-timeout", "WRITE_TIMEOUT", "Timeout for writing responses", (*durationValue)(&c.Server.WriteTimeout)},
+		{"idle-timeout", "IDLE_TIMEOUT", "Timeout for idle keep-alive connections", (*durationValue)(&c.Server.IdleTimeout)},
+		{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "Time given to in-flight requests on shutdown", (*durationValue)(&c.Server.ShutdownTimeout)},
+		{"tls-cert", "TLS_CERT", "TLS certificate file", (*stringValue)(&c.Server.TLSCert)},
+		{"tls-key", "TLS_KEY", "TLS key file", (*stringValue)(&c.Server.TLSKey)},
+		{"h2c", "H2C", "Serve HTTP/2 without TLS", (*boolValue)(&c.Server.H2C)},
+		{"max-upload-size", "MAX_UPLOAD_SIZE", "Largest upload in bytes", (*int64Value)(&c.Upload.MaxSize)},
+		{"memcache-host", "MEMCACHE_SERVICE_HOST", "Memcache host", (*stringValue)(&c.Memcache.Host)},
+		{"memcache-port", "MEMCACHE_SERVICE_PORT", "Memcache port", (*stringValue)(&c.Memcache.Port)},
+		{"memcache-file-ttl", "MEMCACHE_FILE_TTL", "How long file info is cached in memcache", (*durationValue)(&c.Memcache.FileTTL)},
+		{"memcache-list-ttl", "MEMCACHE_LIST_TTL", "How long file listings are cached in memcache", (*durationValue)(&c.Memcache.ListTTL)},
+		{"memcache-max-item-size", "MEMCACHE_MAX_ITEM_SIZE", "Largest item memcached stores in bytes", (*intValue)(&c.Memcache.MaxItemSize)},
+		{"cache-backend", "CACHE_BACKEND", "Where responses are cached: memcache, local, tiered or none", (*stringValue)(&c.Cache.Backend)},
+		{"cache-size", "CACHE_SIZE", "Number of responses cached in memory", (*intValue)(&c.Cache.Size)},
+		{"cache-local-ttl", "CACHE_LOCAL_TTL", "How long responses are cached in memory", (*durationValue)(&c.Cache.LocalTTL)},
+		{"token-cache-size", "TOKEN_CACHE_SIZE", "Number of validated credentials cached", (*intValue)(&c.TokenCache.Size)},
+		{"token-cache-ttl", "TOKEN_CACHE_TTL", "How long validated credentials are cached", (*durationValue)(&c.TokenCache.TTL)},
+		{"storage-read-timeout", "STORAGE_READ_TIMEOUT", "Timeout of storage reads", (*durationValue)(&c.Timeouts.StorageRead)},
+		{"storage-write-timeout", "STORAGE_WRITE_TIMEOUT", "Timeout of storage writes", (*durationValue)(&c.Timeouts.StorageWrite)},
+		{"publish-timeout", "PUBLISH_TIMEOUT", "Timeout of Pub/Sub publishes", (*durationValue)(&c.Timeouts.Publish)},
+		{"health-timeout", "HEALTH_TIMEOUT", "Timeout of each backend check on readiness probes", (*durationValue)(&c.Timeouts.Health)},
+		{"otlp-endpoint", "OTLP_ENDPOINT", "OTLP gRPC endpoint spans are exported to", (*stringValue)(&c.Tracing.Endpoint)},
+		{"otlp-insecure", "OTLP_INSECURE", "Export spans without TLS", (*boolValue)(&c.Tracing.Insecure)},
+		{"trace-sample-ratio", "TRACE_SAMPLE_RATIO", "Fraction of traces sampled", (*floatValue)(&c.Tracing.SampleRatio)},
+		{"rate-limit-backend", "RATE_LIMIT_BACKEND", "Where rate limit counts are kept: local or memcache", (*stringValue)(&c.RateLimit.Backend)},
+		{"trusted-proxies", "TRUSTED_PROXIES", "Proxies in front of the service appending to X-Forwarded-For", (*intValue)(&c.RateLimit.TrustedProxies)},
+		{"rate-limit-global", "RATE_LIMIT_GLOBAL", "API requests across all users, such as 1000/1s", (*limitValue)(&c.RateLimit.Global)},
+		{"rate-limit-upload", "RATE_LIMIT_UPLOAD", "Uploads per profile, such as 30/1m", (*limitValue)(&c.RateLimit.Upload)},
+		{"rate-limit-download", "RATE_LIMIT_DOWNLOAD", "Downloads per profile", (*limitValue)(&c.RateLimit.Download)},
+		{"rate-limit-metadata", "RATE_LIMIT_METADATA", "Metadata calls per profile", (*limitValue)(&c.RateLimit.Metadata)},
+		{"rate-limit-anonymous", "RATE_LIMIT_ANONYMOUS", "Unauthenticated requests per client address", (*limitValue)(&c.RateLimit.Anonymous)},
+		{"rate-limit-auth-failure", "RATE_LIMIT_AUTH_FAILURE", "Failed authentications per client address", (*limitValue)(&c.RateLimit.AuthFailure)},
+		{"cors-allowed-origins", "CORS_ALLOWED_ORIGINS", "Comma separated origins allowed to call the API from browsers", (*listValue)(&c.CORS.AllowedOrigins)},
+		{"cors-allowed-methods", "CORS_ALLOWED_METHODS", "Comma separated methods allowed for cross-origin requests", (*listValue)(&c.CORS.AllowedMethods)},
+		{"cors-allowed-headers", "CORS_ALLOWED_HEADERS", "Comma separated headers cross-origin requests may send", (*listValue)(&c.CORS.AllowedHeaders)},
+		{"cors-exposed-headers", "CORS_EXPOSED_HEADERS", "Comma separated response headers exposed to cross-origin callers", (*listValue)(&c.CORS.ExposedHeaders)},
+		{"cors-allow-credentials", "CORS_ALLOW_CREDENTIALS", "Allow cross-origin requests with credentials", (*boolValue)(&c.CORS.AllowCredentials)},
+		{"cors-max-age", "CORS_MAX_AGE", "How long browsers cache preflight results", (*durationValue)(&c.CORS.MaxAge)},
+		{"s3-listen-addr", "S3_LISTEN_ADDR", "Address the S3 compatible API listens on, empty to disable", (*stringValue)(&c.S3.ListenAddr)},
+		{"s3-region", "S3_REGION", "Region S3 requests are signed for", (*stringValue)(&c.S3.Region)},
+		{"s3-signing-secret", "S3_SIGNING_SECRET", "Secret S3 secret access keys are derived from", (*stringValue)(&c.S3.SigningSecret)},
+		{"sftp-listen-addr", "SFTP_LISTEN_ADDR", "Address the SFTP server listens on, empty to disable", (*stringValue)(&c.SFTP.ListenAddr)},
+		{"sftp-host-key", "SFTP_HOST_KEY", "PEM file holding the private host key of the SFTP server", (*stringValue)(&c.SFTP.HostKey)},
+		{"sftp-idle-timeout", "SFTP_IDLE_TIMEOUT", "Idle SFTP connections are closed after this long", (*durationValue)(&c.SFTP.IdleTimeout)},
+		{"grpc-listen-addr", "GRPC_LISTEN_ADDR", "Address the gRPC API listens on, empty to disable", (*stringValue)(&c.GRPC.ListenAddr)},
+		{"grpc-chunk-size", "GRPC_CHUNK_SIZE", "Size of the chunks files are downloaded in over gRPC", (*intValue)(&c.GRPC.ChunkSize)},
+		{"log-level", "LOG_LEVEL", "Lowest level logged: debug, info, warn or error", (*stringValue)(&c.Logging.Level)},
+		{"log-format", "LOG_FORMAT", "Log format: json or text", (*stringValue)(&c.Logging.Format)},
+	}
+}
+
+type stringValue string
+
+func (s *stringValue) String() string { return string(*s) }
+
+func (s *stringValue) Set(raw string) error {
+	*s = stringValue(raw)
+	return nil
+}
+
+type boolValue bool
+
+func (b *boolValue) String() string { return strconv.FormatBool(bool(*b)) }
+
+func (b *boolValue) Set(raw string) error {
+	parsed, err := strconv.ParseBool(raw)
+	if err != nil {
+		return err
+	}
+	*b = boolValue(parsed)
+	return nil
+}
+
+// IsBoolFlag allows the flag to be passed without a value.
+func (b *boolValue) IsBoolFlag() bool { return true }
+
+type intValue int
+
+func (i *intValue) String() string { return strconv.Itoa(int(*i)) }
+
+func (i *intValue) Set(raw string) error {
+	parsed, err := strconv.Atoi(raw)
+	if err != nil {
+		return err
+	}
+	*i = intValue(parsed)
+	return nil
+}
+
+type int64Value int64
+
+func (i *int64Value) String() string { return strconv.FormatInt(int64(*i), 10) }
+
+func (i *int64Value) Set(raw string) error {
+	parsed, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = int64Value(parsed)
+	return nil
+}
+
+type floatValue float64
+
+func (f *floatValue) String() string { return strconv.FormatFloat(float64(*f), 'g', -1, 64) }
+
+func (f *floatValue) Set(raw string) error {
+	parsed, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return err
+	}
+	*f = floatValue(parsed)
+	return nil
+}
+
+type durationValue Duration
+
+func (d *durationValue) String() string { return time.Duration(*d).String() }
+
+func (d *durationValue) Set(raw string) error {
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(parsed)
+	return nil
+}
+
+type listValue []string
+
+func (l *listValue) String() string { return strings.Join(*l, ",") }
+
+func (l *listValue) Set(raw string) error {
+	*l = []string{}
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+type limitValue Limit
+
+func (l *limitValue) String() string {
+	text, _ := (*Limit)(l).MarshalText()
+	return string(text)
+}
+
+func (l *limitValue) Set(raw string) error {
+	return (*Limit)(l).UnmarshalText([]byte(raw))
+}
@@ -0,0 +1,136 @@
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vjsamuel/uploadly/service/config"
+)
+
+type policy struct {
+	origins       []string
+	methods       map[string]bool
+	headers       map[string]bool
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	credentials   bool
+	any           bool
+	maxAge        string
+}
+
+// Middleware adds the CORS headers allowed by the config to responses to
+// browsers calling from other origins, and answers preflight requests itself.
+// Requests without an Origin header are passed through.
+func Middleware(cfg config.CORSConfig) func(http.Handler) http.Handler {
+	p := &policy{
+		origins:       cfg.AllowedOrigins,
+		methods:       map[string]bool{},
+		headers:       map[string]bool{},
+		allowMethods:  strings.Join(cfg.AllowedMethods, ", "),
+		allowHeaders:  strings.Join(cfg.AllowedHeaders, ", "),
+		exposeHeaders: strings.Join(cfg.ExposedHeaders, ", "),
+		credentials:   cfg.AllowCredentials,
+		maxAge:        strconv.Itoa(int(cfg.MaxAge.Duration().Seconds())),
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		p.any = p.any || origin == "*"
+	}
+	for _, method := range cfg.AllowedMethods {
+		p.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range cfg.AllowedHeaders {
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			// Responses depend on the origin, so caches must key on it
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				p.preflight(w, r, origin)
+				return
+			}
+
+			if p.allowOrigin(origin) {
+				p.setOrigin(w, origin)
+				if p.exposeHeaders != "" {
+					w.Header().Set("Access-Control-Expose-Headers", p.exposeHeaders)
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Preflight answers OPTIONS requests routed to it. The middleware responds to
+// preflight requests before they reach it, so only OPTIONS requests that are
+// not preflights get here.
+func Preflight(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// preflight responds to a preflight request. Disallowed requests get no CORS
+// headers, which makes the browser refuse the actual request.
+func (p *policy) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if p.allowOrigin(origin) && p.methods[strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))] &&
+		p.allowRequestHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+		p.setOrigin(w, origin)
+		w.Header().Set("Access-Control-Allow-Methods", p.allowMethods)
+		if p.allowHeaders != "" {
+			w.Header().Set("Access-Control-Allow-Headers", p.allowHeaders)
+		}
+		w.Header().Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *policy) setOrigin(w http.ResponseWriter, origin string) {
+	if p.credentials {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else if p.any {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+func (p *policy) allowOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.origins {
+		allowed = strings.ToLower(allowed)
+		switch {
+		case allowed == "*" || allowed == origin:
+			return true
+		case strings.HasPrefix(allowed, "*."):
+			// *.example.com matches https://app.example.com but not example.com
+			if _, host, ok := strings.Cut(origin, "://"); ok && strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *policy) allowRequestHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !p.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+// Package dav serves the files of each user over WebDAV, so that they can be
+// mounted as a network drive.
+package dav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bluele/gcache"
+	"github.com/vjsamuel/uploadly/service/apierror"
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/storage"
+	"golang.org/x/net/webdav"
+)
+
+// Realm announced to clients that did not pass credentials.
+const REALM = "upload.ly"
+
+// Number of profiles whose locks are kept. Locks of the least recently used
+// profiles are dropped beyond it.
+const LOCK_SYSTEMS = 10000
+
+var (
+	errTooLarge = errors.New("file size exceeded")
+	errAborted  = errors.New("write aborted")
+)
+
+// Options configures the WebDAV handler.
+type Options struct {
+	// Prefix the handler is mounted under
+	Prefix   string
+	Objects  storage.ObjectStore
+	Metadata storage.MetadataStore
+	Files    Files
+	// MaxUploadSize bounds the size of files written
+	MaxUploadSize int64
+	// SizeExceeded is the message returned for files that are too large
+	SizeExceeded string
+	// User returns the user authenticated for the request
+	User func(*http.Request) *common.User
+}
+
+type handler struct {
+	opts  Options
+	locks gcache.Cache
+}
+
+// NewHandler serves the files of the user authenticated for each request. It
+// expects to be wrapped by Authorize.
+func NewHandler(opts Options) http.Handler {
+	return &handler{
+		opts: opts,
+		locks: gcache.New(LOCK_SYSTEMS).LRU().LoaderFunc(func(interface{}) (interface{}, error) {
+			return webdav.NewMemLS(), nil
+		}).Build(),
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	usr := h.opts.User(r)
+	if usr == nil {
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
+		return
+	}
+
+	b := &body{}
+	if r.Method == http.MethodPut {
+		if r.ContentLength > h.opts.MaxUploadSize {
+			apierror.Write(w, r, http.StatusRequestEntityTooLarge, h.opts.SizeExceeded)
+			return
+		}
+		b.ReadCloser = http.MaxBytesReader(w, r.Body, h.opts.MaxUploadSize)
+		r.Body = b
+	}
+	r = r.WithContext(context.WithValue(r.Context(), bodyKey{}, b))
+
+	// Lock tokens are only valid for the profile that created them
+	locks, err := h.locks.Get(usr.Profile)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to process request")
+		return
+	}
+
+	dav := &webdav.Handler{
+		Prefix:     h.opts.Prefix,
+		FileSystem: NewFileSystem(h.opts.Objects, h.opts.Metadata, h.opts.Files, *usr, h.opts.MaxUploadSize),
+		LockSystem: locks.(webdav.LockSystem),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, context.Canceled) {
+				logging.From(r.Context()).WarnContext(r.Context(), "WebDAV request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			}
+		},
+	}
+	dav.ServeHTTP(&responseWriter{ResponseWriter: w, r: r, body: b, sizeExceeded: h.opts.SizeExceeded}, r)
+}
+
+// BasicAuth lets clients that only support Basic authentication pass their
+// credential as the password. API keys are told apart by their prefix, and
+// the user name is ignored. Clients are challenged for credentials when they
+// are missing or rejected.
+func BasicAuth(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); ok && auth.GetAuthToken(r) == "" {
+			if strings.HasPrefix(password, auth.KEY_PREFIX) {
+				r.Header.Set(auth.API_KEY, password)
+			} else {
+				r.Header.Set(auth.AUTH_TOKEN, password)
+			}
+		}
+		next.ServeHTTP(&challengeWriter{ResponseWriter: w}, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// Authorize requires the scopes needed by the method of each request. Moves
+// need both to write and to delete files.
+func Authorize(a auth.Authenticator, next http.Handler) http.Handler {
+	read := a.AuthorizedHandler(common.SCOPE_READ, next.ServeHTTP)
+	write := a.AuthorizedHandler(common.SCOPE_WRITE, next.ServeHTTP)
+	remove := a.AuthorizedHandler(common.SCOPE_DELETE, next.ServeHTTP)
+	move := a.AuthorizedHandler(common.SCOPE_WRITE, remove.ServeHTTP)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			remove.ServeHTTP(w, r)
+		case "MOVE":
+			move.ServeHTTP(w, r)
+		case http.MethodPut, "MKCOL", "COPY", "PROPPATCH", "LOCK", "UNLOCK":
+			write.ServeHTTP(w, r)
+		default:
+			read.ServeHTTP(w, r)
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+type bodyKey struct{}
+
+// body records whether the request body could not be read in full, in which
+// case the file being written is discarded.
+type body struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *body) tooLarge() bool {
+	var maxBytes *http.MaxBytesError
+	return errors.As(b.err, &maxBytes)
+}
+
+func bodyError(ctx context.Context) error {
+	if b, ok := ctx.Value(bodyKey{}).(*body); ok && b.err != nil {
+		return b.err
+	}
+	return nil
+}
+
+// responseWriter reports files that are too large like the API does, rather
+// than with the status chosen by the WebDAV handler.
+type responseWriter struct {
+	http.ResponseWriter
+	r            *http.Request
+	body         *body
+	sizeExceeded string
+	discard      bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if status == http.StatusMethodNotAllowed && w.body.tooLarge() {
+		apierror.Write(w.ResponseWriter, w.r, http.StatusRequestEntityTooLarge, w.sizeExceeded)
+		w.discard = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.discard {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type challengeWriter struct {
+	http.ResponseWriter
+}
+
+func (w *challengeWriter) WriteHeader(status int) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+REALM+`", charset="UTF-8"`)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,139 @@
+package dav_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/dav"
+)
+
+// authenticator grants the scopes listed in the Scopes header.
+type authenticator struct{}
+
+func (authenticator) AuthenticatedHandler(fn http.HandlerFunc) http.Handler {
+	return fn
+}
+
+func (authenticator) AuthorizedHandler(scope string, fn http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, granted := range strings.Split(r.Header.Get("Scopes"), ",") {
+			if granted == scope {
+				fn(w, r)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusForbidden)
+	})
+}
+
+func (authenticator) User(*http.Request) *common.User {
+	return nil
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		method string
+		scopes []string
+	}{
+		{"GET", []string{common.SCOPE_READ}},
+		{"HEAD", []string{common.SCOPE_READ}},
+		{"OPTIONS", []string{common.SCOPE_READ}},
+		{"PROPFIND", []string{common.SCOPE_READ}},
+		{"PUT", []string{common.SCOPE_WRITE}},
+		{"MKCOL", []string{common.SCOPE_WRITE}},
+		{"COPY", []string{common.SCOPE_WRITE}},
+		{"PROPPATCH", []string{common.SCOPE_WRITE}},
+		{"LOCK", []string{common.SCOPE_WRITE}},
+		{"UNLOCK", []string{common.SCOPE_WRITE}},
+		{"DELETE", []string{common.SCOPE_DELETE}},
+		{"MOVE", []string{common.SCOPE_WRITE, common.SCOPE_DELETE}},
+	}
+
+	handler := dav.Authorize(authenticator{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(method string, scopes []string) int {
+		r := httptest.NewRequest(method, "/dav/file.txt", nil)
+		r.Header.Set("Scopes", strings.Join(scopes, ","))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	all := []string{common.SCOPE_READ, common.SCOPE_WRITE, common.SCOPE_DELETE}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			if status := serve(test.method, test.scopes); status != http.StatusOK {
+				t.Errorf("expected %v to be enough, got %d", test.scopes, status)
+			}
+			// Every required scope is needed on its own
+			for _, missing := range test.scopes {
+				var scopes []string
+				for _, scope := range all {
+					if scope != missing {
+						scopes = append(scopes, scope)
+					}
+				}
+				if status := serve(test.method, scopes); status != http.StatusForbidden {
+					t.Errorf("expected %s to be needed, got %d", missing, status)
+				}
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		header   string
+		token    string
+		expected string
+	}{
+		{"API key", auth.KEY_PREFIX + "key", auth.API_KEY, "", auth.KEY_PREFIX + "key"},
+		{"ID token", "token", auth.AUTH_TOKEN, "", "token"},
+		{"passed in a header", "token", auth.AUTH_TOKEN, "header", "header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			handler := dav.BasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get(test.header)
+			}))
+			r := httptest.NewRequest("PROPFIND", "/dav/", nil)
+			r.SetBasicAuth("ignored", test.password)
+			if test.token != "" {
+				r.Header.Set(auth.AUTH_TOKEN, test.token)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != test.expected {
+				t.Errorf("expected %s to be %q, got %q", test.header, test.expected, got)
+			}
+		})
+	}
+}
+
+func TestBasicAuthChallenges(t *testing.T) {
+	handler := dav.BasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth.GetAuthToken(r) == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PROPFIND", "/dav/", nil))
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), `realm="`+dav.REALM+`"`) {
+		t.Errorf("expected a Basic challenge, got %d and %v", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	r.SetBasicAuth("ignored", "token")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("expected no challenge once authenticated, got %d and %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,486 @@
+package dav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/storage"
+	"golang.org/x/net/webdav"
+)
+
+// Files writes and deletes files like the other APIs do.
+type Files interface {
+	WriteFile(ctx context.Context, holder common.Holder, contents io.Reader) (int64, []byte, error)
+	RemoveFile(ctx context.Context, usr common.User, name string) error
+}
+
+// fileSystem exposes the files of a single user as a flat directory. Content
+// is read from the object store directly and written through files, so that
+// files can be read back as soon as they are written, and metadata is kept in
+// the metadata store like for files uploaded through the API.
+type fileSystem struct {
+	objects  storage.ObjectStore
+	metadata storage.MetadataStore
+	files    Files
+	user     common.User
+	maxSize  int64
+}
+
+// NewFileSystem exposes the files of the user as a flat directory, for
+// serving them over other protocols than WebDAV. Files opened for writing
+// implement Abort, which discards what was written instead of storing it.
+func NewFileSystem(objects storage.ObjectStore, metadata storage.MetadataStore, files Files, user common.User, maxSize int64) webdav.FileSystem {
+	return &fileSystem{objects: objects, metadata: metadata, files: files, user: user, maxSize: maxSize}
+}
+
+func (fs *fileSystem) holder(name string) common.Holder {
+	return common.Holder{File: name, User: fs.user}
+}
+
+// resolve returns the file name of a path, or an empty name for the root.
+// Files live in the root only.
+func resolve(name string) (string, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if strings.Contains(name, "/") {
+		return "", os.ErrNotExist
+	}
+	return name, nil
+}
+
+func (fs *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	file, err := resolve(name)
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return os.ErrExist
+	}
+	// Files are stored under flat names
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	file, err := resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, os.ErrPermission
+		}
+		return &dir{fs: fs, ctx: ctx}, nil
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		// Files are only looked up once they are used, since listings open
+		// every file they return
+		return &readFile{fs: fs, ctx: ctx, name: file}, nil
+	}
+
+	existing, err := fs.metadata.Get(ctx, fs.holder(file))
+	if err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+	if existing == nil && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if existing != nil && flag&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+	return fs.create(ctx, file), nil
+}
+
+func (fs *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	file, err := resolve(name)
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return os.ErrPermission
+	}
+
+	if err := fs.files.RemoveFile(ctx, fs.user, file); err == storage.ErrNotFound {
+		return os.ErrNotExist
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Rename copies the contents to the new name, since objects can not be
+// renamed, and deletes the old file.
+func (fs *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	from, err := resolve(oldName)
+	if err != nil {
+		return err
+	}
+	to, err := resolve(newName)
+	if err != nil {
+		return err
+	}
+	if from == "" || to == "" {
+		return os.ErrPermission
+	}
+
+	existing, err := fs.metadata.Get(ctx, fs.holder(from))
+	if err == storage.ErrNotFound {
+		return os.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+
+	reader, err := fs.objects.Reader(ctx, fs.holder(from))
+	if err == storage.ErrNotFound {
+		return os.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	holder := fs.holder(to)
+	holder.ContentType = existing.Type
+	holder.Description = existing.Description
+	if _, _, err := fs.files.WriteFile(ctx, holder, reader); err != nil {
+		return err
+	}
+	return fs.RemoveAll(ctx, from)
+}
+
+func (fs *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	file, err := resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return rootInfo, nil
+	}
+	return fs.stat(ctx, file)
+}
+
+// stat describes a file by its metadata, and by the size of its object once
+// it has been written.
+func (fs *fileSystem) stat(ctx context.Context, name string) (*fileInfo, error) {
+	holder := fs.holder(name)
+	resp, err := fs.metadata.Get(ctx, holder)
+	if err == storage.ErrNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := newFileInfo(resp)
+	if attrs, err := fs.objects.Attrs(ctx, holder); err == nil {
+		info.size = attrs.Size
+	} else if err != storage.ErrNotFound {
+		return nil, err
+	}
+	return info, nil
+}
+
+// list describes all files of the user with two calls, rather than one per
+// file.
+func (fs *fileSystem) list(ctx context.Context) ([]os.FileInfo, error) {
+	holder := fs.holder("")
+	files, err := fs.metadata.List(ctx, holder)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := fs.objects.List(ctx, holder)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	for _, o := range objects {
+		sizes[o.Name] = o.Size
+	}
+	infos := make([]os.FileInfo, 0, len(files))
+	for i := range files {
+		info := newFileInfo(&files[i])
+		if size, ok := sizes[info.name]; ok {
+			info.size = size
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (fs *fileSystem) create(ctx context.Context, name string) *writeFile {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &writeFile{fs: fs, ctx: ctx, name: name, contentType: contentType, modTime: time.Now()}
+}
+
+// dir is the root directory holding all files of the user.
+type dir struct {
+	fs      *fileSystem
+	ctx     context.Context
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		entries, err := d.fs.list(d.ctx)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error)                   { return rootInfo, nil }
+func (d *dir) Read([]byte) (int, error)                     { return 0, fmt.Errorf("is a directory") }
+func (d *dir) Write([]byte) (int, error)                    { return 0, os.ErrPermission }
+func (d *dir) Seek(offset int64, whence int) (int64, error) { return 0, fmt.Errorf("is a directory") }
+func (d *dir) Close() error                                 { return nil }
+
+// readFile streams the object of a file. Seeking reopens the object and skips
+// to the offset, which is only needed for range requests.
+type readFile struct {
+	fs     *fileSystem
+	ctx    context.Context
+	name   string
+	info   *fileInfo
+	reader io.ReadCloser
+	offset int64
+	read   int64
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	if f.info == nil {
+		info, err := f.fs.stat(f.ctx, f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.info = info
+	}
+	return f.info, nil
+}
+
+func (f *readFile) Read(b []byte) (int, error) {
+	if f.reader == nil {
+		reader, err := f.fs.objects.Reader(f.ctx, f.fs.holder(f.name))
+		if err == storage.ErrNotFound {
+			return 0, os.ErrNotExist
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, reader, f.offset); err != nil {
+			reader.Close()
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		f.reader = reader
+	}
+
+	n, err := f.reader.Read(b)
+	f.offset += int64(n)
+	f.read += int64(n)
+	return n, err
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	target := offset
+	switch whence {
+	case io.SeekCurrent:
+		target = f.offset + offset
+	case io.SeekEnd:
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		target = info.Size() + offset
+	}
+	if target < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+
+	if target != f.offset && f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+	f.offset = target
+	return target, nil
+}
+
+func (f *readFile) Readdir(int) ([]os.FileInfo, error) { return nil, fmt.Errorf("not a directory") }
+func (f *readFile) Write([]byte) (int, error)          { return 0, os.ErrPermission }
+
+func (f *readFile) Close() error {
+	if f.read > 0 {
+		metrics.ObserveTransfer(metrics.DOWNLOAD, f.fs.user, f.read)
+	}
+	if f.reader == nil {
+		return nil
+	}
+	return f.reader.Close()
+}
+
+// writeFile streams the contents of a file to be written through the files
+// of the file system, which store them once it is closed. Nothing is
+// committed when the request body could not be read in full.
+type writeFile struct {
+	fs          *fileSystem
+	ctx         context.Context
+	name        string
+	contentType string
+	modTime     time.Time
+
+	pipe    *io.PipeWriter
+	done    chan error
+	written int64
+	aborted bool
+}
+
+func (f *writeFile) Write(b []byte) (int, error) {
+	if f.written+int64(len(b)) > f.fs.maxSize {
+		return 0, errTooLarge
+	}
+	if f.aborted {
+		return 0, errAborted
+	}
+	if f.pipe == nil {
+		f.open()
+	}
+	n, err := f.pipe.Write(b)
+	f.written += int64(n)
+	return n, err
+}
+
+// open starts writing the file from what is written to the pipe.
+func (f *writeFile) open() {
+	reader, writer := io.Pipe()
+	f.pipe, f.done = writer, make(chan error, 1)
+
+	holder := f.fs.holder(f.name)
+	holder.ContentType = f.contentType
+	go func() {
+		_, _, err := f.fs.files.WriteFile(f.ctx, holder, reader)
+		// Fails the writes still pending when the file could not be written
+		reader.CloseWithError(err)
+		f.done <- err
+	}()
+}
+
+// Abort fails the contents of the file, which discards it. Aborting again
+// does nothing, and the file can no longer be written or stored.
+func (f *writeFile) Abort() {
+	if f.aborted {
+		return
+	}
+	f.aborted = true
+	if f.pipe != nil {
+		f.pipe.CloseWithError(errAborted)
+		<-f.done
+	}
+}
+
+func (f *writeFile) Close() error {
+	if err := bodyError(f.ctx); err != nil {
+		f.Abort()
+		return err
+	}
+	if f.aborted {
+		return errAborted
+	}
+
+	// Empty files are written on close
+	if f.pipe == nil {
+		f.open()
+	}
+	f.pipe.Close()
+	return <-f.done
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: f.name, size: f.written, modTime: f.modTime, contentType: f.contentType}, nil
+}
+
+func (f *writeFile) Read([]byte) (int, error)           { return 0, os.ErrPermission }
+func (f *writeFile) Seek(int64, int) (int64, error)     { return 0, os.ErrPermission }
+func (f *writeFile) Readdir(int) ([]os.FileInfo, error) { return nil, fmt.Errorf("not a directory") }
+
+// fileInfo describes a file for PROPFIND and GET responses.
+type fileInfo struct {
+	name        string
+	size        int64
+	modTime     time.Time
+	contentType string
+	version     int
+	dir         bool
+}
+
+var rootInfo = &fileInfo{name: "/", dir: true}
+
+func newFileInfo(resp *common.Response) *fileInfo {
+	return &fileInfo{
+		name:        resp.File,
+		size:        resp.Size,
+		modTime:     resp.LastModified,
+		contentType: resp.Type,
+		version:     resp.Version,
+	}
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() interface{}   { return nil }
+
+func (i *fileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType reports the type recorded for the file, so that it is not
+// sniffed from its contents.
+func (i *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if i.dir || i.contentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.contentType, nil
+}
+
+// ETag changes with every new version of the file.
+func (i *fileInfo) ETag(ctx context.Context) (string, error) {
+	if i.dir || i.version == 0 {
+		return "", webdav.ErrNotImplemented
+	}
+	return fmt.Sprintf(`"%d-%x"`, i.version, i.modTime.UnixNano()), nil
+}
@@ -0,0 +1,498 @@
+// Package dirsync mirrors a local directory to the files of a user and back.
+//
+// The API stores files under flat names, so only the regular files at the top
+// of the directory are synced. Changes are found by comparing files with a
+// state file recording them as they were after the last sync: local files by
+// size, modification time and SHA-256 checksum, remote files by version and
+// last modification.
+package dirsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/client"
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// Directions of a sync.
+const (
+	// Make the remote files match the directory
+	PUSH = "push"
+	// Make the directory match the remote files
+	PULL = "pull"
+	// Carry changes made on either side over to the other
+	BOTH = "both"
+
+	// Transfers run at the same time by default
+	DEFAULT_CONCURRENCY = 4
+	// Prefix of the files dirsync writes to the directory, which are never synced
+	INTERNAL_PREFIX = ".uploadly-"
+)
+
+// Operations of actions.
+const (
+	UPLOAD        = "upload"
+	UPDATE        = "update"
+	DOWNLOAD      = "download"
+	DELETE_REMOTE = "delete-remote"
+	DELETE_LOCAL  = "delete-local"
+	// The file changed on both sides since the last sync and is left alone
+	CONFLICT = "conflict"
+)
+
+// Remote is the API the files are synced with. It is implemented by
+// *client.Client.
+type Remote interface {
+	List(context.Context) ([]common.Response, error)
+	Info(ctx context.Context, name string) (*common.Response, error)
+	Upload(ctx context.Context, name string, file io.Reader, opts *client.UploadOptions) error
+	Update(ctx context.Context, name string, file io.Reader, opts *client.UploadOptions) error
+	Get(ctx context.Context, name string, w io.Writer) (int64, error)
+	Delete(ctx context.Context, name string) error
+}
+
+type Options struct {
+	// PUSH, PULL or BOTH. Defaults to PUSH
+	Direction string
+	// Delete files missing on the side being synced from. With BOTH, files
+	// deleted on one side since the last sync are deleted on the other.
+	Delete bool
+	// Report the actions without taking them
+	DryRun bool
+	// Glob patterns of the names synced. All names are synced when empty
+	Include []string
+	// Glob patterns of names left alone, taking precedence over Include
+	Exclude []string
+	// Transfers run at the same time. Defaults to DEFAULT_CONCURRENCY
+	Concurrency int
+	// Defaults to STATE_FILE in the directory
+	StateFile string
+}
+
+// Action is a change made, or planned in a dry run, to bring one file in sync.
+type Action struct {
+	Op   string
+	Name string
+	// Why the action is needed
+	Reason string
+	// Set when the action failed
+	Err error
+}
+
+type localFile struct {
+	size    int64
+	modTime time.Time
+	hash    string
+	changed bool
+}
+
+type syncer struct {
+	api  Remote
+	dir  string
+	opts Options
+
+	// Both sides as they were when the sync was planned
+	local  map[string]*localFile
+	remote map[string]common.Response
+
+	mu    sync.Mutex
+	state *state
+}
+
+// Sync brings the directory and the remote files in sync and returns the
+// actions taken. Actions that fail do not stop the others; an error is
+// returned along with the actions when any failed. The state file is updated
+// for the files that are in sync afterwards.
+func Sync(ctx context.Context, remote Remote, dir string, opts Options) ([]Action, error) {
+	if opts.Direction == "" {
+		opts.Direction = PUSH
+	}
+	if opts.Direction != PUSH && opts.Direction != PULL && opts.Direction != BOTH {
+		return nil, fmt.Errorf("direction must be %s, %s or %s", PUSH, PULL, BOTH)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DEFAULT_CONCURRENCY
+	}
+	if opts.StateFile == "" {
+		opts.StateFile = filepath.Join(dir, STATE_FILE)
+	}
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	st, err := loadState(opts.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file: %v", err)
+	}
+	s := &syncer{api: remote, dir: dir, opts: opts, state: st}
+
+	actions, err := s.plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return actions, nil
+	}
+
+	s.execute(ctx, actions)
+	if err := s.state.save(opts.StateFile); err != nil {
+		return actions, fmt.Errorf("unable to write state file: %v", err)
+	}
+
+	failed := 0
+	for _, a := range actions {
+		if a.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return actions, fmt.Errorf("%d of %d actions failed", failed, len(actions))
+	}
+	return actions, nil
+}
+
+// plan compares both sides with the state and returns the actions needed.
+// State entries of files that are in sync are refreshed along the way.
+func (s *syncer) plan(ctx context.Context) ([]Action, error) {
+	listing, err := s.api.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list files: %w", err)
+	}
+	remote := map[string]common.Response{}
+	for _, r := range listing {
+		if s.wanted(r.File) {
+			remote[r.File] = r
+		}
+	}
+
+	local, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+	s.local, s.remote = local, remote
+
+	names := map[string]bool{}
+	for name := range remote {
+		names[name] = true
+	}
+	for name := range local {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var actions []Action
+	for _, name := range sorted {
+		l := local[name]
+		r, onRemote := remote[name]
+		var rp *common.Response
+		if onRemote {
+			rp = &r
+		}
+
+		a, err := s.decide(ctx, name, l, rp)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			actions = append(actions, *a)
+		}
+	}
+
+	// Entries of files that are gone from both sides are dropped
+	for name := range s.state.Files {
+		if !names[name] && s.wanted(name) {
+			delete(s.state.Files, name)
+		}
+	}
+	return actions, nil
+}
+
+func (s *syncer) decide(ctx context.Context, name string, l *localFile, r *common.Response) (*Action, error) {
+	synced, ok := s.state.Files[name]
+	remoteChanged := r != nil && (!ok || r.Version != synced.RemoteVersion || !r.LastModified.Equal(synced.RemoteModified))
+	action := func(op, reason string) (*Action, error) {
+		return &Action{Op: op, Name: name, Reason: reason}, nil
+	}
+
+	switch s.opts.Direction {
+	case PUSH:
+		switch {
+		case l != nil && r == nil:
+			return action(UPLOAD, "not on the server")
+		case l != nil && (l.changed || remoteChanged):
+			return action(UPDATE, changeReason(ok, l.changed, remoteChanged))
+		case l == nil && r != nil && s.opts.Delete:
+			return action(DELETE_REMOTE, "not in the directory")
+		}
+
+	case PULL:
+		switch {
+		case r != nil && l == nil:
+			return action(DOWNLOAD, "not in the directory")
+		case r != nil && (l.changed || remoteChanged):
+			return action(DOWNLOAD, changeReason(ok, l.changed, remoteChanged))
+		case r == nil && l != nil && s.opts.Delete:
+			return action(DELETE_LOCAL, "not on the server")
+		}
+
+	case BOTH:
+		switch {
+		case l != nil && r != nil && !ok:
+			// Files that were never synced are compared by content
+			same, err := s.sameContent(ctx, name, l)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				s.record(name, l, r)
+				return nil, nil
+			}
+			return action(CONFLICT, "differs from the server and was never synced")
+		case l != nil && r != nil:
+			switch {
+			case l.changed && remoteChanged:
+				return action(CONFLICT, "changed locally and on the server")
+			case l.changed:
+				return action(UPDATE, "changed locally")
+			case remoteChanged:
+				return action(DOWNLOAD, "changed on the server")
+			}
+		case l != nil && ok && s.opts.Delete && !l.changed:
+			return action(DELETE_LOCAL, "deleted on the server")
+		case l != nil:
+			return action(UPLOAD, "not on the server")
+		case r != nil && ok && s.opts.Delete && !remoteChanged:
+			return action(DELETE_REMOTE, "deleted locally")
+		case r != nil:
+			return action(DOWNLOAD, "not in the directory")
+		}
+	}
+
+	// The file is in sync. Its entry is refreshed so that a touched file is
+	// not hashed again.
+	if l != nil && r != nil {
+		s.record(name, l, r)
+	}
+	return nil, nil
+}
+
+func changeReason(synced, localChanged, remoteChanged bool) string {
+	switch {
+	case !synced:
+		return "never synced"
+	case localChanged && remoteChanged:
+		return "changed locally and on the server"
+	case localChanged:
+		return "changed locally"
+	default:
+		return "changed on the server"
+	}
+}
+
+// scan returns the regular files of the directory that are synced, hashing
+// the ones that changed since they were recorded.
+func (s *syncer) scan() (map[string]*localFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stateFile, _ := filepath.Abs(s.opts.StateFile)
+	files := map[string]*localFile{}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, INTERNAL_PREFIX) || !s.wanted(name) {
+			continue
+		}
+		p := filepath.Join(s.dir, name)
+		if abs, _ := filepath.Abs(p); abs == stateFile {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		f := &localFile{size: info.Size(), modTime: info.ModTime()}
+		synced, ok := s.state.Files[name]
+		if ok && synced.Size == f.size && synced.ModTime.Equal(f.modTime) {
+			f.hash = synced.SHA256
+		} else {
+			if f.hash, err = hashFile(p); err != nil {
+				return nil, err
+			}
+			f.changed = !ok || f.hash != synced.SHA256
+		}
+		files[name] = f
+	}
+	return files, nil
+}
+
+func (s *syncer) wanted(name string) bool {
+	for _, pattern := range s.opts.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(s.opts.Include) == 0 {
+		return true
+	}
+	for _, pattern := range s.opts.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sameContent downloads the remote file to compare its checksum with the
+// local one.
+func (s *syncer) sameContent(ctx context.Context, name string, l *localFile) (bool, error) {
+	hash := sha256.New()
+	if _, err := s.api.Get(ctx, name, hash); err != nil {
+		return false, fmt.Errorf("unable to compare %s: %w", name, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == l.hash, nil
+}
+
+// execute takes the actions, running up to the configured number at a time.
+func (s *syncer) execute(ctx context.Context, actions []Action) {
+	sem := make(chan struct{}, s.opts.Concurrency)
+	var wg sync.WaitGroup
+	for i := range actions {
+		if actions[i].Op == CONFLICT {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(a *Action) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := ctx.Err(); err != nil {
+				a.Err = err
+				return
+			}
+			a.Err = s.take(ctx, a)
+		}(&actions[i])
+	}
+	wg.Wait()
+}
+
+func (s *syncer) take(ctx context.Context, a *Action) error {
+	switch a.Op {
+	case UPLOAD:
+		return s.upload(ctx, a.Name, s.api.Upload)
+	case UPDATE:
+		return s.upload(ctx, a.Name, s.api.Update)
+	case DOWNLOAD:
+		return s.download(ctx, a.Name)
+	case DELETE_REMOTE:
+		if err := s.api.Delete(ctx, a.Name); err != nil && !client.IsNotFound(err) {
+			return err
+		}
+		s.forget(a.Name)
+	case DELETE_LOCAL:
+		if err := os.Remove(filepath.Join(s.dir, a.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.forget(a.Name)
+	}
+	return nil
+}
+
+type uploadFunc func(context.Context, string, io.Reader, *client.UploadOptions) error
+
+func (s *syncer) upload(ctx context.Context, name string, send uploadFunc) error {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanned := s.local[name]
+	if err := send(ctx, name, f, &client.UploadOptions{Size: scanned.size}); err != nil {
+		return err
+	}
+
+	// A file that changed since it was hashed is left for the next run
+	if info, err := f.Stat(); err != nil || info.Size() != scanned.size || !info.ModTime().Equal(scanned.modTime) {
+		return nil
+	}
+	r, err := s.api.Info(ctx, name)
+	if err != nil {
+		return err
+	}
+	s.record(name, scanned, r)
+	return nil
+}
+
+// download writes to a temporary file that replaces the local file once it is
+// complete, so that a failed download leaves the local file as it was.
+func (s *syncer) download(ctx context.Context, name string) error {
+	tmp, err := os.CreateTemp(s.dir, INTERNAL_PREFIX+"download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = s.api.Get(ctx, name, io.MultiWriter(tmp, hash))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(s.dir, name)
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	// The version listed before downloading is recorded, so that a change made
+	// during the download is picked up by the next run
+	r := s.remote[name]
+	s.record(name, &localFile{size: info.Size(), modTime: info.ModTime(), hash: hex.EncodeToString(hash.Sum(nil))}, &r)
+	return nil
+}
+
+func (s *syncer) record(name string, l *localFile, r *common.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Files[name] = entry{
+		Size:           l.size,
+		ModTime:        l.modTime,
+		SHA256:         l.hash,
+		RemoteVersion:  r.Version,
+		RemoteModified: r.LastModified,
+	}
+}
+
+func (s *syncer) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.state.Files, name)
+}
@@ -0,0 +1,270 @@
+package dirsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/client"
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// remote keeps the files of a user in memory, bumping their version on every
+// upload.
+type remote struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	info  map[string]common.Response
+}
+
+func newRemote() *remote {
+	return &remote{files: map[string][]byte{}, info: map[string]common.Response{}}
+}
+
+func (r *remote) put(name string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := r.info[name]
+	r.files[name] = data
+	r.info[name] = common.Response{File: name, Version: info.Version + 1, LastModified: time.Now()}
+}
+
+func (r *remote) List(ctx context.Context) ([]common.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	listing := []common.Response{}
+	for _, info := range r.info {
+		listing = append(listing, info)
+	}
+	return listing, nil
+}
+
+func (r *remote) Info(ctx context.Context, name string) (*common.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := r.info[name]
+	return &info, nil
+}
+
+func (r *remote) Upload(ctx context.Context, name string, file io.Reader, opts *client.UploadOptions) error {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	r.put(name, data)
+	return nil
+}
+
+func (r *remote) Update(ctx context.Context, name string, file io.Reader, opts *client.UploadOptions) error {
+	return r.Upload(ctx, name, file, opts)
+}
+
+func (r *remote) Get(ctx context.Context, name string, w io.Writer) (int64, error) {
+	r.mu.Lock()
+	data := r.files[name]
+	r.mu.Unlock()
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func (r *remote) Delete(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.files, name)
+	delete(r.info, name)
+	return nil
+}
+
+// States of a file on one side, compared to the last sync
+const (
+	MISSING = iota
+	UNCHANGED
+	CHANGED
+)
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name      string
+		direction string
+		delete    bool
+		// Whether the file was recorded by a previous sync
+		synced bool
+		local  int
+		remote int
+		op     string
+		reason string
+	}{
+		{"push new file", PUSH, false, false, CHANGED, MISSING, UPLOAD, "not on the server"},
+		{"push changed file", PUSH, false, true, CHANGED, UNCHANGED, UPDATE, "changed locally"},
+		{"push over a remote change", PUSH, false, true, UNCHANGED, CHANGED, UPDATE, "changed on the server"},
+		{"push file never synced", PUSH, false, false, CHANGED, UNCHANGED, UPDATE, "never synced"},
+		{"push file in sync", PUSH, false, true, UNCHANGED, UNCHANGED, "", ""},
+		{"push file deleted locally", PUSH, true, true, MISSING, UNCHANGED, DELETE_REMOTE, "not in the directory"},
+		{"push remote file without delete", PUSH, false, false, MISSING, UNCHANGED, "", ""},
+
+		{"pull new file", PULL, false, false, MISSING, CHANGED, DOWNLOAD, "not in the directory"},
+		{"pull changed file", PULL, false, true, UNCHANGED, CHANGED, DOWNLOAD, "changed on the server"},
+		{"pull over a local change", PULL, false, true, CHANGED, UNCHANGED, DOWNLOAD, "changed locally"},
+		{"pull file in sync", PULL, false, true, UNCHANGED, UNCHANGED, "", ""},
+		{"pull file deleted on the server", PULL, true, true, UNCHANGED, MISSING, DELETE_LOCAL, "not on the server"},
+		{"pull local file without delete", PULL, false, false, CHANGED, MISSING, "", ""},
+
+		{"both changed", BOTH, false, true, CHANGED, CHANGED, CONFLICT, "changed locally and on the server"},
+		{"both changed locally", BOTH, false, true, CHANGED, UNCHANGED, UPDATE, "changed locally"},
+		{"both changed on the server", BOTH, false, true, UNCHANGED, CHANGED, DOWNLOAD, "changed on the server"},
+		{"both in sync", BOTH, false, true, UNCHANGED, UNCHANGED, "", ""},
+		{"both deleted on the server", BOTH, true, true, UNCHANGED, MISSING, DELETE_LOCAL, "deleted on the server"},
+		{"both deleted on the server and changed locally", BOTH, true, true, CHANGED, MISSING, UPLOAD, "not on the server"},
+		{"both deleted on the server without delete", BOTH, false, true, UNCHANGED, MISSING, UPLOAD, "not on the server"},
+		{"both new local file", BOTH, true, false, CHANGED, MISSING, UPLOAD, "not on the server"},
+		{"both deleted locally", BOTH, true, true, MISSING, UNCHANGED, DELETE_REMOTE, "deleted locally"},
+		{"both deleted locally and changed on the server", BOTH, true, true, MISSING, CHANGED, DOWNLOAD, "not in the directory"},
+		{"both deleted locally without delete", BOTH, false, true, MISSING, UNCHANGED, DOWNLOAD, "not in the directory"},
+		{"both new remote file", BOTH, true, false, MISSING, CHANGED, DOWNLOAD, "not in the directory"},
+	}
+
+	modified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &syncer{opts: Options{Direction: test.direction, Delete: test.delete}, state: &state{Files: map[string]entry{}}}
+			if test.synced {
+				s.state.Files["file"] = entry{SHA256: "synced", RemoteVersion: 1, RemoteModified: modified}
+			}
+
+			var l *localFile
+			if test.local != MISSING {
+				l = &localFile{hash: "synced", changed: test.local == CHANGED}
+			}
+			var r *common.Response
+			if test.remote == UNCHANGED {
+				r = &common.Response{File: "file", Version: 1, LastModified: modified}
+			} else if test.remote == CHANGED {
+				r = &common.Response{File: "file", Version: 2, LastModified: modified.Add(time.Minute)}
+			}
+
+			a, err := s.decide(context.Background(), "file", l, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.op == "" {
+				if a != nil {
+					t.Errorf("expected no action, got %+v", a)
+				}
+				return
+			}
+			if a == nil || a.Op != test.op || a.Reason != test.reason {
+				t.Errorf("expected %s because %s, got %+v", test.op, test.reason, a)
+			}
+		})
+	}
+}
+
+func TestDecideComparesFilesNeverSynced(t *testing.T) {
+	hash := sha256.Sum256([]byte("contents"))
+	r := newRemote()
+	r.put("same", []byte("contents"))
+	r.put("different", []byte("other contents"))
+
+	s := &syncer{api: r, opts: Options{Direction: BOTH}, state: &state{Files: map[string]entry{}}}
+	l := &localFile{size: 8, hash: hex.EncodeToString(hash[:]), changed: true}
+
+	info, _ := r.Info(context.Background(), "same")
+	if a, err := s.decide(context.Background(), "same", l, info); err != nil || a != nil {
+		t.Errorf("expected identical files to be in sync, got %+v, %v", a, err)
+	}
+	if synced, ok := s.state.Files["same"]; !ok || synced.RemoteVersion != info.Version || synced.SHA256 != l.hash {
+		t.Errorf("expected identical files to be recorded, got %+v", synced)
+	}
+
+	info, _ = r.Info(context.Background(), "different")
+	if a, err := s.decide(context.Background(), "different", l, info); err != nil || a == nil || a.Op != CONFLICT {
+		t.Errorf("expected differing files to conflict, got %+v, %v", a, err)
+	}
+}
+
+func write(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ops(actions []Action) []string {
+	var ops []string
+	for _, a := range actions {
+		ops = append(ops, a.Op+" "+a.Name)
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+func TestSyncDeletesBothWays(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := newRemote()
+	write(t, dir, "local.txt", "local")
+	write(t, dir, "kept.txt", "kept")
+	r.put("remote.txt", []byte("remote"))
+
+	actions, err := Sync(ctx, r, dir, Options{Direction: BOTH, Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ops(actions); len(got) != 3 {
+		t.Fatalf("expected the files to be copied both ways, got %v", got)
+	}
+
+	// Each side deletes a file the other has
+	if err := os.Remove(filepath.Join(dir, "local.txt")); err != nil {
+		t.Fatal(err)
+	}
+	r.Delete(ctx, "remote.txt")
+
+	actions, err = Sync(ctx, r, dir, Options{Direction: BOTH, Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{DELETE_LOCAL + " remote.txt", DELETE_REMOTE + " local.txt"}
+	if got := ops(actions); len(got) != 2 || got[0] != expected[0] || got[1] != expected[1] {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "remote.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected the local copy to be deleted, got %v", err)
+	}
+	if _, ok := r.files["local.txt"]; ok {
+		t.Error("expected the remote copy to be deleted")
+	}
+	if data, ok := r.files["kept.txt"]; !ok || !bytes.Equal(data, []byte("kept")) {
+		t.Errorf("expected other files to be kept, got %q", data)
+	}
+
+	actions, err = Sync(ctx, r, dir, Options{Direction: BOTH, Delete: true})
+	if err != nil || len(actions) != 0 {
+		t.Errorf("expected both sides to be in sync, got %v, %v", ops(actions), err)
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	dir := t.TempDir()
+	r := newRemote()
+	write(t, dir, "local.txt", "local")
+
+	actions, err := Sync(context.Background(), r, dir, Options{Direction: PUSH, DryRun: true})
+	if err != nil || len(actions) != 1 || actions[0].Op != UPLOAD {
+		t.Fatalf("expected an upload to be planned, got %v, %v", ops(actions), err)
+	}
+	if len(r.files) != 0 {
+		t.Error("expected nothing to be uploaded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, STATE_FILE)); !os.IsNotExist(err) {
+		t.Errorf("expected no state file, got %v", err)
+	}
+}
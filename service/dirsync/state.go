@@ -0,0 +1,86 @@
+package dirsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Name of the state file kept in the synced directory by default. It is never
+// synced itself.
+const STATE_FILE = ".uploadly-sync.json"
+
+// entry records a file as it was when it was last in sync, so that later runs
+// only hash files whose size or modification time changed.
+type entry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+	// Version and last modification of the remote file
+	RemoteVersion  int       `json:"remote_version"`
+	RemoteModified time.Time `json:"remote_modified"`
+}
+
+type state struct {
+	Files map[string]entry `json:"files"`
+}
+
+func loadState(path string) (*state, error) {
+	s := &state{Files: map[string]entry{}}
+	bytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, s); err != nil {
+		return nil, err
+	}
+	if s.Files == nil {
+		s.Files = map[string]entry{}
+	}
+	return s, nil
+}
+
+// save replaces the state file at once, so that an interrupted run leaves the
+// previous state behind.
+func (s *state) save(path string) error {
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
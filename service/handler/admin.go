@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/vjsamuel/uploadly/service/apierror"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.profiles.List(r.Context())
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to process request")
+		return
+	}
+
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to get users")
+		return
+	}
+
+	fmt.Fprintf(w, "%s", string(bytes))
+}
+
+func (h *Handler) GetUserUsage(w http.ResponseWriter, r *http.Request) {
+	holder := getProfileHolder(r)
+	if _, err := h.profiles.Get(r.Context(), holder); err == storage.ErrNotFound {
+		apierror.Write(w, r, http.StatusNotFound, fmt.Sprintf("User %s does not exist", holder.GetProfileID()))
+		return
+	} else if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to process request")
+		return
+	}
+
+	usage, err := h.profiles.Usage(r.Context(), holder)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to process request")
+		return
+	}
+
+	bytes, err := json.Marshal(usage)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to get usage")
+		return
+	}
+
+	fmt.Fprintf(w, "%s", string(bytes))
+}
+
+func (h *Handler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, r, true)
+}
+
+func (h *Handler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, r, false)
+}
+
+func (h *Handler) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	holder := getProfileHolder(r)
+	err := h.profiles.SetDisabled(r.Context(), holder, disabled)
+	if err == storage.ErrNotFound {
+		apierror.Write(w, r, http.StatusNotFound, fmt.Sprintf("User %s does not exist", holder.GetProfileID()))
+		return
+	}
+
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to update user. Please try again")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func getProfileHolder(r *http.Request) common.Holder {
+	vars := mux.Vars(r)
+	return common.Holder{
+		User: common.User{
+			Profile: vars["profile"],
+		},
+	}
+}
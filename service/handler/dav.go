@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/dav"
+	"golang.org/x/net/webdav"
+)
+
+// DAV serves the files of the authenticated user over WebDAV under the
+// prefix. Files written over WebDAV are written with WriteFile rather than
+// published, so that clients can read them back as soon as they are written.
+func (h *Handler) DAV(prefix string) http.Handler {
+	return dav.NewHandler(dav.Options{
+		Prefix:        prefix,
+		Objects:       h.object,
+		Metadata:      h.entity,
+		Files:         h,
+		MaxUploadSize: h.maxUploadSize,
+		SizeExceeded:  h.sizeExceeded(),
+		User:          h.getUserFromRequest,
+	})
+}
+
+// FileSystem exposes the files of the user like they are served over WebDAV,
+// for serving them over other protocols.
+func (h *Handler) FileSystem(usr common.User) webdav.FileSystem {
+	return dav.NewFileSystem(h.object, h.entity, h, usr, h.maxUploadSize)
+}
@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+// ErrTooLarge is returned when a file is larger than the upload limit.
+var ErrTooLarge = errors.New("file size exceeded")
+
+// The operations below hold the logic of the file routes without their HTTP
+// framing, so that other APIs serve files the same way. Missing files are
+// reported with storage.ErrNotFound.
+
+// ListFiles returns the metadata of all files of the user, from the cache
+// when it holds the listing. The version of the listing is read before the
+// metadata store, so that a listing read before a change is cached under a
+// version that is no longer current.
+func (h *Handler) ListFiles(ctx context.Context, usr common.User) ([]common.Response, error) {
+	holder := common.Holder{User: usr}
+
+	version, err := h.mcache.ListVersion(ctx, holder)
+	if err != nil {
+		// Without a version the listing can be neither cached nor shared
+		return h.entity.List(ctx, holder)
+	}
+
+	resp := []common.Response{}
+	if bytes, err := h.mcache.GetList(ctx, holder, version); err == nil && json.Unmarshal(bytes, &resp) == nil {
+		return resp, nil
+	}
+
+	key := fmt.Sprintf("list\x00%s\x00%d", usr.Profile, version)
+	val, err := h.coalesce(ctx, key, func(ctx context.Context) (any, error) {
+		resp, err := h.entity.List(ctx, holder)
+		if err != nil {
+			return nil, err
+		}
+		if bytes, err := json.Marshal(resp); err == nil {
+			h.mcache.SetList(ctx, holder, version, bytes)
+		}
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]common.Response{}, val.([]common.Response)...), nil
+}
+
+// FileInfo returns the metadata of the named file, from the cache when it
+// holds it for the current version of the file. The version is read before
+// the metadata store, so that metadata read before a change is cached with a
+// version that is no longer current.
+func (h *Handler) FileInfo(ctx context.Context, usr common.User, name string) (*common.Response, error) {
+	holder := common.Holder{File: name, User: usr}
+
+	version, err := h.mcache.FileVersion(ctx, holder)
+	if err != nil {
+		// Without a version the metadata can be neither cached nor shared
+		return h.entity.Get(ctx, holder)
+	}
+
+	cached := &cachedInfo{}
+	if bytes, err := h.mcache.Get(ctx, holder); err == nil && json.Unmarshal(bytes, cached) == nil && cached.Version == version && cached.Response != nil {
+		return cached.Response, nil
+	}
+
+	key := fmt.Sprintf("info\x00%s\x00%s\x00%d", usr.Profile, name, version)
+	val, err := h.coalesce(ctx, key, func(ctx context.Context) (any, error) {
+		resp, err := h.entity.Get(ctx, holder)
+		if err != nil {
+			return nil, err
+		}
+		if bytes, err := json.Marshal(cachedInfo{Version: version, Response: resp}); err == nil {
+			h.mcache.Set(ctx, holder, bytes)
+		}
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := *val.(*common.Response)
+	return &info, nil
+}
+
+// cachedInfo is the metadata of a file as it is cached, with the version of
+// the file it was read at.
+type cachedInfo struct {
+	Version  uint64           `json:"version"`
+	Response *common.Response `json:"response"`
+}
+
+// coalesce runs fn once for the concurrent callers of the same key, and
+// shares its result. fn runs without the cancellation of the caller that
+// started it, so that the callers still waiting are not failed when it goes
+// away; a caller that goes away stops waiting.
+func (h *Handler) coalesce(ctx context.Context, key string, fn func(context.Context) (any, error)) (any, error) {
+	results := h.flight.DoChan(key, func() (any, error) {
+		return fn(context.WithoutCancel(ctx))
+	})
+
+	select {
+	case res := <-results:
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// StoreFile publishes the contents of the file of the holder to be written
+// and records its metadata. Updates require the file to exist and count a
+// new version of it. The size recorded is the one of the holder, or the size
+// of the contents when it is not set. It returns the size of the contents.
+func (h *Handler) StoreFile(ctx context.Context, holder common.Holder, contents io.Reader, update bool) (int64, error) {
+	if update {
+		if _, err := h.entity.Get(ctx, holder); err != nil {
+			return 0, err
+		}
+	}
+
+	counter := &countingReader{reader: contents, max: h.maxUploadSize}
+	publishCtx, cancel := context.WithTimeout(ctx, h.publishTimeout)
+	err := h.psub.Publish(publishCtx, holder, counter)
+	cancel()
+	if counter.exceeded {
+		return 0, ErrTooLarge
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if holder.Size == 0 {
+		holder.Size = counter.read
+	}
+	if update {
+		err = h.entity.Update(ctx, holder)
+	} else {
+		err = h.entity.Insert(ctx, holder)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	h.invalidate(ctx, holder)
+	metrics.ObserveTransfer(metrics.UPLOAD, holder.User, counter.read)
+	return counter.read, nil
+}
+
+// WriteObject streams the contents to the object of the holder, up to the
+// upload limit, and returns their size and MD5. The object is discarded when
+// the contents can not be read in full. It records no metadata, so the object
+// is not a file unless WriteFile wrote it.
+func (h *Handler) WriteObject(ctx context.Context, holder common.Holder, contents io.Reader) (int64, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer, err := h.object.Writer(ctx, holder)
+	if err != nil {
+		return 0, nil, err
+	}
+	counter := &countingReader{reader: contents, max: h.maxUploadSize}
+	sum := md5.New()
+	size, err := io.Copy(io.MultiWriter(writer, sum), counter)
+	if err != nil {
+		// Cancelling the context aborts the write
+		cancel()
+		writer.Close()
+		return 0, nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, nil, err
+	}
+	return size, sum.Sum(nil), nil
+}
+
+// WriteFile writes the contents of the file of the holder to the object store
+// rather than publishing them, so that they can be read back right away, and
+// records its metadata. The file is created when it does not exist, and keeps
+// its description unless the holder has one. It returns the size and the MD5
+// of the contents.
+func (h *Handler) WriteFile(ctx context.Context, holder common.Holder, contents io.Reader) (int64, []byte, error) {
+	size, sum, err := h.WriteObject(ctx, holder, contents)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	existing, err := h.entity.Get(ctx, holder)
+	if err != nil && err != storage.ErrNotFound {
+		return 0, nil, err
+	}
+	if existing != nil && holder.Description == "" {
+		holder.Description = existing.Description
+	}
+	holder.Size = size
+	if existing != nil {
+		err = h.entity.Update(ctx, holder)
+	} else {
+		err = h.entity.Insert(ctx, holder)
+	}
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Unable to record written file", "file", holder.File, "error", err)
+		return 0, nil, err
+	}
+
+	h.invalidate(ctx, holder)
+	metrics.ObserveTransfer(metrics.UPLOAD, holder.User, size)
+	return size, sum, nil
+}
+
+// OpenFile returns the contents of the named file. The download is counted
+// once the reader is closed.
+func (h *Handler) OpenFile(ctx context.Context, usr common.User, name string) (io.ReadCloser, error) {
+	reader, err := h.object.Reader(ctx, common.Holder{File: name, User: usr})
+	if err != nil {
+		return nil, err
+	}
+	return &downloadReader{ReadCloser: reader, user: usr}, nil
+}
+
+// RemoveFile deletes the contents and the metadata of the named file.
+func (h *Handler) RemoveFile(ctx context.Context, usr common.User, name string) error {
+	holder := common.Holder{File: name, User: usr}
+	if _, err := h.entity.Get(ctx, holder); err != nil {
+		return err
+	}
+
+	if err := h.object.Delete(ctx, holder); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	if err := h.entity.Delete(ctx, holder); err != nil {
+		return err
+	}
+
+	h.invalidate(ctx, holder)
+	return nil
+}
+
+func (h *Handler) invalidate(ctx context.Context, holder common.Holder) {
+	h.mcache.Delete(ctx, holder)
+	h.mcache.DeleteList(ctx, holder)
+}
+
+// countingReader counts the bytes read and fails once more than max were.
+type countingReader struct {
+	reader   io.Reader
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	c.read += int64(n)
+	if c.read > c.max {
+		c.exceeded = true
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+type downloadReader struct {
+	io.ReadCloser
+	user common.User
+	read int64
+}
+
+func (d *downloadReader) Read(b []byte) (int, error) {
+	n, err := d.ReadCloser.Read(b)
+	d.read += int64(n)
+	return n, err
+}
+
+func (d *downloadReader) Close() error {
+	metrics.ObserveTransfer(metrics.DOWNLOAD, d.user, d.read)
+	return d.ReadCloser.Close()
+}
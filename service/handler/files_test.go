@@ -0,0 +1,263 @@
+package handler_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/cache"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/handler"
+	"github.com/vjsamuel/uploadly/service/memcache"
+	"github.com/vjsamuel/uploadly/service/memcache/memcachetest"
+	"github.com/vjsamuel/uploadly/service/storage"
+	"github.com/vjsamuel/uploadly/service/uploadly/uploadlytest"
+)
+
+var owner = common.User{Profile: "owner", Scopes: common.Scopes}
+
+// heldRecords holds a read of the metadata store, once it has read the
+// records, until it is released, so that files can be changed while the read
+// is in flight.
+type heldRecords struct {
+	uploadlytest.Records
+
+	mu      sync.Mutex
+	held    chan struct{}
+	release chan struct{}
+}
+
+// holdNext holds the next read. held is closed once the read is held.
+func (r *heldRecords) holdNext(t *testing.T) (held <-chan struct{}, release func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.held, r.release = make(chan struct{}), make(chan struct{})
+
+	var once sync.Once
+	releaseCh := r.release
+	release = func() { once.Do(func() { close(releaseCh) }) }
+	t.Cleanup(release)
+	return r.held, release
+}
+
+func (r *heldRecords) wait() {
+	r.mu.Lock()
+	held, release := r.held, r.release
+	r.held, r.release = nil, nil
+	r.mu.Unlock()
+
+	if held != nil {
+		close(held)
+		<-release
+	}
+}
+
+func (r *heldRecords) Get(ctx context.Context, holder common.Holder) (*common.Response, error) {
+	resp, err := r.Records.Get(ctx, holder)
+	r.wait()
+	return resp, err
+}
+
+func (r *heldRecords) List(ctx context.Context, holder common.Holder) ([]common.Response, error) {
+	resp, err := r.Records.List(ctx, holder)
+	r.wait()
+	return resp, err
+}
+
+// backends returns a cache of every backend.
+func backends(t *testing.T) map[string]storage.Cache {
+	server, err := memcachetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return map[string]storage.Cache{
+		"none":     cache.NewNone(100),
+		"local":    cache.NewLRU(100, time.Minute),
+		"memcache": memcache.NewMemcacheStorage(server.Config()),
+		"tiered":   cache.NewTiered(cache.NewLRU(100, time.Minute), memcache.NewMemcacheStorage(server.Config())),
+	}
+}
+
+func newHandler(t *testing.T, backend string, c storage.Cache) (*handler.Handler, *heldRecords) {
+	t.Helper()
+
+	store := uploadlytest.NewStore()
+	opts := store.Options(nil)
+	records := &heldRecords{Records: opts.MetadataStore.(uploadlytest.Records)}
+
+	cfg := config.Default()
+	cfg.Cache.Backend = backend
+	h, err := handler.NewHandler(cfg, handler.Backends{
+		Objects:   opts.ObjectStore,
+		Metadata:  records,
+		Cache:     c,
+		Publisher: opts.Publisher,
+		Keys:      opts.KeyStore,
+		Profiles:  opts.ProfileStore,
+	}, opts.Authenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, records
+}
+
+func store(t *testing.T, h *handler.Handler, name, description string, update bool) {
+	t.Helper()
+	holder := common.Holder{File: name, User: owner, ContentType: "text/plain", Description: description}
+	if _, err := h.StoreFile(context.Background(), holder, strings.NewReader(description), update); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// async runs fn in the background, for reads that are held.
+func async[T any](fn func() T) <-chan T {
+	result := make(chan T, 1)
+	go func() { result <- fn() }()
+	return result
+}
+
+// await fails the test when fn waits for a read held since before a change.
+func await[T any](t *testing.T, what string, fn func() T) T {
+	t.Helper()
+	select {
+	case v := <-async(fn):
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s waited for a read started before the change", what)
+		panic("unreachable")
+	}
+}
+
+type info struct {
+	resp *common.Response
+	err  error
+}
+
+func fileInfo(h *handler.Handler, name string) func() info {
+	return func() info {
+		resp, err := h.FileInfo(context.Background(), owner, name)
+		return info{resp, err}
+	}
+}
+
+func listFiles(h *handler.Handler) func() []string {
+	return func() []string {
+		files, err := h.ListFiles(context.Background(), owner)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.File)
+		}
+		return names
+	}
+}
+
+func TestInfoDuringUpdate(t *testing.T) {
+	for backend, c := range backends(t) {
+		t.Run(backend, func(t *testing.T) {
+			h, records := newHandler(t, backend, c)
+			store(t, h, "notes.txt", "first", false)
+
+			held, release := records.holdNext(t)
+			before := async(fileInfo(h, "notes.txt"))
+			<-held
+			store(t, h, "notes.txt", "second", true)
+
+			if got := await(t, "info", fileInfo(h, "notes.txt")); got.err != nil || got.resp.Description != "second" {
+				t.Errorf("expected the updated info, got %+v, %v", got.resp, got.err)
+			}
+			release()
+			<-before
+
+			// The read from before the update must not have been cached
+			if got := fileInfo(h, "notes.txt")(); got.err != nil || got.resp.Description != "second" || got.resp.Version != 2 {
+				t.Errorf("expected the updated info, got %+v, %v", got.resp, got.err)
+			}
+		})
+	}
+}
+
+func TestInfoDuringDelete(t *testing.T) {
+	for backend, c := range backends(t) {
+		t.Run(backend, func(t *testing.T) {
+			h, records := newHandler(t, backend, c)
+			store(t, h, "notes.txt", "first", false)
+
+			held, release := records.holdNext(t)
+			before := async(fileInfo(h, "notes.txt"))
+			<-held
+			if err := h.RemoveFile(context.Background(), owner, "notes.txt"); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := await(t, "info", fileInfo(h, "notes.txt")); got.err != storage.ErrNotFound {
+				t.Errorf("expected the deleted file to be missing, got %+v, %v", got.resp, got.err)
+			}
+			release()
+			<-before
+
+			// The read from before the delete must not have been cached
+			if got := fileInfo(h, "notes.txt")(); got.err != storage.ErrNotFound {
+				t.Errorf("expected the deleted file to be missing, got %+v, %v", got.resp, got.err)
+			}
+		})
+	}
+}
+
+func TestListDuringUpload(t *testing.T) {
+	for backend, c := range backends(t) {
+		t.Run(backend, func(t *testing.T) {
+			h, records := newHandler(t, backend, c)
+			store(t, h, "a.txt", "a", false)
+
+			held, release := records.holdNext(t)
+			before := async(listFiles(h))
+			<-held
+			store(t, h, "b.txt", "b", false)
+
+			if got := await(t, "listing", listFiles(h)); strings.Join(got, ",") != "a.txt,b.txt" {
+				t.Errorf("expected both files, got %v", got)
+			}
+			release()
+			<-before
+
+			if got := listFiles(h)(); strings.Join(got, ",") != "a.txt,b.txt" {
+				t.Errorf("expected both files, got %v", got)
+			}
+		})
+	}
+}
+
+func TestListDuringDelete(t *testing.T) {
+	for backend, c := range backends(t) {
+		t.Run(backend, func(t *testing.T) {
+			h, records := newHandler(t, backend, c)
+			store(t, h, "a.txt", "a", false)
+			store(t, h, "b.txt", "b", false)
+
+			held, release := records.holdNext(t)
+			before := async(listFiles(h))
+			<-held
+			if err := h.RemoveFile(context.Background(), owner, "a.txt"); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := await(t, "listing", listFiles(h)); strings.Join(got, ",") != "b.txt" {
+				t.Errorf("expected the remaining file, got %v", got)
+			}
+			release()
+			<-before
+
+			if got := listFiles(h)(); strings.Join(got, ",") != "b.txt" {
+				t.Errorf("expected the remaining file, got %v", got)
+			}
+		})
+	}
+}
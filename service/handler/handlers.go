@@ -5,377 +5,313 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
-	"os"
 	"strconv"
+	"time"
 	"encoding/json"
 
 	"github.com/gorilla/mux"
 	"github.com/vjsamuel/uploadly/service/storage"
-	"github.com/vjsamuel/uploadly/service/storage/object"
-	"github.com/vjsamuel/uploadly/service/cache"
+	"github.com/vjsamuel/uploadly/service/apierror"
 	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/health"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/tracing"
 	"github.com/vjsamuel/uploadly/service/auth"
-	"github.com/vjsamuel/uploadly/service/storage/entity"
-	"github.com/vjsamuel/uploadly/service/pubsub"
-	"github.com/vjsamuel/uploadly/service/memcache"
+	"golang.org/x/sync/singleflight"
 )
 
-type handler struct {
-	object storage.Storage
-	entity storage.Storage
-	psub   *pubsub.PubSub
-	users *cache.EvictableMap
-	mcache *memcache.Memcache
+// Publisher hands uploaded files over to be written to the object store.
+type Publisher interface {
+	Publish(context.Context, common.Holder, io.Reader) error
+	// Ping checks that messages can be published
+	Ping(context.Context) error
+	Close() error
 }
 
-func NewHandler(users *cache.EvictableMap) *handler {
-	projectId := os.Getenv("PROJECT_ID")
-	bucket := os.Getenv("BUCKET")
-	ctx := context.Background()
-
-	o := object.NewObjectStorage(bucket, projectId, ctx)
-	if o == nil {
-		log.Fatal("Unable to create cloud storage client")
-	}
-	e := entity.NewEntityStorage(projectId, ctx)
-	if e == nil {
-		log.Fatal("Unable to create datastore client")
-	}
-
-	p := pubsub.NewPubSub(projectId, bucket, ctx)
-	if p == nil {
-		log.Fatal("Unable to create pubsub client")
-	}
-
-	host := os.Getenv("MEMCACHE_SERVICE_HOST")
-	if host == "" {
-		host = "localhost"
-	}
-
-	port := os.Getenv("MEMCACHE_SERVICE_PORT")
-	if port == "" {
-		port = "11211"
-	}
+// Backends are the stores and publisher the handler serves requests from.
+type Backends struct {
+	Objects   storage.ObjectStore
+	Metadata  storage.MetadataStore
+	Cache     storage.Cache
+	Publisher Publisher
+	Keys      storage.KeyStore
+	Profiles  storage.ProfileStore
+}
 
-	mcache := memcache.NewMemcacheStorage(host, port)
+type Handler struct {
+	object storage.ObjectStore
+	entity storage.MetadataStore
+	psub   Publisher
+	auth   auth.Authenticator
+	mcache storage.Cache
+	cacheBackend string
+	// Coalesces concurrent reads of metadata missing from the cache
+	flight singleflight.Group
+	keys   storage.KeyStore
+	profiles storage.ProfileStore
+	publishTimeout time.Duration
+	maxUploadSize int64
+	s3Secret string
+}
 
-	return &handler{object: o, users: users, entity: e, psub: p, mcache: mcache}
+// NewHandler serves the API from the backends, applying the storage timeouts
+// and upload limits of the config. Users are looked up with the authenticator
+// that guards the routes. The backends are not closed by the handler.
+func NewHandler(cfg *config.Config, backends Backends, authenticator auth.Authenticator) (*Handler, error) {
+	switch {
+	case backends.Objects == nil:
+		return nil, fmt.Errorf("an object store is required")
+	case backends.Metadata == nil:
+		return nil, fmt.Errorf("a metadata store is required")
+	case backends.Cache == nil:
+		return nil, fmt.Errorf("a cache is required")
+	case backends.Publisher == nil:
+		return nil, fmt.Errorf("a publisher is required")
+	case backends.Keys == nil:
+		return nil, fmt.Errorf("a key store is required")
+	case backends.Profiles == nil:
+		return nil, fmt.Errorf("a profile store is required")
+	case authenticator == nil:
+		return nil, fmt.Errorf("an authenticator is required")
+	}
+
+	timeouts := storage.Timeouts{
+		Read:  cfg.Timeouts.StorageRead.Duration(),
+		Write: cfg.Timeouts.StorageWrite.Duration(),
+	}
+
+	observers := []storage.Observer{tracing.StorageObserver(), metrics.StorageObserver()}
+
+	return &Handler{
+		object: storage.InstrumentObjectStore(storage.ObjectStoreWithTimeouts(backends.Objects, timeouts), "gcs", observers...),
+		entity: storage.InstrumentMetadataStore(storage.MetadataStoreWithTimeouts(backends.Metadata, timeouts), "datastore", observers...),
+		auth: authenticator, psub: backends.Publisher, mcache: storage.InstrumentCache(backends.Cache, cfg.Cache.Backend, observers...),
+		cacheBackend: cfg.Cache.Backend,
+		keys: backends.Keys, profiles: backends.Profiles,
+		publishTimeout: cfg.Timeouts.Publish.Duration(), maxUploadSize: cfg.Upload.MaxSize,
+		s3Secret: cfg.S3.SigningSecret}, nil
 }
 
-func (h *handler) GetFiles(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetFiles(w http.ResponseWriter, r *http.Request) {
 	usr := h.getUserFromRequest(r)
 	if usr == nil {
-		http.Error(w, "Unable to process request", http.StatusInternalServerError)
-		return
-	}
-
-	holder := common.Holder{
-		User: *usr,
-	}
-
-	if rawResp, _ := h.mcache.GetList(holder); rawResp != nil {
-		bytes, _ := rawResp.([]byte)
-		fmt.Fprintf(w, "%s", string(bytes))
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
 		return
 	}
 
-	rawResp, err := h.entity.List(holder)
+	resp, err := h.ListFiles(r.Context(), *usr)
 	if err != nil {
-		http.Error(w, "Unable to process request", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to process request")
 		return
 	}
 
-	if rawResp == nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	resp, _ := rawResp.([]common.Response)
 	bytes, err := json.Marshal(resp)
 	if err != nil {
-		http.Error(w, "Unable to get file info", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to get file info")
 		return
 	}
 
-	holder.Object = bytes
-	h.mcache.InsertList(holder)
-
 	fmt.Fprintf(w, "%s", string(bytes))
 }
 
-func (h *handler) UploadFile(w http.ResponseWriter, r *http.Request) {
-	lenStr := r.Header.Get("Content-Length")
-	var err error
-	var length int64
-	if lenStr != "" {
-		length, err = strconv.ParseInt(lenStr, 10, 64)
-		if err != nil {
-			http.Error(w, "Unable to process file", http.StatusInternalServerError)
-			return
-		}
-
-		if length > 1024 * 1024 * 10 {
-			http.Error(w, "File size exceeded 10 MB", http.StatusBadRequest)
-		}
+func (h *Handler) UploadFile(w http.ResponseWriter, r *http.Request) {
+	h.storeUpload(w, r, false)
+}
 
-	}
-	a, b, err := r.FormFile("file")
-	description := r.FormValue("description")
+func (h *Handler) UpdateFile(w http.ResponseWriter, r *http.Request) {
+	h.storeUpload(w, r, true)
+}
 
-	if err != nil {
-		http.Error(w, "Unable to upload file", http.StatusInternalServerError)
-		log.Printf("Unable to upload file due to error: %v\n", err)
+// storeUpload stores the file uploaded with the request, replacing an
+// existing one when update is set.
+func (h *Handler) storeUpload(w http.ResponseWriter, r *http.Request, update bool) {
+	a, b, length, ok := h.parseUpload(w, r)
+	if !ok {
 		return
 	}
+	defer a.Close()
+	description := r.FormValue("description")
 
 	usr := h.getUserFromRequest(r)
 	if usr == nil {
-		http.Error(w, "Unable to process request", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
 		return
 	}
 
-	reader := r.Body
-	bytes, _ := ioutil.ReadAll(reader)
-	fmt.Println(string(bytes))
-
-
 	contentType := b.Header.Get("Content-Type")
 	holder := common.Holder{
 		File: b.Filename,
 		User: *usr,
-		Object: a,
 		ContentType: contentType,
 		Size: length,
 		Description: description,
 	}
 
-	err = h.psub.Publish(holder)
-	if err != nil {
-		http.Error(w, "Unable to process file", http.StatusInternalServerError)
+	_, err := h.StoreFile(r.Context(), holder, a, update)
+	if err == storage.ErrNotFound {
+		apierror.Write(w, r, http.StatusNotFound, fmt.Sprintf("File %s does not exist", holder.File))
 		return
 	}
-	a.Close()
-
-	err = h.entity.Insert(holder)
 	if err != nil {
-		http.Error(w, "Unable to process file", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to process file")
 		return
 	}
 
-	h.mcache.Delete(holder)
-	h.mcache.DeleteList(holder)
-
 	w.WriteHeader(http.StatusAccepted)
 	fmt.Fprintf(w, "%s uploaded", b.Filename)
 }
 
-func (h *handler) UpdateFile(w http.ResponseWriter, r *http.Request) {
-	lenStr := r.Header.Get("Content-Length")
-	var err error
-	var length int64
-	if lenStr != "" {
-		length, err = strconv.ParseInt(lenStr, 10, 64)
-		if err != nil {
-			http.Error(w, "Unable to process file", http.StatusInternalServerError)
-			return
-		}
-
-		if length > 1024 * 1024 * 10 {
-			http.Error(w, "File size exceeded 10 MB", http.StatusBadRequest)
-		}
-
-	}
-	a, b, err := r.FormFile("file")
-	description := r.FormValue("description")
-
-	if err != nil {
-		http.Error(w, "Unable to upload file", http.StatusInternalServerError)
-		log.Printf("Unable to upload file due to error: %v\n", err)
-		return
-	}
+func (h *Handler) GetFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
 
 	usr := h.getUserFromRequest(r)
 	if usr == nil {
-		http.Error(w, "Unable to process request", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
 		return
 	}
 
-	contentType := b.Header.Get("Content-Type")
-	holder := common.Holder{
-		File: b.Filename,
-		User: *usr,
-		Object: a,
-		ContentType: contentType,
-		Size: length,
-		Description: description,
-	}
-	if  h.entity.Exists(holder) == false {
-		w.WriteHeader(http.StatusNotFound)
+	reader, err := h.OpenFile(r.Context(), *usr, name)
+	if err == storage.ErrNotFound {
+		apierror.Write(w, r, http.StatusNotFound, fmt.Sprintf("File %s does not exist", name))
 		return
 	}
 
-	err = h.psub.Publish(holder)
 	if err != nil {
-		http.Error(w, "Unable to process file", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to get file. Please try again")
 		return
 	}
-	a.Close()
+	defer reader.Close()
 
-	err = h.entity.Update(holder)
+	bytes, err := ioutil.ReadAll(reader)
 	if err != nil {
-		http.Error(w, "Unable to process file", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to get file. Please try again")
 		return
 	}
-	w.WriteHeader(http.StatusAccepted)
-	fmt.Fprintf(w, "%s uploaded", b.Filename)
-
-	h.mcache.Delete(holder)
-	h.mcache.DeleteList(holder)
+	w.Header().Add("Content-Length", fmt.Sprintf("%d", len(bytes)))
+	w.Header().Add("Cache-Control", "s-maxage=3600, public")
+	w.Write(bytes)
 }
 
-func (h *handler) GetFile(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetFileInfo(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
 	usr := h.getUserFromRequest(r)
 	if usr == nil {
-		http.Error(w, "Unable to process request", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
 		return
 	}
 
-	holder := common.Holder{
-		File: name,
-		User: *usr,
-	}
-
-	exists := h.object.Exists(holder)
-	if !exists {
-		w.WriteHeader(http.StatusNotFound)
+	resp, err := h.FileInfo(r.Context(), *usr, name)
+	if err == storage.ErrNotFound {
+		apierror.Write(w, r, http.StatusNotFound, fmt.Sprintf("File %s does not exist", name))
 		return
 	}
 
-	rawReader, err:= h.object.Get(holder)
-
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Unable to get file. Please try again")
-		return
-	}
-
-	if rawReader == nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	reader, ok := rawReader.(io.ReadCloser)
-	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Unable to get file. Please try again")
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to get file info")
 		return
 	}
 
-	bytes, err := ioutil.ReadAll(reader)
+	bytes, err := json.Marshal(resp)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Unable to get file. Please try again")
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to get file info")
 		return
 	}
-	w.Header().Add("Content-Length", fmt.Sprintf("%d", len(bytes)))
-	w.Header().Add("Cache-Control", "s-maxage=3600, public")
-	w.Write(bytes)
-	reader.Close()
+
+	fmt.Fprintf(w, "%s", string(bytes))
 }
 
-func (h *handler) GetFileInfo(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) DeleteFile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
 	usr := h.getUserFromRequest(r)
 	if usr == nil {
-		http.Error(w, "Unable to process request", http.StatusInternalServerError)
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
 		return
 	}
 
-	holder := common.Holder{
-		File: name,
-		User: *usr,
-	}
-
-	if rawResp, _ := h.mcache.Get(holder); rawResp != nil {
-		bytes, _ := rawResp.([]byte)
-		fmt.Fprintf(w, "%s", string(bytes))
+	err := h.RemoveFile(r.Context(), *usr, name)
+	if err == storage.ErrNotFound {
+		apierror.Write(w, r, http.StatusNotFound, fmt.Sprintf("File %s does not exist", name))
 		return
-	}
-
-	rawResp, err := h.entity.Get(holder)
-
-	if rawResp == nil {
-		w.WriteHeader(http.StatusNotFound)
+	} else if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to delete file. Please try again")
 		return
 	}
 
-	resp, _ := rawResp.(common.Response)
-	bytes, err := json.Marshal(resp)
+	w.WriteHeader(http.StatusOK)
+}
 
-	if err != nil {
-		http.Error(w, "Unable to get file info", http.StatusInternalServerError)
-		return
+// RegisterChecks adds a readiness check for every backend the handler uses.
+func (h *Handler) RegisterChecks(checker *health.Checker) {
+	checker.Add("gcs", h.object.Ping)
+	checker.Add("datastore", h.entity.Ping)
+	// Caches held in memory are always available
+	if h.cacheBackend == "memcache" || h.cacheBackend == "tiered" {
+		checker.Add("memcache", h.mcache.Ping)
 	}
-
-	holder.Object = bytes
-	h.mcache.Insert(holder)
-
-	fmt.Fprintf(w, "%s", string(bytes))
+	checker.Add("pubsub", h.psub.Ping)
 }
 
-func (h *handler) DeleteFile(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-
-	usr := h.getUserFromRequest(r)
-	if usr == nil {
-		http.Error(w, "Unable to process request", http.StatusInternalServerError)
-		return
+// parseUpload validates the multipart upload of the request and returns the
+// uploaded file. The error response has been written when false is returned.
+func (h *Handler) parseUpload(w http.ResponseWriter, r *http.Request) (multipart.File, *multipart.FileHeader, int64, bool) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		apierror.Write(w, r, http.StatusUnsupportedMediaType, "Files must be uploaded as multipart/form-data")
+		return nil, nil, 0, false
 	}
 
-	holder := common.Holder{
-		File: name,
-		User: *usr,
-	}
+	lenStr := r.Header.Get("Content-Length")
+	var length int64
+	if lenStr != "" {
+		length, err = strconv.ParseInt(lenStr, 10, 64)
+		if err != nil {
+			apierror.Write(w, r, http.StatusBadRequest, "Invalid Content-Length")
+			return nil, nil, 0, false
+		}
 
-	exists := h.entity.Exists(holder)
-	if !exists {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		if length > h.maxUploadSize {
+			apierror.Write(w, r, http.StatusRequestEntityTooLarge, h.sizeExceeded())
+			return nil, nil, 0, false
+		}
 	}
-	err := h.object.Delete(holder)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Unable to delete file. Please try again")
-		return
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadSize)
+
+	a, b, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		apierror.WriteDetails(w, r, http.StatusUnprocessableEntity, "A file is required", map[string]string{"field": "file"})
+		return nil, nil, 0, false
 	}
 
-	err = h.entity.Delete(holder)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Unable to delete file metadata. Please try again")
-		return
+		logging.From(r.Context()).WarnContext(r.Context(), "Unable to read uploaded file", "error", err)
+		if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+			apierror.Write(w, r, http.StatusRequestEntityTooLarge, h.sizeExceeded())
+		} else {
+			apierror.Write(w, r, http.StatusBadRequest, "Unable to read uploaded file")
+		}
+		return nil, nil, 0, false
 	}
 
-	h.mcache.Delete(holder)
-	h.mcache.DeleteList(holder)
-	w.WriteHeader(http.StatusOK)
+	return a, b, length, true
 }
 
-func (h *handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("ok"))
+func (h *Handler) sizeExceeded() string {
+	if h.maxUploadSize % (1024 * 1024) == 0 {
+		return fmt.Sprintf("File size exceeded %d MB", h.maxUploadSize / (1024 * 1024))
+	}
+	return fmt.Sprintf("File size exceeded %d bytes", h.maxUploadSize)
 }
 
-func (h *handler) getUserFromRequest(r *http.Request) *common.User{
-	token := auth.GetAuthToken(r)
-	return h.users.Get(token)
+func (h *Handler) getUserFromRequest(r *http.Request) *common.User{
+	return h.auth.User(r)
 }
-
-
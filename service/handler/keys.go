@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/apierror"
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/s3"
+	"github.com/vjsamuel/uploadly/service/storage"
+	"golang.org/x/crypto/ssh"
+)
+
+func (h *Handler) GetKeys(w http.ResponseWriter, r *http.Request) {
+	usr := h.getUserFromRequest(r)
+	if usr == nil {
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
+		return
+	}
+
+	holder := common.Holder{
+		User: *usr,
+	}
+
+	resp, err := h.keys.List(r.Context(), holder)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to process request")
+		return
+	}
+
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to get keys")
+		return
+	}
+
+	fmt.Fprintf(w, "%s", string(bytes))
+}
+
+func (h *Handler) CreateKey(w http.ResponseWriter, r *http.Request) {
+	usr := h.getUserFromRequest(r)
+	if usr == nil {
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
+		return
+	}
+
+	if usr.APIKey {
+		apierror.Write(w, r, http.StatusForbidden, "API keys can not be used to manage API keys")
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		apierror.WriteDetails(w, r, http.StatusUnprocessableEntity, "A name is required for the key", map[string]string{"field": "name"})
+		return
+	}
+
+	scopes := []string{}
+	if rawScopes := r.FormValue("scopes"); rawScopes != "" {
+		for _, scope := range strings.Split(rawScopes, ",") {
+			scope = strings.TrimSpace(scope)
+			if !common.ValidScope(scope) {
+				apierror.WriteDetails(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("Unknown scope %s", scope), map[string]string{"field": "scopes"})
+				return
+			}
+			if !usr.HasScope(scope) {
+				apierror.Write(w, r, http.StatusForbidden, fmt.Sprintf("Scope %s can not be granted", scope))
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+	}
+
+	var expiry time.Time
+	if rawExpiry := r.FormValue("expiry"); rawExpiry != "" {
+		var err error
+		expiry, err = time.Parse(time.RFC3339, rawExpiry)
+		if err != nil || expiry.Before(time.Now()) {
+			apierror.WriteDetails(w, r, http.StatusUnprocessableEntity, "Expiry must be a future RFC 3339 timestamp", map[string]string{"field": "expiry"})
+			return
+		}
+	}
+
+	holder := common.Holder{
+		File: name,
+		User: *usr,
+	}
+
+	if _, err := h.keys.Get(r.Context(), holder); err == nil {
+		apierror.Write(w, r, http.StatusConflict, fmt.Sprintf("Key %s already exists", name))
+		return
+	} else if err != storage.ErrNotFound {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to create key")
+		return
+	}
+
+	// SSH public keys are registered like keys, but there is no secret to
+	// return for them
+	var apiKey, hash, fingerprint string
+	if rawPublicKey := r.FormValue("ssh_public_key"); rawPublicKey != "" {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rawPublicKey))
+		if err != nil {
+			apierror.WriteDetails(w, r, http.StatusUnprocessableEntity, "The SSH public key must be in authorized_keys format", map[string]string{"field": "ssh_public_key"})
+			return
+		}
+		hash, fingerprint = auth.HashPublicKey(publicKey), ssh.FingerprintSHA256(publicKey)
+
+		if _, _, err := h.keys.Lookup(r.Context(), hash); err == nil {
+			apierror.Write(w, r, http.StatusConflict, "The SSH public key is already registered")
+			return
+		} else if err != storage.ErrNotFound {
+			apierror.Write(w, r, http.StatusInternalServerError, "Unable to create key")
+			return
+		}
+	} else {
+		var err error
+		apiKey, hash, err = auth.GenerateAPIKey()
+		if err != nil {
+			logging.From(r.Context()).ErrorContext(r.Context(), "Unable to generate key", "error", err)
+			apierror.Write(w, r, http.StatusInternalServerError, "Unable to create key")
+			return
+		}
+	}
+
+	record := common.APIKey{
+		Hash:        hash,
+		Scopes:      scopes,
+		Created:     time.Now(),
+		Expiry:      expiry,
+		Fingerprint: fingerprint,
+	}
+	err := h.keys.Insert(r.Context(), holder, record)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to create key")
+		return
+	}
+
+	resp := common.KeyResponse{
+		Name:        name,
+		Key:         apiKey,
+		Scopes:      scopes,
+		Created:     record.Created,
+		Fingerprint: fingerprint,
+	}
+	if len(scopes) == 0 {
+		resp.Scopes = common.Scopes
+	}
+	if !expiry.IsZero() {
+		resp.Expiry = &expiry
+	}
+	if h.s3Secret != "" && apiKey != "" {
+		credentials := s3.Credentials(h.s3Secret, hash)
+		resp.S3 = &credentials
+	}
+
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to create key")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%s", string(bytes))
+}
+
+func (h *Handler) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	usr := h.getUserFromRequest(r)
+	if usr == nil {
+		apierror.Write(w, r, http.StatusUnauthorized, "Unable to find the authenticated user")
+		return
+	}
+
+	if usr.APIKey {
+		apierror.Write(w, r, http.StatusForbidden, "API keys can not be used to manage API keys")
+		return
+	}
+
+	holder := common.Holder{
+		File: name,
+		User: *usr,
+	}
+
+	if _, err := h.keys.Get(r.Context(), holder); err == storage.ErrNotFound {
+		apierror.Write(w, r, http.StatusNotFound, fmt.Sprintf("Key %s does not exist", name))
+		return
+	} else if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to revoke key. Please try again")
+		return
+	}
+
+	err := h.keys.Delete(r.Context(), holder)
+	if err != nil {
+		apierror.Write(w, r, http.StatusInternalServerError, "Unable to revoke key. Please try again")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
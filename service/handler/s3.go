@@ -0,0 +1,22 @@
+package handler
+
+import (
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/s3"
+)
+
+// S3 serves the S3 compatible API from the stores of the handler. Access keys
+// are validated with users and cached like other credentials.
+func (h *Handler) S3(cfg *config.Config, users s3.Users) *s3.Handler {
+	return s3.NewHandler(s3.Options{
+		Region:        cfg.S3.Region,
+		SigningSecret: cfg.S3.SigningSecret,
+		Objects:       h.object,
+		Metadata:      h.entity,
+		Files:         h,
+		MaxUploadSize: h.maxUploadSize,
+		Users:         users,
+		CacheSize:     cfg.TokenCache.Size,
+		CacheTTL:      cfg.TokenCache.TTL.Duration(),
+	})
+}
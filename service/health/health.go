@@ -0,0 +1,141 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/logging"
+)
+
+const (
+	STATUS_OK   = "ok"
+	STATUS_DOWN = "down"
+)
+
+// Check reports whether a dependency can be used.
+type Check func(context.Context) error
+
+// Checker serves the liveness and readiness probes.
+type Checker struct {
+	timeout time.Duration
+	names   []string
+	checks  map[string]Check
+}
+
+// Result of a single check in the readiness response.
+type Result struct {
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	// Coarse reason the check failed. The full error is only logged
+	Error string `json:"error,omitempty"`
+}
+
+type Response struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// NewChecker returns a checker that gives each check up to timeout to pass. A
+// zero timeout leaves the checks unbounded.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout, checks: map[string]Check{}}
+}
+
+// Add registers a check run on every readiness probe.
+func (c *Checker) Add(name string, check Check) {
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Live reports that the process is serving requests. It does not depend on
+// any backend, so an outage of one does not get the pod restarted.
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	write(w, http.StatusOK, Response{Status: STATUS_OK})
+}
+
+// Ready runs every check concurrently and responds with a 503 when any of them
+// fails, so that traffic is no longer routed to the pod.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	results := c.Run(r.Context())
+
+	resp := Response{Status: STATUS_OK, Checks: results}
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Status != STATUS_OK {
+			resp.Status = STATUS_DOWN
+			status = http.StatusServiceUnavailable
+		}
+	}
+	write(w, status, resp)
+}
+
+// Run runs every check concurrently and returns their results by name.
+func (c *Checker) Run(ctx context.Context) map[string]Result {
+	results := make(map[string]Result, len(c.names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range c.names {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			result := c.run(ctx, name, check)
+
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, c.checks[name])
+	}
+	wg.Wait()
+	return results
+}
+
+func (c *Checker) run(ctx context.Context, name string, check Check) Result {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	// Not every client honours the context, so the check is abandoned rather
+	// than waited on once the deadline passes
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{Status: STATUS_OK, DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		logging.From(ctx).WarnContext(ctx, "Health check failed", "check", name, "error", err)
+		result.Status = STATUS_DOWN
+		result.Error = "unavailable"
+		if ctx.Err() == context.DeadlineExceeded {
+			result.Error = "timeout"
+		}
+	}
+	return result
+}
+
+func write(w http.ResponseWriter, status int, resp Response) {
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
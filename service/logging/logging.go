@@ -0,0 +1,141 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/vjsamuel/uploadly/service/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const REDACTED = "[REDACTED]"
+
+// Attribute keys whose values are never written to the logs
+var sensitive = map[string]bool{
+	"token":         true,
+	"api_key":       true,
+	"authorization": true,
+	"credential":    true,
+	"first_name":    true,
+	"last_name":     true,
+	"email":         true,
+}
+
+// Setup installs the default slog logger writing to stderr with the configured
+// level and format. Standard library log calls are routed through it as well.
+func Setup(cfg config.LoggingConfig) error {
+	handler, err := newHandler(os.Stderr, cfg)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Wrap returns a logger writing to the handler of logger with sensitive values
+// redacted and the request and trace IDs added, as done for the default logger.
+func Wrap(logger *slog.Logger) *slog.Logger {
+	if _, ok := logger.Handler().(contextHandler); ok {
+		return logger
+	}
+	return slog.New(contextHandler{logger.Handler()})
+}
+
+// From returns the logger of the request ctx belongs to, or the default logger.
+func From(ctx context.Context) *slog.Logger {
+	if e, ok := ctx.Value(contextKey{}).(*entry); ok && e.logger != nil {
+		return e.logger
+	}
+	return slog.Default()
+}
+
+func newHandler(w io.Writer, cfg config.LoggingConfig) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %v", cfg.Level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		return contextHandler{slog.NewJSONHandler(w, opts)}, nil
+	case "text":
+		return contextHandler{slog.NewTextHandler(w, opts)}, nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", cfg.Format)
+}
+
+// Fatal logs the message at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// redact replaces the values of sensitive attributes, and of string values
+// that look like credentials, before they are written.
+func redact(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if sensitive[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, REDACTED)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if looksLikeCredential(a.Value.String()) {
+			return slog.String(a.Key, REDACTED)
+		}
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, attr := range group {
+			redacted[i] = redact(attr)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+	return a
+}
+
+// looksLikeCredential matches API keys and the JWTs passed as tokens.
+func looksLikeCredential(value string) bool {
+	return strings.HasPrefix(value, "upl_") ||
+		(strings.HasPrefix(value, "eyJ") && strings.Count(value, ".") == 2)
+}
+
+// contextHandler redacts every record and adds the request ID and trace ID
+// carried by the context to it. Redacting here rather than in ReplaceAttr
+// applies it to handlers passed in by embedders too.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redact(a))
+		return true
+	})
+
+	if id := RequestID(ctx); id != "" {
+		redacted.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		redacted.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = redact(attr)
+	}
+	return contextHandler{h.Handler.WithAttrs(redacted)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
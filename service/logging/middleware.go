@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vjsamuel/uploadly/service/apierror"
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// Longest request ID accepted from clients. Longer or malformed IDs are
+// replaced with a generated one.
+const MAX_REQUEST_ID = 64
+
+type contextKey struct{}
+
+// entry holds what is known about a request for its access log line. The user
+// is filled in once the request has been authenticated.
+type entry struct {
+	requestID string
+	user      *common.User
+	logger    *slog.Logger
+}
+
+// RequestID returns the ID assigned to the request ctx belongs to.
+func RequestID(ctx context.Context) string {
+	if e, ok := ctx.Value(contextKey{}).(*entry); ok {
+		return e.requestID
+	}
+	return ""
+}
+
+// SetUser records the authenticated user of the request ctx belongs to.
+func SetUser(ctx context.Context, usr common.User) {
+	if e, ok := ctx.Value(contextKey{}).(*entry); ok {
+		e.user = &usr
+	}
+}
+
+// Middleware assigns every request an ID, echoed in the X-Request-ID response
+// header, and writes an access log line once the request has been served.
+// Everything logged while serving the request goes to the logger, or to the
+// default logger when it is nil.
+func Middleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	if logger != nil {
+		logger = Wrap(logger)
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			e := &entry{requestID: requestID(r), logger: logger}
+			w.Header().Set(apierror.REQUEST_ID, e.requestID)
+			ctx := context.WithValue(r.Context(), contextKey{}, e)
+
+			sw := common.NewStatusWriter(w)
+			next.ServeHTTP(sw, r.WithContext(ctx))
+
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil {
+				if tmpl, err := current.GetPathTemplate(); err == nil {
+					route = tmpl
+				}
+			}
+
+			attrs := []any{
+				"method", r.Method,
+				"route", route,
+				"status", sw.Status,
+				"bytes_in", r.ContentLength,
+				"bytes_out", sw.Bytes,
+				"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if e.user != nil {
+				attrs = append(attrs, "user", *e.user)
+			}
+
+			level := slog.LevelInfo
+			if sw.Status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			From(ctx).Log(ctx, level, "Served request", attrs...)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// requestID returns the ID passed by the client if it is usable, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(apierror.REQUEST_ID); validRequestID(id) {
+		return id
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -1,39 +1,164 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log/slog"
+	"net"
 	"net/http"
-	"time"
+	"os"
 
-	"github.com/gorilla/mux"
-	"github.com/vjsamuel/uploadly/service/handler"
-	"github.com/vjsamuel/uploadly/service/cache"
-	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"github.com/vjsamuel/uploadly/service/server"
+	"github.com/vjsamuel/uploadly/service/sftp"
+	"github.com/vjsamuel/uploadly/service/tracing"
+	"github.com/vjsamuel/uploadly/service/uploadly"
+	"google.golang.org/grpc"
 )
 
-var users = cache.NewEvictableMap(100, time.Minute)
-
 func main() {
-	h := handler.NewHandler(users)
-	a := auth.NewAuthHandler(users)
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+
+	if cfg.PrintConfig {
+		if err := cfg.Write(os.Stdout); err != nil {
+			logging.Fatal("Unable to print configuration", "error", err)
+		}
+		return
+	}
+
+	if err := logging.Setup(cfg.Logging); err != nil {
+		logging.Fatal("Unable to set up logging", "error", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Unable to set up tracing", "error", err)
+	}
+
+	srv, err := uploadly.NewServer(uploadly.Options{Config: cfg})
+	if err != nil {
+		logging.Fatal("Unable to create service", "error", err)
+	}
+
+	r := srv.Router()
+	// The webapp and metrics are served next to the API with the same middleware
+	web := r.NewRoute().Subrouter()
+	web.Use(tracing.Middleware, logging.Middleware(nil), metrics.Middleware)
+	if cfg.MetricsPath != "" {
+		web.Methods("GET").Path(cfg.MetricsPath).Handler(metrics.Handler())
+	}
+
+	limits := srv.Limits()
+	fs := http.FileServer(http.Dir(cfg.WebappDir))
+	web.Methods("GET").PathPrefix("/").Handler(limits.Middleware(ratelimit.ANONYMOUS, limits.ClientIP)(fs))
 
-	r := mux.NewRouter()
+	httpServer, err := server.NewServer(cfg.ListenAddr, cfg.Server, r)
+	if err != nil {
+		logging.Fatal("Unable to create server", "error", err)
+	}
 
-	v1 := r.PathPrefix("/api/v1").Subrouter()
-	v1.Path("/files").Handler(a.AuthenticatedHandler(cache.NoCacheHandler(h.GetFiles))).Methods("GET")
-	v1.Path("/files").Handler(a.AuthenticatedHandler(h.UploadFile)).Methods("POST")
-	v1.Path("/files").Handler(a.AuthenticatedHandler(h.UpdateFile)).Methods("PUT")
+	// The S3 compatible API is served on a listener of its own, and drains on
+	// the same signal as the main one
+	var s3Done chan error
+	if cfg.S3.ListenAddr != "" {
+		s3Router, err := srv.S3Router()
+		if err != nil {
+			logging.Fatal("Unable to create S3 API", "error", err)
+		}
+		s3Server, err := server.NewServer(cfg.S3.ListenAddr, cfg.Server, s3Router)
+		if err != nil {
+			logging.Fatal("Unable to create S3 server", "error", err)
+		}
+		s3Done = make(chan error, 1)
+		go func() {
+			err := s3Server.Run()
+			if err != nil && err != http.ErrServerClosed {
+				logging.Fatal("S3 server stopped", "error", err)
+			}
+			s3Done <- err
+		}()
+	}
 
-	file := v1.PathPrefix("/file").Subrouter()
-	file.Path("/{name}").Handler(a.AuthenticatedHandler(h.GetFile)).Methods("GET")
-	file.Path("/{name}").Handler(a.AuthenticatedHandler(h.DeleteFile)).Methods("DELETE")
+	var sftpServer *sftp.Server
+	if cfg.SFTP.ListenAddr != "" {
+		sftpServer, err = srv.SFTPServer()
+		if err != nil {
+			logging.Fatal("Unable to create SFTP server", "error", err)
+		}
+		go func() {
+			err := sftpServer.ListenAndServe(cfg.SFTP.ListenAddr)
+			if err != nil && err != sftp.ErrServerClosed {
+				logging.Fatal("SFTP server stopped", "error", err)
+			}
+		}()
+	}
 
-	pages := v1.PathPrefix("/file/{name}").Subrouter()
-	pages.Path("/info").Handler(a.AuthenticatedHandler(cache.NoCacheHandler(h.GetFileInfo))).Methods("GET")
+	var grpcServer *grpc.Server
+	if cfg.GRPC.ListenAddr != "" {
+		grpcServer, err = srv.GRPCServer()
+		if err != nil {
+			logging.Fatal("Unable to create gRPC server", "error", err)
+		}
+		l, err := net.Listen("tcp", cfg.GRPC.ListenAddr)
+		if err != nil {
+			logging.Fatal("Unable to listen for gRPC", "error", err)
+		}
+		slog.Info("Listening", "addr", cfg.GRPC.ListenAddr, "protocol", "grpc")
+		go func() {
+			if err := grpcServer.Serve(l); err != nil {
+				logging.Fatal("gRPC server stopped", "error", err)
+			}
+		}()
+	}
 
-	r.Methods("GET").Path("/_ah/health").Handler(cache.NoCacheHandler(h.HealthCheck))
+	err = httpServer.Run()
+	if s3Done != nil && err == nil {
+		<-s3Done
+	}
+	// SFTP transfers and gRPC calls are given the same time to finish as HTTP
+	// requests
+	ctx := context.Background()
+	if timeout := cfg.Server.ShutdownTimeout.Duration(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if sftpServer != nil {
+		if err := sftpServer.Shutdown(ctx); err != nil {
+			slog.Error("Unable to drain SFTP connections", "error", err)
+		}
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			slog.Error("Unable to drain gRPC calls", "error", ctx.Err())
+			grpcServer.Stop()
+		}
+	}
 
-	fs := http.FileServer(http.Dir("../webapp"))
-	r.Methods("GET").PathPrefix("/").Handler(fs)
+	if err := srv.Close(); err != nil {
+		slog.Error("Unable to close backends", "error", err)
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Unable to flush spans", "error", err)
+	}
 
-	http.ListenAndServe(":8080", r)
+	if err != nil && err != http.ErrServerClosed {
+		logging.Fatal("Server stopped", "error", err)
+	}
 }
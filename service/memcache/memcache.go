@@ -1,124 +1,263 @@
 package memcache
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/storage"
 	"github.com/bradfitz/gomemcache/memcache"
-	"log"
+	"github.com/vjsamuel/uploadly/service/logging"
 )
 
+// Key looked up by Ping. It is never set
+const PING_KEY = "uploadly:ping"
+
+// Prefix of every key written, so that the service can share memcached
+const NAMESPACE = "uploadly:"
+
+// Longest key memcached accepts
+const MAX_KEY_LENGTH = 250
+
+// Bytes memcached stores next to the key and value of an item
+const ITEM_OVERHEAD = 64
+
 type Memcache struct {
 	client    *memcache.Client
+	fileTTL   time.Duration
+	listTTL   time.Duration
+	maxItemSize int
 }
 
-func NewMemcacheStorage(host, port string) *Memcache {
-	client := memcache.New(fmt.Sprintf("%s:%s", host, port))
+func NewMemcacheStorage(cfg config.MemcacheConfig) *Memcache {
+	client := memcache.New(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port))
 
-	return &Memcache{client: client}
+	return &Memcache{client: client, fileTTL: cfg.FileTTL.Duration(), listTTL: cfg.ListTTL.Duration(), maxItemSize: cfg.MaxItemSize}
 }
 
-func (m *Memcache) Get(holder common.Holder) (interface{}, error) {
-	key := m.getRecordKey(holder)
-	item, err := m.client.Get(key)
+func (m *Memcache) Get(ctx context.Context, holder common.Holder) ([]byte, error) {
+	return m.get(ctx, m.getRecordKey(holder))
+}
 
-	if err != nil {
-		log.Printf("Unable to get memcache key %s due to error %v\n", key, err)
-		return nil, err
+func (m *Memcache) Set(ctx context.Context, holder common.Holder, value []byte) error {
+	return m.set(ctx, m.getRecordKey(holder), value, m.fileTTL)
+}
+
+// Delete removes the info of the file and increments its version.
+func (m *Memcache) Delete(ctx context.Context, holder common.Holder) error {
+	err := m.delete(ctx, m.getRecordKey(holder))
+	if incrErr := m.increment(ctx, m.getFileVersionKey(holder)); err == nil {
+		err = incrErr
 	}
+	return err
+}
 
-	return item.Value, nil
+func (m *Memcache) FileVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	return m.version(ctx, m.getFileVersionKey(holder), m.fileTTL)
 }
 
-func (m *Memcache) Insert(holder common.Holder) error {
-	bytes, ok := holder.Object.([]byte)
-	if !ok {
-		return fmt.Errorf("Unable to convert interface to []byte\n")
-	}
-	key := m.getRecordKey(holder)
-	item := &memcache.Item{
-		Key: key,
-		Value: bytes,
+func (m *Memcache) ListVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	return m.version(ctx, m.getVersionKey(holder), m.listTTL)
+}
+
+// version returns the version stored under the key. A version that is
+// missing, because it expired or was evicted, starts again from a random
+// value, so that it is unlikely to run into the versions responses were
+// cached under before, whatever the clocks of the replicas.
+func (m *Memcache) version(ctx context.Context, key string, ttl time.Duration) (uint64, error) {
+	item, err := m.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		version := startVersion()
+		err = m.client.Add(&memcache.Item{Key: key, Value: []byte(strconv.FormatUint(version, 10)), Expiration: expiration(ttl)})
+		if err == nil {
+			return version, nil
+		}
+		if err == memcache.ErrNotStored {
+			// Another request started the version first
+			item, err = m.client.Get(key)
+		}
 	}
-	err := m.client.Set(item)
+
 	if err != nil {
-		log.Printf("Unable to update memcache key %s due to error %v\n", key, err)
+		logging.From(ctx).WarnContext(ctx, "Unable to get memcache key", "key", key, "error", err)
+		return 0, err
 	}
-	return err
+	return strconv.ParseUint(strings.TrimSpace(string(item.Value)), 10, 64)
 }
 
-func (m *Memcache) Update(holder common.Holder) error {
-	bytes, ok := holder.Object.([]byte)
-	if !ok {
-		return fmt.Errorf("Unable to convert interface to []byte")
-	}
-	key := m.getRecordKey(holder)
-	item := &memcache.Item{
-		Key:   key,
-		Value: bytes,
+func (m *Memcache) GetList(ctx context.Context, holder common.Holder, version uint64) ([]byte, error) {
+	return m.get(ctx, m.getListKey(holder, version))
+}
+
+func (m *Memcache) SetList(ctx context.Context, holder common.Holder, version uint64, value []byte) error {
+	return m.set(ctx, m.getListKey(holder, version), value, m.listTTL)
+}
+
+// DeleteList increments the version of the listing. Listings cached under
+// earlier versions are left to expire.
+func (m *Memcache) DeleteList(ctx context.Context, holder common.Holder) error {
+	return m.increment(ctx, m.getVersionKey(holder))
+}
+
+// increment moves the version stored under the key to the next one. When
+// there is no version, the next one is started by version.
+func (m *Memcache) increment(ctx context.Context, key string) error {
+	_, err := m.client.Increment(key, 1)
+	if err == memcache.ErrCacheMiss {
+		return nil
 	}
-	err := m.client.Replace(item)
+
 	if err != nil {
-		log.Printf("Unable to update memcache key %s due to error %v\n", key, err)
+		logging.From(ctx).WarnContext(ctx, "Unable to increment memcache key", "key", key, "error", err)
 	}
 	return err
 }
 
-func (m *Memcache) Delete(holder common.Holder) error {
-	key := m.getRecordKey(holder)
-	err := m.client.Delete(key)
-	if err != nil {
-		log.Printf("Unable to delete memcache key %s due to error %v\n", key, err)
+// Ping looks up a key that is never set, as a miss still proves the server
+// answered.
+func (m *Memcache) Ping(ctx context.Context) error {
+	_, err := m.client.Get(PING_KEY)
+	if err == memcache.ErrCacheMiss {
+		return nil
 	}
 	return err
 }
 
-func (m *Memcache) Exists(holder common.Holder) bool {
-	b, err := m.Get(holder)
-	if err != nil || b == nil {
-		return false
+// Incr adds one to the counter stored under key and returns its new value. A
+// missing counter is created to expire after ttl.
+func (m *Memcache) Incr(ctx context.Context, key string, ttl time.Duration) (uint64, error) {
+	key = safeKey(NAMESPACE + key)
+	count, err := m.client.Increment(key, 1)
+	if err != memcache.ErrCacheMiss {
+		return count, err
 	}
 
-	return true
+	err = m.client.Add(&memcache.Item{Key: key, Value: []byte("1"), Expiration: expiration(ttl)})
+	if err == memcache.ErrNotStored {
+		// Another replica created the counter first
+		return m.client.Increment(key, 1)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
 }
 
-func (m *Memcache) GetList(holder common.Holder) (interface{}, error) {
-	item, err := m.client.Get(holder.GetProfileID())
+// Count returns the value of the counter stored under key, or zero if there
+// is none.
+func (m *Memcache) Count(ctx context.Context, key string) (uint64, error) {
+	item, err := m.client.Get(safeKey(NAMESPACE + key))
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(item.Value)), 10, 64)
+}
+
+func (m *Memcache) get(ctx context.Context, key string) ([]byte, error) {
+	item, err := m.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, storage.ErrNotFound
+	}
 
 	if err != nil {
-		log.Printf("Unable to get memcache key %s due to error %v\n", holder.GetProfileID(), err)
+		logging.From(ctx).WarnContext(ctx, "Unable to get memcache key", "key", key, "error", err)
 		return nil, err
 	}
 
 	return item.Value, nil
 }
 
-func (m *Memcache) InsertList(holder common.Holder) error {
-	bytes, ok := holder.Object.([]byte)
-	if !ok {
-		return fmt.Errorf("Unable to convert interface to []byte\n")
+// set stores the value for the ttl. Values too large for memcached are not
+// stored, and the previous value of the key is removed instead so that it is
+// not served in their place.
+func (m *Memcache) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if len(key)+len(value)+ITEM_OVERHEAD > m.maxItemSize {
+		logging.From(ctx).DebugContext(ctx, "Not caching value larger than memcache items", "key", key, "bytes", len(value))
+		return m.delete(ctx, key)
 	}
 
 	item := &memcache.Item{
-		Key:   holder.GetProfileID(),
-		Value: bytes,
+		Key:        key,
+		Value:      value,
+		Expiration: expiration(ttl),
 	}
 
 	err := m.client.Set(item)
 	if err != nil {
-		log.Printf("Unable to insert memcache key %s due to error %v\n", holder.GetProfileID(), err)
+		logging.From(ctx).WarnContext(ctx, "Unable to update memcache key", "key", key, "error", err)
 	}
 	return err
 }
 
-func (m *Memcache) DeleteList(holder common.Holder) error {
-	err := m.client.Delete(holder.GetProfileID())
+func (m *Memcache) delete(ctx context.Context, key string) error {
+	err := m.client.Delete(key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+
 	if err != nil {
-		log.Printf("Unable to delete memcache key %s due to error %v\n", holder.GetProfileID(), err)
+		logging.From(ctx).WarnContext(ctx, "Unable to delete memcache key", "key", key, "error", err)
 	}
 	return err
 }
 
 func (m *Memcache) getRecordKey(holder common.Holder) string {
-	return fmt.Sprintf("%s:%s", holder.GetProfileID(), holder.File)
+	return safeKey(fmt.Sprintf("%sfile:%s:%s", NAMESPACE, holder.GetProfileID(), holder.File))
+}
+
+func (m *Memcache) getListKey(holder common.Holder, version uint64) string {
+	return safeKey(fmt.Sprintf("%slist:%s:%d", NAMESPACE, holder.GetProfileID(), version))
+}
+
+func (m *Memcache) getVersionKey(holder common.Holder) string {
+	return safeKey(fmt.Sprintf("%slistversion:%s", NAMESPACE, holder.GetProfileID()))
+}
+
+func (m *Memcache) getFileVersionKey(holder common.Holder) string {
+	return safeKey(fmt.Sprintf("%sfileversion:%s:%s", NAMESPACE, holder.GetProfileID(), holder.File))
+}
+
+// startVersion returns a random version, leaving room for it to be
+// incremented without wrapping around.
+func startVersion() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:]) >> 1
+}
+
+// safeKey returns the key as is when memcached accepts it. Keys that are too
+// long or hold spaces or control characters are replaced by their hash, under
+// the namespace.
+func safeKey(key string) string {
+	valid := len(key) <= MAX_KEY_LENGTH
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid {
+		return key
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return NAMESPACE + "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// expiration converts the ttl to whole seconds, rounding up so a short ttl
+// does not become no expiry at all.
+func expiration(ttl time.Duration) int32 {
+	seconds := int32((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
 }
@@ -0,0 +1,262 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/memcache/memcachetest"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+var holder = common.Holder{File: "notes.txt", User: common.User{Profile: "profile"}}
+
+func newMemcache(t *testing.T, configure func(*config.MemcacheConfig)) (*Memcache, *memcachetest.Server) {
+	t.Helper()
+
+	server, err := memcachetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	cfg := server.Config()
+	if configure != nil {
+		configure(&cfg)
+	}
+	return NewMemcacheStorage(cfg), server
+}
+
+func TestSafeKey(t *testing.T) {
+	long := NAMESPACE + strings.Repeat("a", MAX_KEY_LENGTH)
+	tests := []struct {
+		name   string
+		key    string
+		hashed bool
+	}{
+		{"plain", NAMESPACE + "file:profile:notes.txt", false},
+		{"longest", long[:MAX_KEY_LENGTH], false},
+		{"too long", long, true},
+		{"space", NAMESPACE + "file:profile:my notes.txt", true},
+		{"newline", NAMESPACE + "file:profile:notes\n.txt", true},
+		{"delete", NAMESPACE + "file:profile:notes\x7f.txt", true},
+		{"unicode", NAMESPACE + "file:profile:nötes.txt", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := safeKey(test.key)
+			if !test.hashed {
+				if key != test.key {
+					t.Errorf("expected the key to be kept, got %q", key)
+				}
+				return
+			}
+			if !strings.HasPrefix(key, NAMESPACE+"sha256:") || len(key) > MAX_KEY_LENGTH {
+				t.Errorf("expected a namespaced hash, got %q", key)
+			}
+			if key == safeKey(test.key+"x") {
+				t.Error("expected different keys to hash differently")
+			}
+		})
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want int32
+	}{
+		{0, 1},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+		{24 * time.Hour, 86400},
+	}
+	for _, test := range tests {
+		if got := expiration(test.ttl); got != test.want {
+			t.Errorf("expiration(%v) = %d, expected %d", test.ttl, got, test.want)
+		}
+	}
+}
+
+func TestItemsExpireAfterTheirTTL(t *testing.T) {
+	m, server := newMemcache(t, func(cfg *config.MemcacheConfig) {
+		cfg.FileTTL = config.Duration(time.Minute)
+		cfg.ListTTL = config.Duration(10 * time.Second)
+	})
+	ctx := context.Background()
+
+	if err := m.Set(ctx, holder, []byte("info")); err != nil {
+		t.Fatal(err)
+	}
+	version, err := m.ListVersion(ctx, holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetList(ctx, holder, version, []byte("list")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int32{
+		m.getRecordKey(holder):        60,
+		m.getVersionKey(holder):       10,
+		m.getListKey(holder, version): 10,
+	}
+	for key, want := range expected {
+		item, ok := server.Item(key)
+		if !ok {
+			t.Errorf("%s was not stored", key)
+		} else if item.Expiration != want {
+			t.Errorf("%s expires after %ds, expected %ds", key, item.Expiration, want)
+		}
+	}
+	for _, key := range server.Keys() {
+		if !strings.HasPrefix(key, NAMESPACE) {
+			t.Errorf("%s is not namespaced", key)
+		}
+	}
+}
+
+func TestUnsafeFileNames(t *testing.T) {
+	m, _ := newMemcache(t, nil)
+	ctx := context.Background()
+
+	names := []string{"my notes.txt", strings.Repeat("n", 300) + ".txt", "tab\tseparated.txt"}
+	for _, name := range names {
+		h := common.Holder{File: name, User: holder.User}
+		if err := m.Set(ctx, h, []byte(name)); err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+	}
+	for _, name := range names {
+		value, err := m.Get(ctx, common.Holder{File: name, User: holder.User})
+		if err != nil || string(value) != name {
+			t.Errorf("%q: got %q, %v", name, value, err)
+		}
+	}
+}
+
+func TestOversizedValuesAreNotCached(t *testing.T) {
+	m, _ := newMemcache(t, func(cfg *config.MemcacheConfig) {
+		cfg.MaxItemSize = 1024
+	})
+	ctx := context.Background()
+
+	if err := m.Set(ctx, holder, []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set(ctx, holder, bytes.Repeat([]byte("x"), 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := m.Get(ctx, holder); err != storage.ErrNotFound {
+		t.Errorf("expected the previous value to be removed, got %q, %v", value, err)
+	}
+}
+
+func TestListVersion(t *testing.T) {
+	m, server := newMemcache(t, nil)
+	ctx := context.Background()
+
+	first, err := m.ListVersion(ctx, holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := m.ListVersion(ctx, holder); err != nil || again != first {
+		t.Errorf("expected the version to be kept, got %d, %v", again, err)
+	}
+	if err := m.DeleteList(ctx, holder); err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.ListVersion(ctx, holder)
+	if err != nil || second != first+1 {
+		t.Errorf("expected version %d after a change, got %d, %v", first+1, second, err)
+	}
+
+	// A version that was evicted starts again elsewhere
+	server.Delete(m.getVersionKey(holder))
+	restarted, err := m.ListVersion(ctx, holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted == first || restarted == second {
+		t.Errorf("expected the version to restart away from %d and %d", first, second)
+	}
+}
+
+func TestDeleteListWithoutVersion(t *testing.T) {
+	m, server := newMemcache(t, nil)
+
+	if err := m.DeleteList(context.Background(), holder); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Item(m.getVersionKey(holder)); ok {
+		t.Error("expected no version to be created")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	m, server := newMemcache(t, nil)
+	ctx := context.Background()
+
+	if count, err := m.Count(ctx, "limit:profile"); err != nil || count != 0 {
+		t.Errorf("expected no count, got %d, %v", count, err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		count, err := m.Incr(ctx, "limit:profile", time.Minute)
+		if err != nil || count != i {
+			t.Errorf("expected count %d, got %d, %v", i, count, err)
+		}
+	}
+	if count, err := m.Count(ctx, "limit:profile"); err != nil || count != 3 {
+		t.Errorf("expected count 3, got %d, %v", count, err)
+	}
+	if item, ok := server.Item(NAMESPACE + "limit:profile"); !ok || item.Expiration != 60 {
+		t.Errorf("expected the counter to expire after a minute, got %+v", item)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	m, server := newMemcache(t, nil)
+	server.Close()
+	ctx := context.Background()
+
+	if _, err := m.Get(ctx, holder); err == nil || err == storage.ErrNotFound {
+		t.Errorf("expected an error, got %v", err)
+	}
+	if _, err := m.ListVersion(ctx, holder); err == nil {
+		t.Error("expected the version to be unavailable")
+	}
+	if err := m.Ping(ctx); err == nil {
+		t.Error("expected the ping to fail")
+	}
+}
+
+func TestDeleteMovesFileVersion(t *testing.T) {
+	m, server := newMemcache(t, nil)
+	ctx := context.Background()
+
+	version, err := m.FileVersion(ctx, holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set(ctx, holder, []byte("info")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ctx, holder); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Item(m.getRecordKey(holder)); ok {
+		t.Error("expected the info to be removed")
+	}
+	if next, err := m.FileVersion(ctx, holder); err != nil || next != version+1 {
+		t.Errorf("expected version %d after the delete, got %d, %v", version+1, next, err)
+	}
+	if item, ok := server.Item(m.getFileVersionKey(holder)); !ok || item.Expiration != expiration(m.fileTTL) {
+		t.Errorf("expected the version to expire with the info, got %+v", item)
+	}
+}
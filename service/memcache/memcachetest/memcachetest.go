@@ -0,0 +1,219 @@
+// Package memcachetest provides an in-memory server speaking the memcached
+// text protocol, for testing memcache clients without memcached.
+package memcachetest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vjsamuel/uploadly/service/config"
+)
+
+// Item is a value stored by the server. Items never expire; their expiration
+// is only recorded.
+type Item struct {
+	Value      []byte
+	Flags      uint32
+	Expiration int32
+}
+
+// Server answers the commands of memcached clients from memory.
+type Server struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	items map[string]Item
+	cas   uint64
+	conns map[net.Conn]bool
+}
+
+// NewServer starts a server on a local port.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener, items: map[string]Item{}, conns: map[net.Conn]bool{}}
+	go s.serve()
+	return s, nil
+}
+
+// Config returns the memcache configuration of the defaults, pointed at the
+// server.
+func (s *Server) Config() config.MemcacheConfig {
+	cfg := config.Default().Memcache
+	cfg.Host, cfg.Port, _ = net.SplitHostPort(s.listener.Addr().String())
+	return cfg
+}
+
+// Item returns the item stored under the key.
+func (s *Server) Item(key string) (Item, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	return item, ok
+}
+
+// Keys returns the keys of all items stored.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.items))
+	for key := range s.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Delete removes the item stored under the key, as if it was evicted.
+func (s *Server) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+}
+
+// Close stops the server and closes the connections of its clients, so that
+// their later commands fail.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := s.command(rw, fields); err != nil {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) command(rw *bufio.ReadWriter, fields []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch cmd, args := fields[0], fields[1:]; cmd {
+	case "get", "gets":
+		for _, key := range args {
+			if item, ok := s.items[key]; ok {
+				fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n%s\r\n", key, item.Flags, len(item.Value), s.cas, item.Value)
+			}
+		}
+		rw.WriteString("END\r\n")
+
+	case "set", "add", "replace":
+		if len(args) < 4 {
+			rw.WriteString("ERROR\r\n")
+			return nil
+		}
+		flags, _ := strconv.ParseUint(args[1], 10, 32)
+		expiration, _ := strconv.ParseInt(args[2], 10, 32)
+		size, err := strconv.Atoi(args[3])
+		if err != nil {
+			rw.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return nil
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, value); err != nil {
+			return err
+		}
+		_, exists := s.items[args[0]]
+		if (cmd == "add" && exists) || (cmd == "replace" && !exists) {
+			rw.WriteString("NOT_STORED\r\n")
+			return nil
+		}
+		s.cas++
+		s.items[args[0]] = Item{Value: value[:size], Flags: uint32(flags), Expiration: int32(expiration)}
+		rw.WriteString("STORED\r\n")
+
+	case "delete":
+		if _, ok := s.items[args[0]]; !ok {
+			rw.WriteString("NOT_FOUND\r\n")
+			return nil
+		}
+		delete(s.items, args[0])
+		rw.WriteString("DELETED\r\n")
+
+	case "incr", "decr":
+		item, ok := s.items[args[0]]
+		if !ok {
+			rw.WriteString("NOT_FOUND\r\n")
+			return nil
+		}
+		value, err := strconv.ParseUint(string(item.Value), 10, 64)
+		delta, _ := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			rw.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+			return nil
+		}
+		if cmd == "incr" {
+			value += delta
+		} else if delta > value {
+			value = 0
+		} else {
+			value -= delta
+		}
+		item.Value = []byte(strconv.FormatUint(value, 10))
+		s.items[args[0]] = item
+		fmt.Fprintf(rw, "%d\r\n", value)
+
+	case "touch":
+		item, ok := s.items[args[0]]
+		if !ok {
+			rw.WriteString("NOT_FOUND\r\n")
+			return nil
+		}
+		expiration, _ := strconv.ParseInt(args[1], 10, 32)
+		item.Expiration = int32(expiration)
+		s.items[args[0]] = item
+		rw.WriteString("TOUCHED\r\n")
+
+	case "version":
+		rw.WriteString("VERSION memcachetest\r\n")
+
+	default:
+		rw.WriteString("ERROR\r\n")
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+const namespace = "uploadly"
+
+var (
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of storage operations by backend and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "operation_errors_total",
+		Help:      "Failed storage operations by backend and operation. Missing entries are not counted.",
+	}, []string{"backend", "operation"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Cache lookups by cache, operation and result (hit, miss or error).",
+	}, []string{"cache", "operation", "result"})
+
+	publishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "pubsub",
+		Name:      "publish_duration_seconds",
+		Help:      "Latency of Pub/Sub publishes by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	transferBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transfer_bytes_total",
+		Help:      "Bytes of files uploaded and downloaded by direction and user tier.",
+	}, []string{"direction", "tier"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected for exceeding a rate limit by limit.",
+	}, []string{"limit"})
+)
+
+const (
+	UPLOAD   = "upload"
+	DOWNLOAD = "download"
+)
+
+func init() {
+	prometheus.MustRegister(httpDuration, storageDuration, storageErrors, cacheRequests, publishDuration, transferBytes, rateLimited)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the latency of every request routed by the router it is
+// used on, labelled with the route template rather than the raw path.
+func Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := common.NewStatusWriter(w)
+		next.ServeHTTP(sw, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		httpDuration.WithLabelValues(route, r.Method, strconv.Itoa(sw.Status)).Observe(time.Since(start).Seconds())
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// ObservePublish records a Pub/Sub publish that started at start.
+func ObservePublish(start time.Time, err error) {
+	publishDuration.WithLabelValues(result(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveTokenCache records a lookup of a credential in the token cache.
+func ObserveTokenCache(hit bool) {
+	if hit {
+		cacheRequests.WithLabelValues("token", "get", "hit").Inc()
+	} else {
+		cacheRequests.WithLabelValues("token", "get", "miss").Inc()
+	}
+}
+
+// ObserveTransfer records bytes of a file moved in the given direction for the
+// user.
+func ObserveTransfer(direction string, usr common.User, bytes int64) {
+	transferBytes.WithLabelValues(direction, Tier(usr)).Add(float64(bytes))
+}
+
+// ObserveRateLimited records a request rejected by the named rate limit.
+func ObserveRateLimited(limit string) {
+	rateLimited.WithLabelValues(limit).Inc()
+}
+
+// Tier groups users for metrics without exposing their profile IDs.
+func Tier(usr common.User) string {
+	switch {
+	case usr.HasScope(common.SCOPE_ADMIN):
+		return "admin"
+	case usr.APIKey:
+		return "api_key"
+	default:
+		return "user"
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
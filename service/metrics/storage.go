@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+type storageObserver struct{}
+
+// StorageObserver records the latency and errors of storage operations, and
+// the hits and misses of cache lookups.
+func StorageObserver() storage.Observer {
+	return storageObserver{}
+}
+
+func (storageObserver) Observe(ctx context.Context, op storage.Operation) (context.Context, func(error)) {
+	start := time.Now()
+	return ctx, func(err error) {
+		storageDuration.WithLabelValues(op.Backend, op.Name).Observe(time.Since(start).Seconds())
+		if op.Lookup {
+			cacheRequests.WithLabelValues(op.Backend, op.Name, lookupResult(err)).Inc()
+		}
+
+		if err != nil && err != storage.ErrNotFound {
+			storageErrors.WithLabelValues(op.Backend, op.Name).Inc()
+		}
+	}
+}
+
+func lookupResult(err error) string {
+	switch err {
+	case nil:
+		return "hit"
+	case storage.ErrNotFound:
+		return "miss"
+	default:
+		return "error"
+	}
+}
@@ -0,0 +1,125 @@
+// Package openapi serves the OpenAPI document of the /api/v1 routes, and a
+// page rendering it for browsers.
+package openapi
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vjsamuel/uploadly/service/apierror"
+)
+
+// Path the API is served under, relative to the path prefix of the server
+const API_PATH = "/api/v1"
+
+//go:embed openapi.json
+var document []byte
+
+//go:embed docs.html
+var docs []byte
+
+// Redoc renders the document in the page. It is vendored so that the page
+// loads nothing from outside the service, and refreshed from the version in
+// redoc/VERSION with go generate.
+//go:generate sh -c "curl -fsSL -o redoc/redoc.standalone.js https://cdn.redoc.ly/redoc/v$(cat redoc/VERSION)/bundles/redoc.standalone.js"
+
+//go:embed redoc
+var redoc embed.FS
+
+// Path of the vendored Redoc bundle in redoc
+const REDOC_SCRIPT = "redoc/redoc.standalone.js"
+
+// Document returns the OpenAPI document, with the server URL of the API under
+// the path prefix.
+func Document(prefix string) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+	doc["servers"] = []map[string]string{{"url": prefix + API_PATH}}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// Handler serves the OpenAPI document of the API under the path prefix.
+func Handler(prefix string) http.Handler {
+	doc, err := Document(prefix)
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			apierror.Write(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// DocsHandler serves a page rendering the document served next to it as
+// openapi.json.
+func DocsHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(docs)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// DocsScriptHandler serves the Redoc bundle loaded by the page of
+// DocsHandler as docs/redoc.standalone.js.
+func DocsScriptHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fs.Stat(redoc, REDOC_SCRIPT); err != nil {
+			apierror.Write(w, r, http.StatusNotFound, "Redoc is not vendored, run go generate ./openapi")
+			return
+		}
+		http.ServeFileFS(w, r, redoc, REDOC_SCRIPT)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Undocumented returns the routes of the API registered in the router under
+// the path prefix that the document leaves out, as "METHOD /path". CORS
+// preflight routes are not expected to be documented.
+func Undocumented(r *mux.Router, prefix string) ([]string, error) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+
+	base := prefix + API_PATH
+	var missing []string
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tmpl, base+"/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path := strings.TrimPrefix(tmpl, base)
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+			if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+				missing = append(missing, method+" "+API_PATH+path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
@@ -0,0 +1,72 @@
+package openapi_test
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/openapi"
+	"github.com/vjsamuel/uploadly/service/uploadly"
+	"github.com/vjsamuel/uploadly/service/uploadly/uploadlytest"
+)
+
+// router builds the router of the service on in-memory backends.
+func router(t *testing.T) *mux.Router {
+	t.Helper()
+
+	opts := uploadlytest.NewStore().Options(map[string]common.User{})
+	opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	server, err := uploadly.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server.Router()
+}
+
+func TestRoutesAreDocumented(t *testing.T) {
+	missing, err := openapi.Undocumented(router(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range missing {
+		t.Errorf("%s is missing from openapi.json", route)
+	}
+}
+
+func TestDocumentIsServed(t *testing.T) {
+	w := httptest.NewRecorder()
+	router(t).ServeHTTP(w, httptest.NewRequest(http.MethodGet, openapi.API_PATH+"/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the document, got status %d", w.Code)
+	}
+
+	var doc struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid document: %v", err)
+	}
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != openapi.API_PATH {
+		t.Errorf("expected the API to be served at %s, got %+v", openapi.API_PATH, doc.Servers)
+	}
+}
+
+func TestDocsLoadNothingRemote(t *testing.T) {
+	w := httptest.NewRecorder()
+	router(t).ServeHTTP(w, httptest.NewRequest(http.MethodGet, openapi.API_PATH+"/docs", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the page, got status %d", w.Code)
+	}
+	if page := w.Body.String(); strings.Contains(page, "://") {
+		t.Errorf("expected the page to load everything from the service, got %s", page)
+	}
+}
@@ -4,23 +4,27 @@ import (
 	"context"
 
 	"cloud.google.com/go/pubsub"
-	"log"
+	"log/slog"
+	"github.com/vjsamuel/uploadly/service/logging"
 	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"io"
 	"fmt"
 	"io/ioutil"
+	"time"
 )
 
 type PubSub struct {
 	topic     *pubsub.Topic
 	client    *pubsub.Client
-	ctx       context.Context
 }
 
 func NewPubSub(project, topic string, ctx context.Context) *PubSub {
 	client, err := pubsub.NewClient(ctx, project)
 	if err != nil {
-		log.Printf("Client connection failed with error: %v\n", err)
+		slog.Error("Client connection failed", "error", err)
 		return nil
 	}
 
@@ -28,22 +32,20 @@ func NewPubSub(project, topic string, ctx context.Context) *PubSub {
 	if t == nil {
 		t, err = client.CreateTopic(ctx, topic)
 		if err != nil {
-			log.Printf("Topic creation failed with error: %v\n", err)
+			slog.Error("Topic creation failed", "topic", topic, "error", err)
 			return nil
 		}
 	}
 
-	return &PubSub{client: client, topic: t, ctx: ctx}
+	return &PubSub{client: client, topic: t}
 }
 
-func (p *PubSub) Publish(holder common.Holder) (error){
-	reader, ok := holder.Object.(io.Reader)
-	if !ok {
-		return fmt.Errorf("Unable to get Reader for input object")
-	}
+func (p *PubSub) Publish(ctx context.Context, holder common.Holder, reader io.Reader) (err error){
+	ctx, span := tracing.Start(ctx, "pubsub.publish", attribute.String("messaging.destination.name", p.topic.ID()))
+	defer func() { tracing.End(span, err) }()
 
 	bytes, err := ioutil.ReadAll(reader)
-	if !ok {
+	if err != nil {
 		return fmt.Errorf("Unable to get bytes from reader due to error: %v", err)
 	}
 
@@ -55,17 +57,36 @@ func (p *PubSub) Publish(holder common.Holder) (error){
 		},
 		Data: bytes,
 	}
+	// Lets the subscriber continue the trace of the upload
+	tracing.Inject(ctx, message.Attributes)
 
-	result := p.topic.Publish(p.ctx, &message)
-	_, err = result.Get(p.ctx)
+	start := time.Now()
+	result := p.topic.Publish(ctx, &message)
+	_, err = result.Get(ctx)
+	metrics.ObservePublish(start, err)
 
 	if err != nil {
-		log.Printf("Message publish failed with error: %v\n", err)
+		logging.From(ctx).ErrorContext(ctx, "Message publish failed", "file", holder.File, "error", err)
 		return err
 	}
 
 	return nil
 }
 
+// Ping checks that the topic messages are published to exists.
+func (p *PubSub) Ping(ctx context.Context) error {
+	exists, err := p.topic.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("topic %s does not exist", p.topic.ID())
+	}
+	return nil
+}
 
-
+// Close waits for pending messages to be published before closing the client.
+func (p *PubSub) Close() error {
+	p.topic.Stop()
+	return p.client.Close()
+}
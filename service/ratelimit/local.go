@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/vjsamuel/uploadly/service/config"
+)
+
+// Number of keys whose buckets are kept per limit. The least recently used
+// buckets are dropped beyond it.
+const BUCKETS = 10000
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type localLimiter struct {
+	mu      sync.Mutex
+	limit   config.Limit
+	rate    float64
+	buckets gcache.Cache
+}
+
+// NewLocalLimiter keeps a token bucket per key in memory. Buckets hold up to
+// the requests of the limit and refill evenly over its period.
+func NewLocalLimiter(limit config.Limit) Limiter {
+	return &localLimiter{
+		limit:   limit,
+		rate:    float64(limit.Requests) / limit.Period.Seconds(),
+		buckets: gcache.New(BUCKETS).LRU().Build(),
+	}
+}
+
+func (l *localLimiter) Allow(ctx context.Context, key string) Decision {
+	return l.take(key, true)
+}
+
+func (l *localLimiter) Peek(ctx context.Context, key string) Decision {
+	return l.take(key, false)
+}
+
+func (l *localLimiter) take(key string, consume bool) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	capacity := float64(l.limit.Requests)
+	b := &bucket{tokens: capacity, updated: now}
+	if raw, err := l.buckets.GetIFPresent(key); err == nil {
+		b = raw.(*bucket)
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+		b.updated = now
+	}
+
+	d := Decision{Allowed: b.tokens >= 1, Limit: l.limit.Requests}
+	if d.Allowed && consume {
+		b.tokens--
+	}
+	if !d.Allowed {
+		d.RetryAfter = l.duration(1 - b.tokens)
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = l.duration(capacity - b.tokens)
+
+	if consume {
+		// An idle bucket is full again after a period, so it can be dropped
+		l.buckets.SetWithExpire(key, b, l.limit.Period)
+	}
+	return d
+}
+
+func (l *localLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
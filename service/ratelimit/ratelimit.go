@@ -0,0 +1,221 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/apierror"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/metrics"
+)
+
+// Names of the limits. They are also used in counter keys and metrics.
+const (
+	GLOBAL       = "global"
+	UPLOAD       = "upload"
+	DOWNLOAD     = "download"
+	METADATA     = "metadata"
+	ANONYMOUS    = "anonymous"
+	AUTH_FAILURE = "auth_failure"
+)
+
+// Decision is the outcome of checking a key against its limit.
+type Decision struct {
+	Allowed bool
+	// Requests allowed per period
+	Limit int
+	// Requests left right now
+	Remaining int
+	// Time until the full allowance is available again
+	Reset time.Duration
+	// Time until the next request is allowed, set when it was not
+	RetryAfter time.Duration
+}
+
+// Limiter keeps the allowance of every key for a single limit.
+type Limiter interface {
+	// Allow takes one request from the allowance of the key
+	Allow(ctx context.Context, key string) Decision
+	// Peek reports whether a request would be allowed without taking it
+	Peek(ctx context.Context, key string) Decision
+}
+
+// Counter is a shared store of expiring counters, such as memcache.
+type Counter interface {
+	Incr(ctx context.Context, key string, ttl time.Duration) (uint64, error)
+	Count(ctx context.Context, key string) (uint64, error)
+}
+
+// KeyFunc picks the key a request is limited by. Requests without a key are
+// not limited.
+type KeyFunc func(*http.Request) string
+
+// Limits holds a limiter for every configured limit. Methods on a nil Limits
+// allow every request.
+type Limits struct {
+	limiters map[string]Limiter
+	proxies  int
+}
+
+// NewLimits creates the configured limits. They are kept in the counter when
+// one is passed, and in memory otherwise.
+func NewLimits(cfg config.RateLimitConfig, counter Counter) *Limits {
+	l := &Limits{limiters: map[string]Limiter{}, proxies: cfg.TrustedProxies}
+	for name, limit := range map[string]config.Limit{
+		GLOBAL:       cfg.Global,
+		UPLOAD:       cfg.Upload,
+		DOWNLOAD:     cfg.Download,
+		METADATA:     cfg.Metadata,
+		ANONYMOUS:    cfg.Anonymous,
+		AUTH_FAILURE: cfg.AuthFailure,
+	} {
+		if limit.Unlimited() {
+			continue
+		}
+		if counter != nil {
+			l.limiters[name] = NewSharedLimiter(name, limit, counter)
+		} else {
+			l.limiters[name] = NewLocalLimiter(limit)
+		}
+	}
+	return l
+}
+
+// Middleware rejects requests once the key picked for them has exhausted the
+// named limit.
+func (l *Limits) Middleware(name string, key KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			limiter := l.limiter(name)
+			k := key(r)
+			if limiter == nil || k == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			d := limiter.Allow(r.Context(), k)
+			setHeaders(w, d)
+			if !d.Allowed {
+				reject(w, r, name, d)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Handler applies the named limit to a single handler.
+func (l *Limits) Handler(name string, key KeyFunc, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return l.Middleware(name, key)(handlerFunc).ServeHTTP
+}
+
+// Exhausted responds with a 429 and returns true when the key has no
+// allowance left in the named limit, without taking from it.
+func (l *Limits) Exhausted(w http.ResponseWriter, r *http.Request, name, key string) bool {
+	limiter := l.limiter(name)
+	if limiter == nil {
+		return false
+	}
+
+	d := limiter.Peek(r.Context(), key)
+	if d.Allowed {
+		return false
+	}
+	setHeaders(w, d)
+	reject(w, r, name, d)
+	return true
+}
+
+// Record takes one request from the allowance of the key without enforcing
+// the limit, such as for a failed authentication.
+func (l *Limits) Record(ctx context.Context, name, key string) {
+	if limiter := l.limiter(name); limiter != nil {
+		limiter.Allow(ctx, key)
+	}
+}
+
+// Allow takes one request from the allowance of the key and reports whether
+// it was allowed, for requests that are not served over HTTP.
+func (l *Limits) Allow(ctx context.Context, name, key string) bool {
+	limiter := l.limiter(name)
+	if limiter == nil || key == "" {
+		return true
+	}
+	if !limiter.Allow(ctx, key).Allowed {
+		metrics.ObserveRateLimited(name)
+		return false
+	}
+	return true
+}
+
+// Available reports whether the key has allowance left in the named limit,
+// without taking from it.
+func (l *Limits) Available(ctx context.Context, name, key string) bool {
+	limiter := l.limiter(name)
+	return limiter == nil || limiter.Peek(ctx, key).Allowed
+}
+
+// ClientIP identifies the client by its address, taken from X-Forwarded-For
+// when the service runs behind trusted proxies.
+func (l *Limits) ClientIP(r *http.Request) string {
+	if l != nil && l.proxies > 0 {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		// Addresses before the ones appended by the proxies can be forged
+		if len(hops) >= l.proxies {
+			return hops[len(hops)-l.proxies]
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Global limits all requests together.
+func Global(*http.Request) string {
+	return GLOBAL
+}
+
+func (l *Limits) limiter(name string) Limiter {
+	if l == nil {
+		return nil
+	}
+	return l.limiters[name]
+}
+
+func setHeaders(w http.ResponseWriter, d Decision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(d.Reset)))
+}
+
+func reject(w http.ResponseWriter, r *http.Request, name string, d Decision) {
+	metrics.ObserveRateLimited(name)
+	logging.From(r.Context()).InfoContext(r.Context(), "Rejecting request over rate limit", "limit", name)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+	apierror.WriteDetails(w, r, http.StatusTooManyRequests, fmt.Sprintf("The %s rate limit was exceeded", name),
+		map[string]string{"limit": name})
+}
+
+// seconds rounds up so that clients never retry too early.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,210 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+)
+
+// counter keeps counters in memory, and fails while err is set.
+type counter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+	err    error
+}
+
+func newCounter() *counter {
+	return &counter{counts: map[string]uint64{}}
+}
+
+func (c *counter) Incr(ctx context.Context, key string, ttl time.Duration) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.counts[key]++
+	return c.counts[key], nil
+}
+
+func (c *counter) Count(ctx context.Context, key string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[key], c.err
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	limiter := ratelimit.NewLocalLimiter(config.Limit{Requests: 2, Period: time.Second})
+
+	for i := 0; i < 2; i++ {
+		if d := limiter.Allow(ctx, "key"); !d.Allowed || d.Remaining != 1-i || d.Limit != 2 {
+			t.Fatalf("expected request %d to be allowed, got %+v", i+1, d)
+		}
+	}
+	d := limiter.Allow(ctx, "key")
+	if d.Allowed || d.Remaining != 0 {
+		t.Fatalf("expected the bucket to be empty, got %+v", d)
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > 500*time.Millisecond {
+		t.Errorf("expected a token within 500ms, got %v", d.RetryAfter)
+	}
+	if d := limiter.Allow(ctx, "another"); !d.Allowed {
+		t.Errorf("expected other keys to have their own bucket, got %+v", d)
+	}
+
+	// A token is added every 500ms
+	time.Sleep(550 * time.Millisecond)
+	if d := limiter.Allow(ctx, "key"); !d.Allowed {
+		t.Errorf("expected the bucket to refill, got %+v", d)
+	}
+	if d := limiter.Allow(ctx, "key"); d.Allowed {
+		t.Errorf("expected a single token to be added, got %+v", d)
+	}
+}
+
+func TestTokenBucketPeek(t *testing.T) {
+	ctx := context.Background()
+	limiter := ratelimit.NewLocalLimiter(config.Limit{Requests: 1, Period: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		if d := limiter.Peek(ctx, "key"); !d.Allowed || d.Remaining != 1 {
+			t.Fatalf("expected peeking to leave the allowance, got %+v", d)
+		}
+	}
+	limiter.Allow(ctx, "key")
+	if d := limiter.Peek(ctx, "key"); d.Allowed || d.RetryAfter <= 0 {
+		t.Errorf("expected peeking to see the empty bucket, got %+v", d)
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	ctx := context.Background()
+	c := newCounter()
+	limiter := ratelimit.NewSharedLimiter("upload", config.Limit{Requests: 2, Period: time.Hour}, c)
+
+	for i := 0; i < 2; i++ {
+		if d := limiter.Allow(ctx, "key"); !d.Allowed || d.Remaining != 1-i {
+			t.Fatalf("expected request %d to be allowed, got %+v", i+1, d)
+		}
+	}
+	d := limiter.Allow(ctx, "key")
+	if d.Allowed || d.Remaining != 0 {
+		t.Fatalf("expected the window to be exhausted, got %+v", d)
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > time.Hour || d.RetryAfter != d.Reset {
+		t.Errorf("expected to retry when the window ends, got %+v", d)
+	}
+	if d := limiter.Allow(ctx, "another"); !d.Allowed {
+		t.Errorf("expected other keys to have their own window, got %+v", d)
+	}
+}
+
+func TestFixedWindowPeek(t *testing.T) {
+	ctx := context.Background()
+	c := newCounter()
+	limiter := ratelimit.NewSharedLimiter("upload", config.Limit{Requests: 1, Period: time.Hour}, c)
+
+	for i := 0; i < 3; i++ {
+		if d := limiter.Peek(ctx, "key"); !d.Allowed || d.Remaining != 1 {
+			t.Fatalf("expected peeking to leave the allowance, got %+v", d)
+		}
+	}
+	limiter.Allow(ctx, "key")
+	if d := limiter.Peek(ctx, "key"); d.Allowed {
+		t.Errorf("expected peeking to see the exhausted window, got %+v", d)
+	}
+}
+
+func TestFixedWindowAllowsWithoutCounter(t *testing.T) {
+	ctx := context.Background()
+	c := newCounter()
+	c.err = errors.New("unreachable")
+	limiter := ratelimit.NewSharedLimiter("upload", config.Limit{Requests: 1, Period: time.Hour}, c)
+
+	for i := 0; i < 3; i++ {
+		if d := limiter.Allow(ctx, "key"); !d.Allowed {
+			t.Fatalf("expected requests to be allowed without the counter, got %+v", d)
+		}
+	}
+	if d := limiter.Peek(ctx, "key"); !d.Allowed {
+		t.Errorf("expected peeking to allow without the counter, got %+v", d)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	limits := ratelimit.NewLimits(config.RateLimitConfig{Upload: config.Limit{Requests: 1, Period: time.Hour}}, nil)
+	key := func(r *http.Request) string { return r.Header.Get("Key") }
+	handler := limits.Middleware(ratelimit.UPLOAD, key)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(k string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/", nil)
+		r.Header.Set("Key", k)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("key"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("expected the request with its limit headers, got %d and %v", w.Code, w.Header())
+	}
+	w := serve("key")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || w.Header().Get("Retry-After") == "0" {
+		t.Errorf("expected the request to be rejected with Retry-After, got %d and %v", w.Code, w.Header())
+	}
+	for i := 0; i < 3; i++ {
+		if w := serve(""); w.Code != http.StatusOK {
+			t.Errorf("expected requests without a key not to be limited, got %d", w.Code)
+		}
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var nilLimits *ratelimit.Limits
+	limits := ratelimit.NewLimits(config.RateLimitConfig{Upload: config.Limit{Requests: 0, Period: time.Hour}}, nil)
+	for _, l := range []*ratelimit.Limits{nilLimits, limits} {
+		for i := 0; i < 3; i++ {
+			if !l.Allow(context.Background(), ratelimit.UPLOAD, "key") {
+				t.Fatal("expected unconfigured limits to allow every request")
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		proxies   int
+		forwarded []string
+		expected  string
+	}{
+		{"no proxies", 0, []string{"203.0.113.1"}, "192.0.2.1"},
+		{"one proxy", 1, []string{"203.0.113.1"}, "203.0.113.1"},
+		{"forged by the client", 1, []string{"198.51.100.1, 203.0.113.1"}, "203.0.113.1"},
+		{"two proxies", 2, []string{"198.51.100.1, 203.0.113.1, 10.0.0.1"}, "203.0.113.1"},
+		{"split across headers", 2, []string{"198.51.100.1, 203.0.113.1", "10.0.0.1"}, "203.0.113.1"},
+		{"fewer hops than proxies", 2, []string{"203.0.113.1"}, "192.0.2.1"},
+		{"no header", 1, nil, "192.0.2.1"},
+		{"empty hops", 1, []string{" , 203.0.113.1, "}, "203.0.113.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits := ratelimit.NewLimits(config.RateLimitConfig{TrustedProxies: test.proxies}, nil)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for _, header := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if ip := limits.ClientIP(r); ip != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, ip)
+			}
+		})
+	}
+}
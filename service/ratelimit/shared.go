@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/logging"
+)
+
+type sharedLimiter struct {
+	name    string
+	limit   config.Limit
+	counter Counter
+}
+
+// NewSharedLimiter counts requests per key in fixed windows of the limit's
+// period in the counter, so that all replicas enforce a single allowance. When
+// the counter can not be reached requests are allowed.
+func NewSharedLimiter(name string, limit config.Limit, counter Counter) Limiter {
+	return &sharedLimiter{name: name, limit: limit, counter: counter}
+}
+
+func (s *sharedLimiter) Allow(ctx context.Context, key string) Decision {
+	k, reset := s.window(key)
+	count, err := s.counter.Incr(ctx, k, reset)
+	if err != nil {
+		logging.From(ctx).WarnContext(ctx, "Unable to count request for rate limit", "limit", s.name, "error", err)
+		return s.decision(0, reset, true)
+	}
+	return s.decision(count, reset, true)
+}
+
+func (s *sharedLimiter) Peek(ctx context.Context, key string) Decision {
+	k, reset := s.window(key)
+	count, err := s.counter.Count(ctx, k)
+	if err != nil {
+		logging.From(ctx).WarnContext(ctx, "Unable to read rate limit count", "limit", s.name, "error", err)
+		return s.decision(0, reset, false)
+	}
+	return s.decision(count, reset, false)
+}
+
+// window returns the counter key of the current window and the time left in it.
+func (s *sharedLimiter) window(key string) (string, time.Duration) {
+	now := time.Now()
+	start := now.Truncate(s.limit.Period)
+	return fmt.Sprintf("ratelimit:%s:%s:%d", s.name, key, start.Unix()), start.Add(s.limit.Period).Sub(now)
+}
+
+// decision reports on a window that has seen count requests. A request that was
+// counted is allowed if it is within the limit; otherwise one more would be.
+func (s *sharedLimiter) decision(count uint64, reset time.Duration, counted bool) Decision {
+	limit := uint64(s.limit.Requests)
+	d := Decision{Limit: s.limit.Requests, Reset: reset}
+	if counted {
+		d.Allowed = count <= limit
+	} else {
+		d.Allowed = count < limit
+	}
+	if count < limit {
+		d.Remaining = int(limit - count)
+	}
+	if !d.Allowed {
+		d.RetryAfter = reset
+	}
+	return d
+}
@@ -0,0 +1,199 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"github.com/vjsamuel/uploadly/service/rpc/filespb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Scope each method needs, as the matching REST route does
+var scopes = map[string]string{
+	filespb.Files_ListFiles_FullMethodName:   common.SCOPE_READ,
+	filespb.Files_GetFileInfo_FullMethodName: common.SCOPE_READ,
+	filespb.Files_Upload_FullMethodName:      common.SCOPE_WRITE,
+	filespb.Files_Download_FullMethodName:    common.SCOPE_READ,
+	filespb.Files_Delete_FullMethodName:      common.SCOPE_DELETE,
+}
+
+// Per profile limit each method counts against
+var limits = map[string]string{
+	filespb.Files_ListFiles_FullMethodName:   ratelimit.METADATA,
+	filespb.Files_GetFileInfo_FullMethodName: ratelimit.METADATA,
+	filespb.Files_Upload_FullMethodName:      ratelimit.UPLOAD,
+	filespb.Files_Download_FullMethodName:    ratelimit.DOWNLOAD,
+	filespb.Files_Delete_FullMethodName:      ratelimit.METADATA,
+}
+
+// Status of the authenticator's responses reported to clients
+var codesByStatus = map[int]codes.Code{
+	http.StatusUnauthorized:    codes.Unauthenticated,
+	http.StatusForbidden:       codes.PermissionDenied,
+	http.StatusTooManyRequests: codes.ResourceExhausted,
+}
+
+type userKey struct{}
+
+func userFrom(ctx context.Context) common.User {
+	usr, _ := ctx.Value(userKey{}).(common.User)
+	return usr
+}
+
+// guard authenticates and rate limits calls before they are served, and logs
+// them once they were.
+type guard struct {
+	auth   auth.Authenticator
+	limits *ratelimit.Limits
+	logger *slog.Logger
+}
+
+func (g *guard) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	ctx, err := g.admit(ctx, info.FullMethod)
+	var resp any
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	g.log(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+func (g *guard) stream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := g.admit(ss.Context(), info.FullMethod)
+	if err == nil {
+		err = handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+	g.log(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// admit checks the credential of the call with the authenticator, as if it
+// were a request to the REST route of the method, and returns the context
+// carrying its user.
+func (g *guard) admit(ctx context.Context, method string) (context.Context, error) {
+	scope, ok := scopes[method]
+	if !ok {
+		return ctx, status.Errorf(codes.Unimplemented, "Unknown method %s", method)
+	}
+	if !g.limits.Allow(ctx, ratelimit.GLOBAL, ratelimit.GLOBAL) {
+		return ctx, exhausted(ratelimit.GLOBAL)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	if err != nil {
+		return ctx, status.Error(codes.Internal, "Unable to authenticate the call")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, header := range []string{auth.AUTH_TOKEN, auth.API_KEY} {
+		if values := md.Get(header); len(values) > 0 {
+			r.Header.Set(header, values[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	var usr *common.User
+	w := &recorder{header: http.Header{}, status: http.StatusOK}
+	g.auth.AuthorizedHandler(scope, func(w http.ResponseWriter, r *http.Request) {
+		usr = g.auth.User(r)
+	}).ServeHTTP(w, r)
+	if usr == nil {
+		return ctx, w.err()
+	}
+
+	if limit := limits[method]; !g.limits.Allow(ctx, limit, usr.Profile) {
+		return ctx, exhausted(limit)
+	}
+	return context.WithValue(ctx, userKey{}, *usr), nil
+}
+
+func exhausted(limit string) error {
+	return status.Errorf(codes.ResourceExhausted, "The %s rate limit was exceeded", limit)
+}
+
+func (g *guard) log(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	attrs := []any{
+		"method", method,
+		"code", code.String(),
+		"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if usr, ok := ctx.Value(userKey{}).(common.User); ok {
+		attrs = append(attrs, "user", usr)
+	}
+
+	level := slog.LevelInfo
+	switch code {
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		level = slog.LevelError
+	}
+	g.logger.Log(ctx, level, "Served call", attrs...)
+}
+
+// serverStream replaces the context of a stream with the one carrying its
+// user.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// recorder keeps the response the authenticator wrote for a rejected call.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// err converts the rejection to a status, with the message of the API error
+// the authenticator responded with.
+func (r *recorder) err() error {
+	code, ok := codesByStatus[r.status]
+	if !ok {
+		code = codes.Internal
+	}
+
+	var envelope struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := strings.TrimSpace(r.body.String())
+	if json.Unmarshal(r.body.Bytes(), &envelope) == nil && envelope.Error.Message != "" {
+		message = envelope.Error.Message
+	}
+	if message == "" {
+		message = http.StatusText(r.status)
+	}
+	return status.Error(code, message)
+}
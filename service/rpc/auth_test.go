@@ -0,0 +1,134 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/apierror"
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"github.com/vjsamuel/uploadly/service/rpc/filespb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authenticator takes the API key as the scopes it is granted.
+type authenticator struct{}
+
+func (authenticator) AuthenticatedHandler(fn http.HandlerFunc) http.Handler {
+	return fn
+}
+
+func (a authenticator) AuthorizedHandler(scope string, fn http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.User(r) == nil {
+			apierror.Write(w, r, http.StatusUnauthorized, "A credential needs to be passed")
+			return
+		}
+		if !a.User(r).HasScope(scope) {
+			apierror.Write(w, r, http.StatusForbidden, "The key is not granted the "+scope+" scope")
+			return
+		}
+		fn(w, r)
+	})
+}
+
+func (authenticator) User(r *http.Request) *common.User {
+	key := r.Header.Get(auth.API_KEY)
+	if key == "" {
+		return nil
+	}
+	return &common.User{Profile: "profile", Scopes: strings.Split(key, ",")}
+}
+
+func newGuard(limits *ratelimit.Limits) *guard {
+	return &guard{auth: authenticator{}, limits: limits, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+}
+
+// call returns the context of a call passing the scopes as its API key.
+func call(scopes ...string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(auth.API_KEY, strings.Join(scopes, ",")))
+}
+
+func TestScopes(t *testing.T) {
+	tests := []struct {
+		method string
+		scope  string
+	}{
+		{filespb.Files_ListFiles_FullMethodName, common.SCOPE_READ},
+		{filespb.Files_GetFileInfo_FullMethodName, common.SCOPE_READ},
+		{filespb.Files_Download_FullMethodName, common.SCOPE_READ},
+		{filespb.Files_Upload_FullMethodName, common.SCOPE_WRITE},
+		{filespb.Files_Delete_FullMethodName, common.SCOPE_DELETE},
+	}
+
+	g := newGuard(nil)
+	all := []string{common.SCOPE_READ, common.SCOPE_WRITE, common.SCOPE_DELETE}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			ctx, err := g.admit(call(test.scope), test.method)
+			if err != nil {
+				t.Fatalf("expected %s to be enough, got %v", test.scope, err)
+			}
+			if usr := userFrom(ctx); usr.Profile != "profile" {
+				t.Errorf("expected the context to carry the user, got %+v", usr)
+			}
+
+			var others []string
+			for _, scope := range all {
+				if scope != test.scope {
+					others = append(others, scope)
+				}
+			}
+			_, err = g.admit(call(others...), test.method)
+			if status.Code(err) != codes.PermissionDenied || !strings.Contains(status.Convert(err).Message(), test.scope) {
+				t.Errorf("expected %s to be needed, got %v", test.scope, err)
+			}
+		})
+	}
+}
+
+func TestUnauthenticated(t *testing.T) {
+	_, err := newGuard(nil).admit(context.Background(), filespb.Files_ListFiles_FullMethodName)
+	if status.Code(err) != codes.Unauthenticated || status.Convert(err).Message() != "A credential needs to be passed" {
+		t.Errorf("expected the call to be unauthenticated with the API message, got %v", err)
+	}
+}
+
+func TestUnknownMethods(t *testing.T) {
+	_, err := newGuard(nil).admit(call(common.SCOPE_READ), "/uploadly.v1.Files/Unknown")
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected unknown methods to be unimplemented, got %v", err)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	limits := ratelimit.NewLimits(config.RateLimitConfig{
+		Upload:   config.Limit{Requests: 1, Period: time.Hour},
+		Metadata: config.Limit{Requests: 1, Period: time.Hour},
+	}, nil)
+	g := newGuard(limits)
+	ctx := call(common.SCOPE_READ, common.SCOPE_WRITE, common.SCOPE_DELETE)
+
+	if _, err := g.admit(ctx, filespb.Files_ListFiles_FullMethodName); err != nil {
+		t.Fatal(err)
+	}
+	// Metadata methods share their limit
+	if _, err := g.admit(ctx, filespb.Files_Delete_FullMethodName); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected the metadata limit to be exhausted, got %v", err)
+	}
+	if _, err := g.admit(ctx, filespb.Files_Upload_FullMethodName); err != nil {
+		t.Errorf("expected uploads to have their own limit, got %v", err)
+	}
+	if _, err := g.admit(ctx, filespb.Files_Download_FullMethodName); err != nil {
+		t.Errorf("expected unconfigured limits to allow calls, got %v", err)
+	}
+}
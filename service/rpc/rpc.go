@@ -0,0 +1,252 @@
+// Package rpc serves the files of each user over gRPC, for clients that
+// prefer generated stubs and streaming to the REST API. Calls are
+// authenticated and rate limited like the REST routes, and go through the
+// same file operations of the handler.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative filespb/files.proto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/handler"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"github.com/vjsamuel/uploadly/service/rpc/filespb"
+	"github.com/vjsamuel/uploadly/service/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Size of the chunks downloads are sent in when none is configured
+const DEFAULT_CHUNK_SIZE = 64 * 1024
+
+// Options configures the gRPC service.
+type Options struct {
+	// Files holds the file operations shared with the REST API
+	Files         *handler.Handler
+	Authenticator auth.Authenticator
+	// Limits applied to calls, per profile like the REST routes
+	Limits *ratelimit.Limits
+	// MaxUploadSize is reported to clients uploading larger files
+	MaxUploadSize int64
+	// ChunkSize bounds the size of the chunks downloads are sent in
+	ChunkSize int
+	// Logger for calls. Defaults to the default slog logger
+	Logger *slog.Logger
+}
+
+// service implements the Files service on top of the handler.
+type service struct {
+	filespb.UnimplementedFilesServer
+	files     *handler.Handler
+	maxSize   int64
+	chunkSize int
+	logger    *slog.Logger
+}
+
+// NewServer returns a gRPC server serving the Files service, with the
+// interceptors authenticating, rate limiting and logging its calls added
+// after any in opts.
+func NewServer(opts Options, serverOpts ...grpc.ServerOption) *grpc.Server {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger = logging.Wrap(logger)
+	g := &guard{auth: opts.Authenticator, limits: opts.Limits, logger: logger}
+
+	serverOpts = append(serverOpts,
+		grpc.ChainUnaryInterceptor(g.unary),
+		grpc.ChainStreamInterceptor(g.stream),
+	)
+	srv := grpc.NewServer(serverOpts...)
+
+	svc := &service{files: opts.Files, maxSize: opts.MaxUploadSize, chunkSize: opts.ChunkSize, logger: logger}
+	if svc.chunkSize <= 0 {
+		svc.chunkSize = DEFAULT_CHUNK_SIZE
+	}
+	filespb.RegisterFilesServer(srv, svc)
+	return srv
+}
+
+func (s *service) ListFiles(ctx context.Context, req *filespb.ListFilesRequest) (*filespb.ListFilesResponse, error) {
+	files, err := s.files.ListFiles(ctx, userFrom(ctx))
+	if err != nil {
+		return nil, s.status(ctx, err, "", "Unable to list files")
+	}
+
+	resp := &filespb.ListFilesResponse{Files: make([]*filespb.FileInfo, 0, len(files))}
+	for _, file := range files {
+		resp.Files = append(resp.Files, toFileInfo(file))
+	}
+	return resp, nil
+}
+
+func (s *service) GetFileInfo(ctx context.Context, req *filespb.GetFileInfoRequest) (*filespb.FileInfo, error) {
+	if err := validName(req.GetName()); err != nil {
+		return nil, err
+	}
+	info, err := s.files.FileInfo(ctx, userFrom(ctx), req.GetName())
+	if err != nil {
+		return nil, s.status(ctx, err, req.GetName(), "Unable to get file info")
+	}
+	return toFileInfo(*info), nil
+}
+
+// Upload reads the header of the file, then stores the chunks following it
+// until the client closes its side of the stream.
+func (s *service) Upload(stream grpc.ClientStreamingServer[filespb.UploadRequest, filespb.UploadResponse]) error {
+	ctx := stream.Context()
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "The upload must start with a header")
+	}
+	if err != nil {
+		return err
+	}
+	header := first.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "The upload must start with a header")
+	}
+	if err := validName(header.GetName()); err != nil {
+		return err
+	}
+
+	holder := common.Holder{
+		File:        header.GetName(),
+		User:        userFrom(ctx),
+		ContentType: header.GetContentType(),
+		Description: header.GetDescription(),
+	}
+	contents := &chunkReader{stream: stream}
+	size, err := s.files.StoreFile(ctx, holder, contents, header.GetUpdate())
+	if contents.err != nil {
+		return contents.err
+	}
+	if err != nil {
+		return s.status(ctx, err, holder.File, "Unable to process file")
+	}
+	return stream.SendAndClose(&filespb.UploadResponse{Name: holder.File, Size: size})
+}
+
+func (s *service) Download(req *filespb.DownloadRequest, stream grpc.ServerStreamingServer[filespb.DownloadResponse]) error {
+	ctx := stream.Context()
+	if err := validName(req.GetName()); err != nil {
+		return err
+	}
+	reader, err := s.files.OpenFile(ctx, userFrom(ctx), req.GetName())
+	if err != nil {
+		return s.status(ctx, err, req.GetName(), "Unable to get file. Please try again")
+	}
+	defer reader.Close()
+
+	buf := make([]byte, s.chunkSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			if err := stream.Send(&filespb.DownloadResponse{Chunk: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return s.status(ctx, err, req.GetName(), "Unable to get file. Please try again")
+		}
+	}
+}
+
+func (s *service) Delete(ctx context.Context, req *filespb.DeleteRequest) (*filespb.DeleteResponse, error) {
+	if err := validName(req.GetName()); err != nil {
+		return nil, err
+	}
+	if err := s.files.RemoveFile(ctx, userFrom(ctx), req.GetName()); err != nil {
+		return nil, s.status(ctx, err, req.GetName(), "Unable to delete file")
+	}
+	return &filespb.DeleteResponse{}, nil
+}
+
+// status converts the errors of the file operations to the status returned
+// to clients. Unexpected errors are logged and reported with the message.
+func (s *service) status(ctx context.Context, err error, name, message string) error {
+	switch {
+	case err == storage.ErrNotFound:
+		return status.Errorf(codes.NotFound, "File %s does not exist", name)
+	case err == handler.ErrTooLarge:
+		return status.Errorf(codes.ResourceExhausted, "File size exceeded %d bytes", s.maxSize)
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	s.logger.ErrorContext(ctx, message, "file", name, "error", err)
+	return status.Error(codes.Internal, message)
+}
+
+// validName rejects the names the REST API can not be given, as it only
+// keeps the base name of uploaded files.
+func validName(name string) error {
+	if name == "" {
+		return status.Error(codes.InvalidArgument, "A file name is required")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return status.Errorf(codes.InvalidArgument, "Invalid file name %s", name)
+	}
+	return nil
+}
+
+func toFileInfo(resp common.Response) *filespb.FileInfo {
+	return &filespb.FileInfo{
+		File:         resp.File,
+		UploadTime:   timestamppb.New(resp.UploadTime),
+		LastModified: timestamppb.New(resp.LastModified),
+		Version:      int32(resp.Version),
+		Size:         resp.Size,
+		Type:         resp.Type,
+		Description:  resp.Description,
+	}
+}
+
+// chunkReader reads the chunks of an upload as one stream of bytes. Errors
+// of the stream, and headers sent after the first message, are kept so the
+// upload reports them rather than the failure they cause.
+type chunkReader struct {
+	stream grpc.ClientStreamingServer[filespb.UploadRequest, filespb.UploadResponse]
+	chunk  []byte
+	err    error
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		req, err := c.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+		if req.GetHeader() != nil {
+			c.err = status.Error(codes.InvalidArgument, "The header can only be sent once")
+			return 0, c.err
+		}
+		c.chunk = req.GetChunk()
+	}
+
+	n := copy(b, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
@@ -0,0 +1,298 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+// Highest part number of a multipart upload
+const MAX_PARTS = 10000
+
+// upload is kept next to the parts of a multipart upload until it is
+// completed or aborted.
+type upload struct {
+	Key         string   `json:"key"`
+	ContentType string   `json:"content_type"`
+	Description []string `json:"description,omitempty"`
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	XMLNS    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	XMLNS    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (h *Handler) createMultipartUpload(w http.ResponseWriter, r *http.Request, usr *common.User, key string) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := hex.EncodeToString(buf)
+
+	raw, err := json.Marshal(upload{
+		Key:         key,
+		ContentType: contentType(r.Header.Get("Content-Type"), key),
+		Description: r.Header.Values(DESCRIPTION_HEADER),
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if _, _, err := h.opts.Files.WriteObject(r.Context(), uploadHolder(usr, id), bytes.NewReader(raw)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeXML(w, r, http.StatusOK, initiateResult{XMLNS: XMLNS, Bucket: usr.Profile, Key: key, UploadID: id})
+}
+
+func (h *Handler) uploadPart(w http.ResponseWriter, r *http.Request, usr *common.User, key string) {
+	query := r.URL.Query()
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 || number > MAX_PARTS {
+		writeError(w, r, errInvalidPartNumber)
+		return
+	}
+	id := query.Get("uploadId")
+	if _, err := h.upload(r.Context(), usr, id, key); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	contents, _, err := body(r, h.opts.MaxUploadSize)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// The upload is counted once the parts are joined into the file
+	_, sum, err := h.opts.Files.WriteObject(r.Context(), partHolder(usr, id, number), contents)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// completeMultipartUpload joins the parts into the object of the key, which
+// is written anew, so its ETag is the MD5 of the whole contents.
+func (h *Handler) completeMultipartUpload(w http.ResponseWriter, r *http.Request, usr *common.User, key string) {
+	id := r.URL.Query().Get("uploadId")
+	u, err := h.upload(r.Context(), usr, id, key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	contents, _, err := body(r, 1024*1024)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req completeRequest
+	if err := xml.NewDecoder(contents).Decode(&req); err != nil || len(req.Parts) == 0 {
+		if e, ok := err.(*apiError); ok {
+			writeError(w, r, e)
+		} else {
+			writeError(w, r, errMalformedXML)
+		}
+		return
+	}
+
+	parts := make([]common.Holder, 0, len(req.Parts))
+	var total int64
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			writeError(w, r, errInvalidPartOrder)
+			return
+		}
+		holder := partHolder(usr, id, part.PartNumber)
+		attrs, err := h.opts.Objects.Attrs(r.Context(), holder)
+		if err == storage.ErrNotFound {
+			writeError(w, r, errInvalidPart)
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if len(attrs.MD5) > 0 && strings.Trim(part.ETag, `"`) != hex.EncodeToString(attrs.MD5) {
+			writeError(w, r, errInvalidPart)
+			return
+		}
+		total += attrs.Size
+		parts = append(parts, holder)
+	}
+	if total > h.opts.MaxUploadSize {
+		writeError(w, r, errTooLarge)
+		return
+	}
+
+	holder := newHolder(usr, key)
+	holder.ContentType = u.ContentType
+	if len(u.Description) > 0 {
+		holder.Description = u.Description[0]
+	}
+	reader := &partsReader{ctx: r.Context(), objects: h.opts.Objects, parts: parts}
+	defer reader.Close()
+	_, sum, err := h.opts.Files.WriteFile(r.Context(), holder, reader)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h.cleanUp(r.Context(), usr, id)
+
+	writeXML(w, r, http.StatusOK, completeResult{
+		XMLNS:    XMLNS,
+		Location: "/" + usr.Profile + "/" + encode(key, false),
+		Bucket:   usr.Profile,
+		Key:      key,
+		ETag:     `"` + hex.EncodeToString(sum) + `"`,
+	})
+}
+
+func (h *Handler) abortMultipartUpload(w http.ResponseWriter, r *http.Request, usr *common.User, key string) {
+	id := r.URL.Query().Get("uploadId")
+	if _, err := h.upload(r.Context(), usr, id, key); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h.cleanUp(r.Context(), usr, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upload reads the multipart upload with the ID, which must have been
+// created for the key.
+func (h *Handler) upload(ctx context.Context, usr *common.User, id, key string) (*upload, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, errNoSuchUpload
+	}
+
+	reader, err := h.opts.Objects.Reader(ctx, uploadHolder(usr, id))
+	if err == storage.ErrNotFound {
+		return nil, errNoSuchUpload
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(reader, 64*1024)); err != nil {
+		return nil, err
+	}
+	u := &upload{}
+	if err := json.Unmarshal(buf.Bytes(), u); err != nil {
+		return nil, err
+	}
+	if u.Key != key {
+		return nil, errNoSuchUpload
+	}
+	return u, nil
+}
+
+// cleanUp deletes the parts of the upload, including those that were not
+// completed, and then the upload itself.
+func (h *Handler) cleanUp(ctx context.Context, usr *common.User, id string) {
+	objects, err := h.opts.Objects.List(ctx, newHolder(usr, ""))
+	if err != nil {
+		logging.From(ctx).WarnContext(ctx, "Unable to list the parts of a multipart upload", "upload", id, "error", err)
+		return
+	}
+
+	prefix := MULTIPART_PREFIX + id + "/"
+	upload := uploadHolder(usr, id)
+	for _, o := range objects {
+		if !strings.HasPrefix(o.Name, prefix) || o.Name == upload.File {
+			continue
+		}
+		if err := h.opts.Objects.Delete(ctx, newHolder(usr, o.Name)); err != nil && err != storage.ErrNotFound {
+			logging.From(ctx).WarnContext(ctx, "Unable to delete the part of a multipart upload", "part", o.Name, "error", err)
+		}
+	}
+	if err := h.opts.Objects.Delete(ctx, upload); err != nil && err != storage.ErrNotFound {
+		logging.From(ctx).WarnContext(ctx, "Unable to delete a multipart upload", "upload", id, "error", err)
+	}
+}
+
+func uploadHolder(usr *common.User, id string) common.Holder {
+	return newHolder(usr, MULTIPART_PREFIX+id+"/upload")
+}
+
+func partHolder(usr *common.User, id string, number int) common.Holder {
+	return newHolder(usr, fmt.Sprintf("%s%s/%05d", MULTIPART_PREFIX, id, number))
+}
+
+// partsReader reads the objects of the parts one after the other.
+type partsReader struct {
+	ctx     context.Context
+	objects storage.ObjectStore
+	parts   []common.Holder
+	reader  io.ReadCloser
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.reader == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := p.objects.Reader(p.ctx, p.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			p.reader, p.parts = reader, p.parts[1:]
+		}
+
+		n, err := p.reader.Read(b)
+		if err == io.EOF {
+			p.reader.Close()
+			p.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.reader == nil {
+		return nil
+	}
+	return p.reader.Close()
+}
@@ -0,0 +1,228 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// multipart drives multipart uploads of a user through the handler.
+type multipart struct {
+	t       *testing.T
+	handler http.Handler
+	store   *objects
+	usr     common.User
+}
+
+func newMultipart(t *testing.T) *multipart {
+	usr := common.User{Profile: "profile", Scopes: []string{common.SCOPE_READ, common.SCOPE_WRITE}}
+	handler, store := newTestHandler(t, users{"key": usr})
+	return &multipart{t: t, handler: handler, store: store, usr: usr}
+}
+
+func (m *multipart) do(method, target, contents string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://s3.example.com"+target, strings.NewReader(contents))
+	w := httptest.NewRecorder()
+	m.handler.ServeHTTP(w, signed(r, "key", "us-east-1", time.Now(), hashHex([]byte(contents))))
+	return w
+}
+
+func (m *multipart) create(key string) string {
+	m.t.Helper()
+	w := m.do(http.MethodPost, "/profile/"+key+"?uploads", "")
+	if w.Code != http.StatusOK {
+		m.t.Fatalf("expected the upload to be created, got %d: %s", w.Code, w.Body)
+	}
+	var result initiateResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || result.UploadID == "" {
+		m.t.Fatalf("expected an upload ID, got %s, %v", w.Body, err)
+	}
+	return result.UploadID
+}
+
+func (m *multipart) part(key, id string, number int, contents string) string {
+	m.t.Helper()
+	w := m.do(http.MethodPut, fmt.Sprintf("/profile/%s?partNumber=%d&uploadId=%s", key, number, id), contents)
+	if w.Code != http.StatusOK {
+		m.t.Fatalf("expected part %d to be uploaded, got %d: %s", number, w.Code, w.Body)
+	}
+	return w.Header().Get("ETag")
+}
+
+// complete lists the parts, each as its number followed by its ETag.
+func (m *multipart) complete(key, id string, parts ...any) *httptest.ResponseRecorder {
+	var b strings.Builder
+	b.WriteString("<CompleteMultipartUpload>")
+	for i := 0; i < len(parts); i += 2 {
+		fmt.Fprintf(&b, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", parts[i], parts[i+1])
+	}
+	b.WriteString("</CompleteMultipartUpload>")
+	return m.do(http.MethodPost, "/profile/"+key+"?uploadId="+id, b.String())
+}
+
+// uploads returns the objects left by multipart uploads.
+func (m *multipart) uploads() []string {
+	left := []string{}
+	for _, name := range m.store.names() {
+		if strings.HasPrefix(name, "profile/"+MULTIPART_PREFIX) {
+			left = append(left, name)
+		}
+	}
+	return left
+}
+
+func TestMultipartUpload(t *testing.T) {
+	m := newMultipart(t)
+	id := m.create("file.txt")
+	first := m.part("file.txt", id, 1, "first ")
+	second := m.part("file.txt", id, 2, "second")
+
+	sum := md5.Sum([]byte("first "))
+	if first != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Errorf("expected the ETag of a part to be its MD5, got %s", first)
+	}
+
+	w := m.complete("file.txt", id, 1, first, 2, second)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the upload to complete, got %d: %s", w.Code, w.Body)
+	}
+	var result completeResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	sum = md5.Sum([]byte("first second"))
+	if result.Key != "file.txt" || result.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Errorf("expected the key and the MD5 of the file, got %+v", result)
+	}
+
+	if data, _ := m.store.get(common.Holder{User: m.usr, File: "file.txt"}); string(data) != "first second" {
+		t.Errorf("expected the parts to be joined, got %q", data)
+	}
+	if left := m.uploads(); len(left) != 0 {
+		t.Errorf("expected the parts to be deleted, got %v", left)
+	}
+}
+
+func TestMultipartUploadSkipsUnlistedParts(t *testing.T) {
+	m := newMultipart(t)
+	id := m.create("file.txt")
+	first := m.part("file.txt", id, 1, "first")
+	m.part("file.txt", id, 2, "skipped")
+	third := m.part("file.txt", id, 3, "third")
+
+	if w := m.complete("file.txt", id, 1, first, 3, third); w.Code != http.StatusOK {
+		t.Fatalf("expected the upload to complete, got %d: %s", w.Code, w.Body)
+	}
+	if data, _ := m.store.get(common.Holder{User: m.usr, File: "file.txt"}); string(data) != "firstthird" {
+		t.Errorf("expected only the listed parts, got %q", data)
+	}
+	if left := m.uploads(); len(left) != 0 {
+		t.Errorf("expected unlisted parts to be deleted too, got %v", left)
+	}
+}
+
+func TestMultipartUploadRejectsParts(t *testing.T) {
+	m := newMultipart(t)
+	id := m.create("file.txt")
+	first := m.part("file.txt", id, 1, "first")
+	second := m.part("file.txt", id, 2, "second")
+
+	tests := []struct {
+		name  string
+		parts []any
+		code  string
+	}{
+		{"out of order", []any{2, second, 1, first}, "InvalidPartOrder"},
+		{"repeated", []any{1, first, 1, first}, "InvalidPartOrder"},
+		{"missing", []any{1, first, 3, second}, "InvalidPart"},
+		{"wrong ETag", []any{1, second, 2, second}, "InvalidPart"},
+		{"none", []any{}, "MalformedXML"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := m.complete("file.txt", id, test.parts...)
+			if w.Code != http.StatusBadRequest || errorCode(w) != test.code {
+				t.Errorf("expected %s, got %d and %q", test.code, w.Code, errorCode(w))
+			}
+		})
+	}
+
+	if _, ok := m.store.get(common.Holder{User: m.usr, File: "file.txt"}); ok {
+		t.Error("expected no file to be written")
+	}
+	if w := m.complete("file.txt", id, 1, first, 2, second); w.Code != http.StatusOK {
+		t.Errorf("expected the upload to still complete, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestMultipartAbort(t *testing.T) {
+	m := newMultipart(t)
+	id := m.create("file.txt")
+	first := m.part("file.txt", id, 1, "first")
+
+	if w := m.do(http.MethodDelete, "/profile/file.txt?uploadId="+id, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected the upload to be aborted, got %d: %s", w.Code, w.Body)
+	}
+	if left := m.uploads(); len(left) != 0 {
+		t.Errorf("expected the parts to be deleted, got %v", left)
+	}
+
+	w := m.do(http.MethodPut, "/profile/file.txt?partNumber=2&uploadId="+id, "second")
+	if w.Code != http.StatusNotFound || errorCode(w) != "NoSuchUpload" {
+		t.Errorf("expected parts of an aborted upload to be rejected, got %d and %q", w.Code, errorCode(w))
+	}
+	w = m.complete("file.txt", id, 1, first)
+	if w.Code != http.StatusNotFound || errorCode(w) != "NoSuchUpload" {
+		t.Errorf("expected an aborted upload not to complete, got %d and %q", w.Code, errorCode(w))
+	}
+	if w := m.do(http.MethodDelete, "/profile/file.txt?uploadId="+id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected an aborted upload to be gone, got %d", w.Code)
+	}
+}
+
+func TestMultipartUnknownUploads(t *testing.T) {
+	m := newMultipart(t)
+	id := m.create("file.txt")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+		code   string
+	}{
+		{"part of another key", http.MethodPut, "/profile/another.txt?partNumber=1&uploadId=" + id, http.StatusNotFound, "NoSuchUpload"},
+		{"unknown ID", http.MethodPut, "/profile/file.txt?partNumber=1&uploadId=00ff", http.StatusNotFound, "NoSuchUpload"},
+		{"malformed ID", http.MethodPut, "/profile/file.txt?partNumber=1&uploadId=../upload", http.StatusNotFound, "NoSuchUpload"},
+		{"part number zero", http.MethodPut, "/profile/file.txt?partNumber=0&uploadId=" + id, http.StatusBadRequest, "InvalidArgument"},
+		{"part number too high", http.MethodPut, "/profile/file.txt?partNumber=10001&uploadId=" + id, http.StatusBadRequest, "InvalidArgument"},
+		{"abort of another key", http.MethodDelete, "/profile/another.txt?uploadId=" + id, http.StatusNotFound, "NoSuchUpload"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := m.do(test.method, test.target, "part")
+			if w.Code != test.status || errorCode(w) != test.code {
+				t.Errorf("expected status %d and code %q, got %d and %q", test.status, test.code, w.Code, errorCode(w))
+			}
+		})
+	}
+}
+
+func TestMultipartNeedsWriteScope(t *testing.T) {
+	usr := common.User{Profile: "profile", Scopes: []string{common.SCOPE_READ}}
+	handler, _ := newTestHandler(t, users{"key": usr})
+	r := httptest.NewRequest(http.MethodPost, "http://s3.example.com/profile/file.txt?uploads", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, signed(r, "key", "us-east-1", time.Now(), emptyHash))
+	if w.Code != http.StatusForbidden || errorCode(w) != "AccessDenied" {
+		t.Errorf("expected uploads to need the write scope, got %d and %q", w.Code, errorCode(w))
+	}
+}
@@ -0,0 +1,467 @@
+package s3
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+// Header carrying the description of a file
+const DESCRIPTION_HEADER = "X-Amz-Meta-Description"
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Owner   owner    `xml:"Owner"`
+	Buckets []bucket `xml:"Buckets>Bucket"`
+}
+
+// listBuckets returns the bucket of the user, created when their first file
+// was uploaded.
+func (h *Handler) listBuckets(w http.ResponseWriter, r *http.Request, usr *common.User) {
+	files, err := h.opts.Metadata.List(r.Context(), newHolder(usr, ""))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created := time.Now()
+	for _, file := range files {
+		if file.UploadTime.Before(created) {
+			created = file.UploadTime
+		}
+	}
+	writeXML(w, r, http.StatusOK, listBucketsResult{
+		XMLNS:   XMLNS,
+		Owner:   owner{ID: usr.Profile, DisplayName: strings.TrimSpace(usr.FirstName + " " + usr.LastName)},
+		Buckets: []bucket{{Name: usr.Profile, CreationDate: timestamp(created)}},
+	})
+}
+
+type locationResult struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	XMLNS    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+func (h *Handler) location(w http.ResponseWriter, r *http.Request) {
+	// Buckets in the default region have no location constraint
+	location := h.opts.Region
+	if location == "us-east-1" {
+		location = ""
+	}
+	writeXML(w, r, http.StatusOK, locationResult{XMLNS: XMLNS, Location: location})
+}
+
+// object describes a file in listings.
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listObjectsResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	XMLNS                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Marker                *string        `xml:"Marker"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	KeyCount              *int           `xml:"KeyCount"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []object       `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObjects answers both versions of the listing. Version 2 pages with
+// continuation tokens and version 1 with markers.
+func (h *Handler) listObjects(w http.ResponseWriter, r *http.Request, usr *common.User) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	maxKeys := MAX_KEYS
+	if raw := query.Get("max-keys"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			writeError(w, r, errInvalidArgument)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	encoding := query.Get("encoding-type")
+	if encoding != "" && encoding != "url" {
+		writeError(w, r, errInvalidArgument)
+		return
+	}
+	escape := func(s string) string {
+		if encoding == "url" {
+			return encode(s, true)
+		}
+		return s
+	}
+
+	result := listObjectsResult{XMLNS: XMLNS, Name: usr.Profile, Prefix: escape(prefix), Delimiter: escape(delimiter), EncodingType: encoding, MaxKeys: maxKeys}
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		result.StartAfter = escape(after)
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				writeError(w, r, errInvalidArgument)
+				return
+			}
+			after = string(decoded)
+			result.ContinuationToken = token
+		}
+	} else {
+		marker := escape(after)
+		result.Marker = &marker
+	}
+
+	objects, err := h.list(r.Context(), usr)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	count, last := 0, ""
+	for _, o := range objects {
+		if o.Key <= after || !strings.HasPrefix(o.Key, prefix) {
+			continue
+		}
+
+		// Keys sharing a prefix up to the delimiter are rolled up
+		rolled := ""
+		if delimiter != "" {
+			if i := strings.Index(o.Key[len(prefix):], delimiter); i >= 0 {
+				rolled = o.Key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if rolled != "" && (rolled == last || strings.HasPrefix(after, rolled)) {
+			continue
+		}
+
+		if count == maxKeys {
+			result.IsTruncated = maxKeys > 0
+			break
+		}
+		count++
+		if rolled != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: escape(rolled)})
+			last = rolled
+		} else {
+			last = o.Key
+			o.Key = escape(o.Key)
+			result.Contents = append(result.Contents, o)
+		}
+	}
+
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			result.NextMarker = escape(last)
+		}
+	}
+	if v2 {
+		result.KeyCount = &count
+	}
+	writeXML(w, r, http.StatusOK, result)
+}
+
+// list describes all files of the user sorted by key, with the sizes and
+// checksums of their objects.
+func (h *Handler) list(ctx context.Context, usr *common.User) ([]object, error) {
+	files, err := h.opts.Metadata.List(ctx, newHolder(usr, ""))
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := h.opts.Objects.List(ctx, newHolder(usr, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]storage.ObjectAttrs{}
+	for _, a := range attrs {
+		byName[a.Name] = a
+	}
+	objects := make([]object, 0, len(files))
+	for i := range files {
+		file := &files[i]
+		o := object{Key: file.File, LastModified: timestamp(file.LastModified), Size: file.Size, StorageClass: "STANDARD"}
+		a, ok := byName[file.File]
+		if ok {
+			o.Size = a.Size
+		}
+		o.ETag = etag(file, &a)
+		objects = append(objects, o)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// etag is the MD5 of the contents when it is known, like for objects uploaded
+// in a single part to S3, and changes with every version otherwise.
+func etag(file *common.Response, attrs *storage.ObjectAttrs) string {
+	if attrs != nil && len(attrs.MD5) > 0 {
+		return `"` + hex.EncodeToString(attrs.MD5) + `"`
+	}
+	return fmt.Sprintf(`"%d-%x"`, file.Version, file.LastModified.UnixNano())
+}
+
+func (h *Handler) getObject(w http.ResponseWriter, r *http.Request, usr *common.User, key string) {
+	holder := newHolder(usr, key)
+	file, err := h.opts.Metadata.Get(r.Context(), holder)
+	if err == storage.ErrNotFound {
+		writeError(w, r, errNoSuchKey)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// Files uploaded through the API are listed before their contents are
+	// written
+	attrs, err := h.opts.Objects.Attrs(r.Context(), holder)
+	if err == storage.ErrNotFound {
+		writeError(w, r, errNoSuchKey)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", file.Type)
+	w.Header().Set("ETag", etag(file, attrs))
+	if file.Description != "" {
+		w.Header().Set(DESCRIPTION_HEADER, file.Description)
+	}
+
+	reader := &objectReader{ctx: r.Context(), objects: h.opts.Objects, holder: holder, size: attrs.Size}
+	defer reader.Close()
+	http.ServeContent(w, r, "", file.LastModified, reader)
+	if reader.read > 0 {
+		metrics.ObserveTransfer(metrics.DOWNLOAD, *usr, reader.read)
+	}
+}
+
+func (h *Handler) putObject(w http.ResponseWriter, r *http.Request, usr *common.User, key string) {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		writeError(w, r, errNotImplemented)
+		return
+	}
+
+	contents, _, err := body(r, h.opts.MaxUploadSize)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	holder := newHolder(usr, key)
+	holder.ContentType = contentType(r.Header.Get("Content-Type"), key)
+	holder.Description = r.Header.Get(DESCRIPTION_HEADER)
+	_, sum, err := h.opts.Files.WriteFile(r.Context(), holder, contents)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) deleteObject(w http.ResponseWriter, r *http.Request, usr *common.User, key string) {
+	if err := h.remove(r.Context(), newHolder(usr, key)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleted struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name      `xml:"DeleteResult"`
+	XMLNS   string        `xml:"xmlns,attr"`
+	Deleted []deleted     `xml:"Deleted"`
+	Errors  []deleteError `xml:"Error"`
+}
+
+func (h *Handler) deleteObjects(w http.ResponseWriter, r *http.Request, usr *common.User) {
+	contents, _, err := body(r, 1024*1024)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req deleteRequest
+	if err := xml.NewDecoder(contents).Decode(&req); err != nil {
+		if e, ok := err.(*apiError); ok {
+			writeError(w, r, e)
+		} else {
+			writeError(w, r, errMalformedXML)
+		}
+		return
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > MAX_KEYS {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	result := deleteResult{XMLNS: XMLNS}
+	for _, o := range req.Objects {
+		var err error
+		if invalid := validKey(o.Key); invalid != nil {
+			err = invalid
+		} else {
+			err = h.remove(r.Context(), newHolder(usr, o.Key))
+		}
+		if err != nil {
+			e, ok := err.(*apiError)
+			if !ok {
+				e = errInternal
+			}
+			result.Errors = append(result.Errors, deleteError{Key: o.Key, Code: e.code, Message: e.message})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: o.Key})
+		}
+	}
+	writeXML(w, r, http.StatusOK, result)
+}
+
+// remove deletes the file of the holder. Files that do not exist are
+// considered deleted.
+func (h *Handler) remove(ctx context.Context, holder common.Holder) error {
+	if err := h.opts.Files.RemoveFile(ctx, holder.User, holder.File); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// contentType uses the type passed with the upload unless it is a generic
+// one, and the type of the extension of the key otherwise.
+func contentType(passed, key string) string {
+	if passed != "" && passed != "binary/octet-stream" && passed != "application/octet-stream" {
+		return passed
+	}
+	if byExtension := mime.TypeByExtension(filepath.Ext(key)); byExtension != "" {
+		return byExtension
+	}
+	return "application/octet-stream"
+}
+
+// objectReader streams an object of a known size. Seeking reopens the object
+// and skips to the offset, which is only needed for range requests.
+type objectReader struct {
+	ctx     context.Context
+	objects storage.ObjectStore
+	holder  common.Holder
+	size    int64
+	reader  io.ReadCloser
+	offset  int64
+	read    int64
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.reader == nil {
+		reader, err := o.objects.Reader(o.ctx, o.holder)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, reader, o.offset); err != nil {
+			reader.Close()
+			return 0, err
+		}
+		o.reader = reader
+	}
+
+	n, err := o.reader.Read(p)
+	o.offset += int64(n)
+	o.read += int64(n)
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+
+	if offset != o.offset && o.reader != nil {
+		o.reader.Close()
+		o.reader = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *objectReader) Close() error {
+	if o.reader == nil {
+		return nil
+	}
+	return o.reader.Close()
+}
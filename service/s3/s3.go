@@ -0,0 +1,343 @@
+// Package s3 serves a subset of the S3 REST API so that tools speaking S3 can
+// manage the files of a user. Each user sees a single bucket named after their
+// profile, holding their files as objects. Requests are signed with AWS
+// Signature Version 4 using credentials derived from the API keys of the user.
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/apierror"
+	"github.com/vjsamuel/uploadly/service/cache"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/storage"
+)
+
+// Namespace of the XML documents of the API
+const XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// Prefix of the objects holding the parts of multipart uploads. Keys can not
+// contain "/", so they never collide with files.
+const MULTIPART_PREFIX = ".uploadly-multipart/"
+
+// Most keys returned by a single listing or deleted by a single request
+const MAX_KEYS = 1000
+
+// Longest key accepted, in bytes
+const MAX_KEY_LENGTH = 1024
+
+// Users validates API keys by the hash they are stored under.
+type Users interface {
+	KeyUser(ctx context.Context, hash string) *common.User
+}
+
+// Files writes and deletes files like the other APIs do.
+type Files interface {
+	// WriteObject writes an object that is not a file, such as a part
+	WriteObject(ctx context.Context, holder common.Holder, contents io.Reader) (int64, []byte, error)
+	WriteFile(ctx context.Context, holder common.Holder, contents io.Reader) (int64, []byte, error)
+	RemoveFile(ctx context.Context, usr common.User, name string) error
+}
+
+// Options configures the S3 handler.
+type Options struct {
+	// Region requests are signed for
+	Region string
+	// Secret the secret access keys are derived from
+	SigningSecret string
+	Objects       storage.ObjectStore
+	Metadata      storage.MetadataStore
+	Files         Files
+	// MaxUploadSize bounds the size of objects and of each part
+	MaxUploadSize int64
+	Users         Users
+	// Number of access keys kept validated and for how long
+	CacheSize int
+	CacheTTL  time.Duration
+}
+
+type Handler struct {
+	opts  Options
+	users *cache.EvictableMap
+}
+
+// NewHandler serves the API from the stores. It expects to be wrapped by
+// Authenticate.
+func NewHandler(opts Options) *Handler {
+	return &Handler{opts: opts, users: cache.NewEvictableMap(opts.CacheSize, opts.CacheTTL)}
+}
+
+// Credentials derives the S3 credentials of the API key stored under the hash.
+// The access key ID is the hash itself, and the secret access key can only be
+// derived with the signing secret.
+func Credentials(signingSecret, hash string) common.S3Credentials {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte(hash))
+	return common.S3Credentials{AccessKeyID: hash, SecretAccessKey: hex.EncodeToString(mac.Sum(nil))}
+}
+
+type userKey struct{}
+
+// User returns the user authenticated for the request, if any.
+func User(r *http.Request) *common.User {
+	usr, _ := r.Context().Value(userKey{}).(*common.User)
+	return usr
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	usr := User(r)
+	if usr == nil {
+		writeError(w, r, errAccessDenied)
+		return
+	}
+
+	bucket, key := splitPath(r.URL.Path)
+	query := r.URL.Query()
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		if h.authorize(w, r, usr, common.SCOPE_READ) {
+			h.listBuckets(w, r, usr)
+		}
+		return
+	}
+
+	// Other users are not revealed to have buckets
+	if bucket != usr.Profile {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	if key == "" {
+		h.serveBucket(w, r, usr, query)
+		return
+	}
+	if err := validKey(key); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h.serveObject(w, r, usr, key, query)
+}
+
+func (h *Handler) serveBucket(w http.ResponseWriter, r *http.Request, usr *common.User, query map[string][]string) {
+	if unsupported(query, bucketSubresources) {
+		writeError(w, r, errNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		if h.authorize(w, r, usr, common.SCOPE_READ) {
+			w.WriteHeader(http.StatusOK)
+		}
+	case http.MethodGet:
+		if !h.authorize(w, r, usr, common.SCOPE_READ) {
+			return
+		}
+		if _, ok := query["location"]; ok {
+			h.location(w, r)
+		} else {
+			h.listObjects(w, r, usr)
+		}
+	case http.MethodPost:
+		if _, ok := query["delete"]; !ok {
+			writeError(w, r, errNotImplemented)
+		} else if h.authorize(w, r, usr, common.SCOPE_DELETE) {
+			h.deleteObjects(w, r, usr)
+		}
+	case http.MethodPut:
+		writeError(w, r, errBucketOwned)
+	default:
+		writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+func (h *Handler) serveObject(w http.ResponseWriter, r *http.Request, usr *common.User, key string, query map[string][]string) {
+	if unsupported(query, objectSubresources) {
+		writeError(w, r, errNotImplemented)
+		return
+	}
+	_, multipart := query["uploadId"]
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if multipart {
+			writeError(w, r, errNotImplemented)
+		} else if h.authorize(w, r, usr, common.SCOPE_READ) {
+			h.getObject(w, r, usr, key)
+		}
+	case http.MethodPut:
+		if !h.authorize(w, r, usr, common.SCOPE_WRITE) {
+			return
+		}
+		if multipart {
+			h.uploadPart(w, r, usr, key)
+		} else {
+			h.putObject(w, r, usr, key)
+		}
+	case http.MethodPost:
+		if !h.authorize(w, r, usr, common.SCOPE_WRITE) {
+			return
+		}
+		if _, ok := query["uploads"]; ok {
+			h.createMultipartUpload(w, r, usr, key)
+		} else if multipart {
+			h.completeMultipartUpload(w, r, usr, key)
+		} else {
+			writeError(w, r, errNotImplemented)
+		}
+	case http.MethodDelete:
+		if multipart {
+			if h.authorize(w, r, usr, common.SCOPE_WRITE) {
+				h.abortMultipartUpload(w, r, usr, key)
+			}
+		} else if h.authorize(w, r, usr, common.SCOPE_DELETE) {
+			h.deleteObject(w, r, usr, key)
+		}
+	default:
+		writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, usr *common.User, scope string) bool {
+	if !usr.HasScope(scope) {
+		writeError(w, r, errAccessDenied)
+		return false
+	}
+	return true
+}
+
+// Subresources that are not supported. Requests for them fail rather than
+// being mistaken for plain listings, reads and writes.
+var bucketSubresources = []string{"acl", "cors", "encryption", "lifecycle", "logging", "notification", "object-lock",
+	"policy", "replication", "tagging", "uploads", "versioning", "versions", "website"}
+var objectSubresources = []string{"acl", "attributes", "legal-hold", "restore", "retention", "select", "tagging", "torrent"}
+
+func unsupported(query map[string][]string, subresources []string) bool {
+	for _, name := range subresources {
+		if _, ok := query[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitPath(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// validKey only accepts flat names, like the rest of the API.
+func validKey(key string) *apiError {
+	switch {
+	case len(key) > MAX_KEY_LENGTH:
+		return errKeyTooLong
+	case strings.Contains(key, "/"):
+		return errInvalidKey
+	}
+	return nil
+}
+
+func newHolder(usr *common.User, key string) common.Holder {
+	return common.Holder{File: key, User: *usr}
+}
+
+// apiError is an error in the form of the S3 API.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+var (
+	errAccessDenied       = &apiError{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errInvalidAccessKey   = &apiError{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records"}
+	errSignatureMismatch  = &apiError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	errTimeSkewed         = &apiError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	errExpired            = &apiError{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errMalformedAuth      = &apiError{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	errMalformedQueryAuth = &apiError{http.StatusBadRequest, "AuthorizationQueryParametersError", "The query parameters used for authorization are malformed"}
+	errWrongRegion        = &apiError{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The region in the credential is not the region of the service"}
+	errMissingContentHash = &apiError{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+	errContentHash        = &apiError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	errIncompleteBody     = &apiError{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header"}
+	errMalformedBody      = &apiError{http.StatusBadRequest, "InvalidRequest", "The aws-chunked body of the request is malformed"}
+	errTooLarge           = &apiError{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size"}
+	errNoSuchBucket       = &apiError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey          = &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchUpload       = &apiError{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errInvalidPart        = &apiError{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found or did not match its entity tag"}
+	errInvalidPartOrder   = &apiError{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errInvalidPartNumber  = &apiError{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000"}
+	errInvalidKey         = &apiError{http.StatusBadRequest, "InvalidArgument", "Object keys can not contain /"}
+	errKeyTooLong         = &apiError{http.StatusBadRequest, "KeyTooLongError", "Your key is too long"}
+	errInvalidArgument    = &apiError{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+	errMalformedXML       = &apiError{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"}
+	errBucketOwned        = &apiError{http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it"}
+	errMethodNotAllowed   = &apiError{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+	errNotImplemented     = &apiError{http.StatusNotImplemented, "NotImplemented", "A header or query you provided requested a function that is not implemented"}
+	errInternal           = &apiError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// writeError responds with the error, or with an internal error when err is
+// not an error of the API.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = errInternal
+	}
+	writeXML(w, r, e.status, errorResponse{
+		Code:      e.code,
+		Message:   e.message,
+		Resource:  r.URL.Path,
+		RequestID: w.Header().Get(apierror.REQUEST_ID),
+	})
+}
+
+func writeXML(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	bytes, err := xml.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	if id := w.Header().Get(apierror.REQUEST_ID); id != "" {
+		w.Header().Set("x-amz-request-id", id)
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(xml.Header))
+		w.Write(bytes)
+	}
+}
+
+// timestamp formats times the way the API does.
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
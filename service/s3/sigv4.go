@@ -0,0 +1,438 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/logging"
+)
+
+const (
+	ALGORITHM = "AWS4-HMAC-SHA256"
+	// Time format of X-Amz-Date
+	AMZ_DATE = "20060102T150405Z"
+	// Largest difference allowed between the time a request was signed and now
+	MAX_SKEW = 15 * time.Minute
+	// Longest validity of presigned URLs
+	MAX_EXPIRY = 7 * 24 * time.Hour
+	// Largest chunk accepted in aws-chunked bodies. Signed chunks are buffered
+	// until their signature is checked
+	MAX_CHUNK = 16 * 1024 * 1024
+)
+
+// Values of x-amz-content-sha256 that are not hashes of the body
+const (
+	UNSIGNED_PAYLOAD           = "UNSIGNED-PAYLOAD"
+	STREAMING_PAYLOAD          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	STREAMING_PAYLOAD_TRAILER  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	STREAMING_UNSIGNED_TRAILER = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+var emptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// signature holds what is needed to check the body of a request against the
+// signature of its headers.
+type signature struct {
+	date    string
+	scope   string
+	key     []byte
+	value   string
+	payload string
+}
+
+type signatureKey struct{}
+
+// Authenticate checks the signature of requests and passes the user of the
+// access key to User. Requests are either signed in the Authorization header
+// or presigned in the query.
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		accessKey, sig, err := h.verify(r)
+		if err != nil {
+			logging.From(r.Context()).InfoContext(r.Context(), "Rejecting S3 request", "error", err)
+			writeError(w, r, err)
+			return
+		}
+
+		usr := h.users.Get(accessKey)
+		if usr == nil {
+			usr = h.opts.Users.KeyUser(r.Context(), accessKey)
+			if usr == nil {
+				writeError(w, r, errInvalidAccessKey)
+				return
+			}
+			h.users.Insert(accessKey, *usr)
+		}
+
+		logging.SetUser(r.Context(), *usr)
+		ctx := context.WithValue(r.Context(), userKey{}, usr)
+		ctx = context.WithValue(ctx, signatureKey{}, sig)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func (h *Handler) verify(r *http.Request) (string, *signature, error) {
+	query := r.URL.Query()
+	presigned := query.Get("X-Amz-Algorithm") != ""
+
+	var credential, signedHeaders, value, date, payload string
+	if presigned {
+		if query.Get("X-Amz-Algorithm") != ALGORITHM {
+			return "", nil, errMalformedQueryAuth
+		}
+		credential, signedHeaders = query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders")
+		value, date = query.Get("X-Amz-Signature"), query.Get("X-Amz-Date")
+		payload = UNSIGNED_PAYLOAD
+	} else {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			return "", nil, errAccessDenied
+		}
+		if !strings.HasPrefix(header, ALGORITHM+" ") {
+			return "", nil, errMalformedAuth
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(header, ALGORITHM+" "), ",") {
+			name, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				value = v
+			}
+		}
+		date = r.Header.Get("X-Amz-Date")
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+		if payload == "" {
+			return "", nil, errMissingContentHash
+		}
+	}
+
+	malformed := errMalformedAuth
+	if presigned {
+		malformed = errMalformedQueryAuth
+	}
+	// The credential is the access key followed by the scope
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || signedHeaders == "" || value == "" {
+		return "", nil, malformed
+	}
+	accessKey, scope := parts[0], strings.Join(parts[1:], "/")
+	if parts[2] != h.opts.Region {
+		return "", nil, errWrongRegion
+	}
+
+	signed, err := time.Parse(AMZ_DATE, date)
+	if err != nil || parts[1] != date[:8] {
+		return "", nil, malformed
+	}
+	now := time.Now()
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > MAX_EXPIRY {
+			return "", nil, malformed
+		}
+		if now.Before(signed.Add(-MAX_SKEW)) || now.After(signed.Add(time.Duration(expires)*time.Second)) {
+			return "", nil, errExpired
+		}
+	} else if now.Sub(signed) > MAX_SKEW || signed.Sub(now) > MAX_SKEW {
+		return "", nil, errTimeSkewed
+	}
+
+	canonical := canonicalRequest(r, signedHeaders, payload)
+	secret := Credentials(h.opts.SigningSecret, accessKey).SecretAccessKey
+	key := signingKey(secret, parts[1], parts[2])
+	expected := hex.EncodeToString(sign(key, stringToSign(date, scope, hashHex([]byte(canonical)))))
+	if !hmac.Equal([]byte(expected), []byte(value)) {
+		return "", nil, errSignatureMismatch
+	}
+
+	return accessKey, &signature{date: date, scope: scope, key: key, value: value, payload: payload}, nil
+}
+
+// canonicalRequest is the form of the request its signature is calculated
+// over, covering the signed headers and the hash of the payload.
+func canonicalRequest(r *http.Request, signedHeaders, payload string) string {
+	return strings.Join([]string{
+		r.Method,
+		encodePath(r.URL.Path),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, signedHeaders),
+		signedHeaders,
+		payload,
+	}, "\n")
+}
+
+func signingKey(secret, day, region string) []byte {
+	key := sign([]byte("AWS4"+secret), day)
+	key = sign(key, region)
+	key = sign(key, "s3")
+	return sign(key, "aws4_request")
+}
+
+func sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func stringToSign(date, scope, hash string) string {
+	return ALGORITHM + "\n" + date + "\n" + scope + "\n" + hash
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func canonicalQuery(query url.Values) string {
+	params := []string{}
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			params = append(params, encode(name, false)+"="+encode(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func canonicalHeaders(r *http.Request, signedHeaders string) string {
+	var b strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		case "transfer-encoding":
+			values = append(values, r.TransferEncoding...)
+		default:
+			values = append(values, r.Header.Values(name)...)
+		}
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return b.String()
+}
+
+func encodePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return encode(path, true)
+}
+
+// encode escapes everything but unreserved characters, and slashes if asked
+// to, as required for canonical requests.
+func encode(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// body returns the contents uploaded with the request and their size, or -1
+// when it is not known. The contents are checked against the signature of the
+// request as they are read, and reading fails when they do not match or are
+// larger than max.
+func body(r *http.Request, max int64) (io.Reader, int64, error) {
+	sig, _ := r.Context().Value(signatureKey{}).(*signature)
+	if sig == nil {
+		return nil, 0, errAccessDenied
+	}
+
+	size := r.ContentLength
+	var reader io.Reader = r.Body
+	switch sig.payload {
+	case UNSIGNED_PAYLOAD:
+	case STREAMING_PAYLOAD, STREAMING_PAYLOAD_TRAILER, STREAMING_UNSIGNED_TRAILER:
+		decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			decoded = -1
+		}
+		size = decoded
+		chunks := &chunkedReader{r: bufio.NewReader(r.Body), trailer: sig.payload != STREAMING_PAYLOAD}
+		if sig.payload != STREAMING_UNSIGNED_TRAILER {
+			chunks.sig = sig
+			chunks.previous = sig.value
+		}
+		reader = chunks
+	default:
+		expected, err := hex.DecodeString(sig.payload)
+		if err != nil || len(expected) != sha256.Size {
+			return nil, 0, errContentHash
+		}
+		reader = &hashReader{r: r.Body, hash: sha256.New(), expected: expected}
+	}
+
+	if size > max {
+		return nil, 0, errTooLarge
+	}
+	return &limitReader{r: reader, remaining: max, size: size}, size, nil
+}
+
+// hashReader fails at the end of the contents when they do not match the
+// hash they were signed with.
+type hashReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected []byte
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(h.hash.Sum(nil), h.expected) {
+		return n, errContentHash
+	}
+	return n, err
+}
+
+// limitReader fails once more than the remaining bytes are read, and when
+// fewer bytes than the known size could be read.
+type limitReader struct {
+	r         io.Reader
+	remaining int64
+	size      int64
+	read      int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.remaining {
+		return n, errTooLarge
+	}
+	if err == io.EOF && l.size >= 0 && l.read != l.size {
+		return n, errIncompleteBody
+	}
+	var maxBytes *http.MaxBytesError
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &maxBytes) {
+		return n, errIncompleteBody
+	}
+	return n, err
+}
+
+// chunkedReader decodes aws-chunked bodies. Each chunk is checked against its
+// signature, chained from the signature of the request, unless the body is
+// unsigned. Trailing checksums are not checked.
+type chunkedReader struct {
+	r        *bufio.Reader
+	sig      *signature
+	previous string
+	trailer  bool
+	chunk    []byte
+	done     bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) next() error {
+	// Bodies end with a chunk of size zero, so they can not be cut short
+	line, err := c.line()
+	if err == io.EOF {
+		return errIncompleteBody
+	}
+	if err != nil {
+		return err
+	}
+	rawSize, params, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(rawSize, 16, 64)
+	if err != nil || size < 0 || size > MAX_CHUNK {
+		return errMalformedBody
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(c.r, chunk); err != nil {
+		return errIncompleteBody
+	}
+
+	if c.sig != nil {
+		value := strings.TrimPrefix(params, "chunk-signature=")
+		toSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.sig.date + "\n" + c.sig.scope + "\n" + c.previous + "\n" + emptyHash + "\n" + hashHex(chunk)
+		expected := hex.EncodeToString(sign(c.sig.key, toSign))
+		if !hmac.Equal([]byte(expected), []byte(value)) {
+			return errSignatureMismatch
+		}
+		c.previous = value
+	}
+
+	if size == 0 {
+		c.done = true
+		return c.trailers()
+	}
+	if line, err := c.line(); err != nil || line != "" {
+		return errMalformedBody
+	}
+	c.chunk = chunk
+	return nil
+}
+
+// trailers skips the trailing headers up to the end of the body.
+func (c *chunkedReader) trailers() error {
+	for {
+		line, err := c.line()
+		if err == io.EOF && !c.trailer {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+	}
+}
+
+func (c *chunkedReader) line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", io.EOF
+	}
+	if err != nil {
+		return "", errIncompleteBody
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Minimum time between checks of the certificate files for changes
+const reloadInterval = 10 * time.Second
+
+// certReloader serves the certificate from disk and loads it again whenever
+// the certificate or key file changes, so renewed certificates are picked up
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checkedAt) >= reloadInterval {
+		c.checkedAt = time.Now()
+		if c.latestModTime().After(c.modTime) {
+			if err := c.reload(); err != nil {
+				// Keep serving the previous certificate
+				slog.Error("Unable to reload certificate", "cert", c.certFile, "error", err)
+			} else {
+				slog.Info("Reloaded certificate", "cert", c.certFile)
+			}
+		}
+	}
+
+	return c.cert, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime := c.latestModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+	c.checkedAt = time.Now()
+	return nil
+}
+
+func (c *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/vjsamuel/uploadly/service/config"
+)
+
+type Server struct {
+	server *http.Server
+	cfg    config.ServerConfig
+	certs  *certReloader
+}
+
+func NewServer(addr string, cfg config.ServerConfig, handler http.Handler) (*Server, error) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Duration(),
+		ReadTimeout:       cfg.ReadTimeout.Duration(),
+		WriteTimeout:      cfg.WriteTimeout.Duration(),
+		IdleTimeout:       cfg.IdleTimeout.Duration(),
+	}
+
+	s := &Server{server: srv, cfg: cfg}
+	if cfg.TLSCert != "" {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = certs
+		srv.TLSConfig = tlsConfig(certs)
+	} else if cfg.H2C {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return s, nil
+}
+
+// TLSConfig returns the TLS settings of servers using the configured
+// certificate, which is reloaded when it changes. It returns nil when no
+// certificate is configured.
+func TLSConfig(cfg config.ServerConfig) (*tls.Config, error) {
+	if cfg.TLSCert == "" {
+		return nil, nil
+	}
+	certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig(certs), nil
+}
+
+func tlsConfig(certs *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+}
+
+// Run serves requests until SIGTERM or SIGINT is received and then drains
+// in-flight requests for up to the shutdown timeout. Backends must only be
+// closed after Run returns.
+func (s *Server) Run() error {
+	errs := make(chan error, 1)
+	go func() {
+		slog.Info("Listening", "addr", s.server.Addr, "tls", s.certs != nil)
+		if s.certs != nil {
+			errs <- s.server.ListenAndServeTLS("", "")
+		} else {
+			errs <- s.server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		slog.Info("Draining in-flight requests", "signal", sig.String())
+	}
+
+	ctx := context.Background()
+	if timeout := s.cfg.ShutdownTimeout.Duration(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		slog.Error("Unable to drain in-flight requests", "error", err)
+		s.server.Close()
+		return err
+	}
+	return nil
+}
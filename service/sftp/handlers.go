@@ -0,0 +1,334 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"golang.org/x/net/webdav"
+)
+
+// Bytes a reader keeps behind the furthest offset read, so that reads that
+// arrive out of order do not reopen the file
+const READ_WINDOW = 4 * 1024 * 1024
+
+var (
+	errRateLimited = errors.New("rate limit exceeded")
+	errTooLarge    = errors.New("file size exceeded")
+	errOverwrite   = errors.New("files can only be written sequentially")
+	errIncomplete  = errors.New("the file was not written in full")
+)
+
+// handlers serves the requests of a session from the files of its user.
+// Operations need the scopes the HTTP API would require for them, and count
+// against the same rate limits.
+type handlers struct {
+	fs      webdav.FileSystem
+	user    common.User
+	limits  *ratelimit.Limits
+	maxSize int64
+	logger  *slog.Logger
+}
+
+func (h *handlers) allow(ctx context.Context, scope, limit string) error {
+	if !h.user.HasScope(scope) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if !h.limits.Allow(ctx, limit, h.user.Profile) {
+		return errRateLimited
+	}
+	return nil
+}
+
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if err := h.allow(r.Context(), common.SCOPE_READ, ratelimit.DOWNLOAD); err != nil {
+		return nil, err
+	}
+	file, err := h.fs.OpenFile(r.Context(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Files are opened lazily, so a missing file is only noticed here
+	if _, err := file.Stat(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &readerAt{file: file}, nil
+}
+
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if err := h.allow(r.Context(), common.SCOPE_WRITE, ratelimit.UPLOAD); err != nil {
+		return nil, err
+	}
+	flags := r.Pflags()
+	if flags.Append {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+
+	flag := os.O_WRONLY
+	if flags.Creat {
+		flag |= os.O_CREATE
+	}
+	if flags.Excl {
+		flag |= os.O_EXCL
+	}
+	file, err := h.fs.OpenFile(r.Context(), r.Filepath, flag, 0644)
+	if err != nil {
+		return nil, status(err)
+	}
+	return &writerAt{file: file, maxSize: h.maxSize, logger: h.logger, name: r.Filepath}, nil
+}
+
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		// Clients set the times and mode of files they upload, which are
+		// not kept
+		if err := h.allow(ctx, common.SCOPE_WRITE, ratelimit.METADATA); err != nil {
+			return err
+		}
+		_, err := h.fs.Stat(ctx, r.Filepath)
+		return err
+	case "Rename", "PosixRename":
+		if err := h.allow(ctx, common.SCOPE_WRITE, ratelimit.METADATA); err != nil {
+			return err
+		}
+		if !h.user.HasScope(common.SCOPE_DELETE) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		// Plain renames must not replace an existing file
+		if r.Method == "Rename" {
+			if _, err := h.fs.Stat(ctx, r.Target); err == nil {
+				return os.ErrExist
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return status(h.fs.Rename(ctx, r.Filepath, r.Target))
+	case "Remove":
+		if err := h.allow(ctx, common.SCOPE_DELETE, ratelimit.METADATA); err != nil {
+			return err
+		}
+		return status(h.fs.RemoveAll(ctx, r.Filepath))
+	case "Mkdir":
+		if err := h.allow(ctx, common.SCOPE_WRITE, ratelimit.METADATA); err != nil {
+			return err
+		}
+		// Files are stored under flat names
+		return status(h.fs.Mkdir(ctx, r.Filepath, 0755))
+	case "Rmdir":
+		return sftp.ErrSSHFxPermissionDenied
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx := r.Context()
+	if err := h.allow(ctx, common.SCOPE_READ, ratelimit.METADATA); err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		dir, err := h.fs.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		entries, err := dir.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(entries), nil
+	case "Stat", "Lstat":
+		info, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// status reports denied operations as such, rather than as failures.
+func status(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(entries []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(entries, l[offset:])
+	if offset+int64(n) == int64(len(l)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readerAt serves reads at offsets from a file that is read sequentially.
+// Clients keep several reads in flight and they are served concurrently, so
+// the most recent bytes are kept for reads that arrive late. Reads before
+// them, or far after them, reopen the file.
+type readerAt struct {
+	mu     sync.Mutex
+	file   webdav.File
+	window []byte
+	// Offset of the first byte of the window
+	start int64
+	eof   bool
+}
+
+func (r *readerAt) ReadAt(b []byte, offset int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if offset < r.start || offset > r.start+int64(len(r.window))+READ_WINDOW {
+		if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.window, r.start, r.eof = r.window[:0], offset, false
+	}
+
+	end := offset + int64(len(b))
+	for !r.eof && r.start+int64(len(r.window)) < end {
+		buf := make([]byte, end-r.start-int64(len(r.window)))
+		n, err := io.ReadFull(r.file, buf)
+		r.window = append(r.window, buf[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if excess := int64(len(r.window)) - READ_WINDOW; excess > 0 && r.start+excess <= offset {
+		r.window = append(r.window[:0], r.window[excess:]...)
+		r.start += excess
+	}
+
+	available := r.start + int64(len(r.window)) - offset
+	if available <= 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.window[offset-r.start:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *readerAt) Close() error {
+	return r.file.Close()
+}
+
+// writerAt writes to a file that can only be written sequentially. Writes
+// arriving ahead of the end of the file are held until the bytes before them
+// are written. Held bytes count against the size limit of the file like
+// written ones do.
+type writerAt struct {
+	mu      sync.Mutex
+	file    webdav.File
+	maxSize int64
+	logger  *slog.Logger
+	name    string
+	offset  int64
+	pending map[int64][]byte
+	held    int64
+	err     error
+}
+
+func (w *writerAt) WriteAt(b []byte, offset int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	if offset < w.offset {
+		return 0, errOverwrite
+	}
+	if offset > w.offset {
+		if offset+int64(len(b)) > w.maxSize || w.offset+w.held+int64(len(b)) > w.maxSize {
+			w.err = errTooLarge
+			return 0, w.err
+		}
+		if w.pending == nil {
+			w.pending = map[int64][]byte{}
+		}
+		w.held += int64(len(b)) - int64(len(w.pending[offset]))
+		w.pending[offset] = append([]byte(nil), b...)
+		return len(b), nil
+	}
+
+	if err := w.write(b); err != nil {
+		return 0, err
+	}
+	for {
+		next, ok := w.pending[w.offset]
+		if !ok {
+			return len(b), nil
+		}
+		delete(w.pending, w.offset)
+		w.held -= int64(len(next))
+		if err := w.write(next); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (w *writerAt) write(b []byte) error {
+	n, err := w.file.Write(b)
+	w.offset += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// Close stores the file, unless writing it failed or bytes are missing from
+// it.
+func (w *writerAt) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil && len(w.pending) > 0 {
+		w.err = errIncomplete
+	}
+	if w.err != nil {
+		w.abort()
+		return fmt.Errorf("%s: %w", w.name, w.err)
+	}
+	return w.file.Close()
+}
+
+// TransferError discards the file when the session ends before it was
+// closed.
+func (w *writerAt) TransferError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.logger.Info("Discarding file of interrupted SFTP transfer", "file", w.name, "error", err)
+}
+
+func (w *writerAt) abort() {
+	if aborter, ok := w.file.(interface{ Abort() }); ok {
+		aborter.Abort()
+	}
+}
@@ -0,0 +1,150 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"golang.org/x/net/webdav"
+)
+
+// Open flags of SFTP for writing a file, creating it when missing
+const WRITE_CREATE = 0x02 | 0x08
+
+var ALL_SCOPES = []string{common.SCOPE_READ, common.SCOPE_WRITE, common.SCOPE_DELETE}
+
+// newHandlers serves a user granted the scopes from files holding file.txt.
+func newHandlers(t *testing.T, limits *ratelimit.Limits, scopes ...string) *handlers {
+	t.Helper()
+	fs := webdav.NewMemFS()
+	file, err := fs.OpenFile(context.Background(), "/file.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("contents"))
+	file.Close()
+	return &handlers{fs: fs, user: common.User{Profile: "profile", Scopes: scopes}, limits: limits, maxSize: 1024}
+}
+
+func request(method, path, target string) *sftp.Request {
+	r := sftp.NewRequest(method, path)
+	r.Target = target
+	if method == "Put" {
+		r.Flags = WRITE_CREATE
+	}
+	return r
+}
+
+// serve runs the request the way the SFTP server would route it.
+func (h *handlers) serve(r *sftp.Request) error {
+	switch r.Method {
+	case "Get":
+		reader, err := h.Fileread(r)
+		if err == nil {
+			reader.(io.Closer).Close()
+		}
+		return err
+	case "Put":
+		writer, err := h.Filewrite(r)
+		if err == nil {
+			writer.(io.Closer).Close()
+		}
+		return err
+	case "List", "Stat", "Lstat":
+		_, err := h.Filelist(r)
+		return err
+	default:
+		return h.Filecmd(r)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		target string
+		scopes []string
+	}{
+		{"Get", "/file.txt", "", []string{common.SCOPE_READ}},
+		{"List", "/", "", []string{common.SCOPE_READ}},
+		{"Stat", "/file.txt", "", []string{common.SCOPE_READ}},
+		{"Lstat", "/file.txt", "", []string{common.SCOPE_READ}},
+		{"Put", "/new.txt", "", []string{common.SCOPE_WRITE}},
+		{"Setstat", "/file.txt", "", []string{common.SCOPE_WRITE}},
+		{"Mkdir", "/dir", "", []string{common.SCOPE_WRITE}},
+		{"Remove", "/file.txt", "", []string{common.SCOPE_DELETE}},
+		{"Rename", "/file.txt", "/renamed.txt", []string{common.SCOPE_WRITE, common.SCOPE_DELETE}},
+		{"PosixRename", "/file.txt", "/renamed.txt", []string{common.SCOPE_WRITE, common.SCOPE_DELETE}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			h := newHandlers(t, nil, test.scopes...)
+			if err := h.serve(request(test.method, test.path, test.target)); err != nil {
+				t.Errorf("expected %v to be enough, got %v", test.scopes, err)
+			}
+			// Every required scope is needed on its own
+			for _, missing := range test.scopes {
+				var scopes []string
+				for _, scope := range ALL_SCOPES {
+					if scope != missing {
+						scopes = append(scopes, scope)
+					}
+				}
+				h := newHandlers(t, nil, scopes...)
+				if err := h.serve(request(test.method, test.path, test.target)); err != sftp.ErrSSHFxPermissionDenied {
+					t.Errorf("expected %s to be needed, got %v", missing, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRmdirIsDenied(t *testing.T) {
+	h := newHandlers(t, nil, ALL_SCOPES...)
+	if err := h.serve(request("Rmdir", "/dir", "")); err != sftp.ErrSSHFxPermissionDenied {
+		t.Errorf("expected directories not to be removed, got %v", err)
+	}
+}
+
+func TestRenameKeepsExistingFiles(t *testing.T) {
+	h := newHandlers(t, nil, ALL_SCOPES...)
+	if err := h.serve(request("Put", "/other.txt", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.serve(request("Rename", "/file.txt", "/other.txt")); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected the existing file to be kept, got %v", err)
+	}
+	if err := h.serve(request("PosixRename", "/file.txt", "/other.txt")); err != nil {
+		t.Errorf("expected POSIX renames to replace the file, got %v", err)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	limits := ratelimit.NewLimits(config.RateLimitConfig{
+		Upload:   config.Limit{Requests: 1, Period: time.Hour},
+		Download: config.Limit{Requests: 1, Period: time.Hour},
+		Metadata: config.Limit{Requests: 1, Period: time.Hour},
+	}, nil)
+	h := newHandlers(t, limits, ALL_SCOPES...)
+
+	for _, method := range []string{"Put", "Get", "Stat"} {
+		if err := h.serve(request(method, "/file.txt", "")); err != nil {
+			t.Fatalf("expected the first %s to be allowed, got %v", method, err)
+		}
+		if err := h.serve(request(method, "/file.txt", "")); err != errRateLimited {
+			t.Errorf("expected the second %s to be limited, got %v", method, err)
+		}
+	}
+	// Metadata operations share their limit
+	if err := h.serve(request("Remove", "/file.txt", "")); err != errRateLimited {
+		t.Errorf("expected removals to count against the metadata limit, got %v", err)
+	}
+}
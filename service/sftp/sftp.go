@@ -0,0 +1,339 @@
+// Package sftp serves the files of each user over SFTP, for partners that can
+// only deliver files that way. Users sign in with an SSH public key they
+// registered, or with an API key as the password.
+package sftp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+// Name of the SSH subsystem clients request
+const SUBSYSTEM = "sftp"
+
+// Extension of the permissions of a connection holding its user
+const USER_EXTENSION = "uploadly-user"
+
+// ErrServerClosed is returned by Serve once the server was shut down.
+var ErrServerClosed = errors.New("sftp: server closed")
+
+var (
+	errUnauthorized = errors.New("invalid credentials")
+	errAuthLimited  = errors.New("too many failed authentications")
+)
+
+// Users validates keys by their hash.
+type Users interface {
+	// KeyUser returns the user the key stored under the hash grants access
+	// to, or nil when it is not valid
+	KeyUser(ctx context.Context, hash string) *common.User
+}
+
+// Options configures the SFTP server.
+type Options struct {
+	// HostKey identifies the server to clients
+	HostKey ssh.Signer
+	Users   Users
+	// FileSystem returns the files of the user
+	FileSystem func(common.User) webdav.FileSystem
+	// MaxUploadSize bounds the size of files written
+	MaxUploadSize int64
+	// Limits applied to authentications and file operations
+	Limits *ratelimit.Limits
+	// Connections without any traffic for this long are closed. Zero keeps
+	// them open
+	IdleTimeout time.Duration
+	// Logger for connections. Defaults to the default slog logger
+	Logger *slog.Logger
+}
+
+// Server accepts SSH connections and serves the SFTP subsystem on their
+// sessions.
+type Server struct {
+	opts   Options
+	config *ssh.ServerConfig
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewServer(opts Options) *Server {
+	s := &Server{opts: opts, conns: map[net.Conn]struct{}{}, logger: opts.Logger}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	s.logger = logging.Wrap(s.logger)
+
+	s.config = &ssh.ServerConfig{
+		PasswordCallback:  s.password,
+		PublicKeyCallback: s.publicKey,
+		ServerVersion:     "SSH-2.0-uploadly",
+	}
+	s.config.AddHostKey(opts.HostKey)
+	return s
+}
+
+// ListenAndServe listens on the address and serves connections until the
+// server is shut down.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Listening", "addr", addr, "protocol", "sftp")
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until the server is shut down,
+// after which it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for the open ones to finish
+// until ctx is done, after which they are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	var netConn net.Conn = conn
+	if s.opts.IdleTimeout > 0 {
+		netConn = &idleConn{Conn: conn, timeout: s.opts.IdleTimeout}
+	}
+	sshConn, channels, requests, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		s.logger.Debug("SSH handshake failed", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	usr, err := fromPermissions(sshConn.Permissions)
+	if err != nil {
+		s.logger.Error("Unable to read the user of a connection", "error", err)
+		return
+	}
+	logger := s.logger.With("remote", conn.RemoteAddr().String(), "user", *usr)
+	logger.Info("SFTP connection opened", "client", string(sshConn.ClientVersion()))
+	start := time.Now()
+
+	var sessions sync.WaitGroup
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			logger.Warn("Unable to accept a session", "error", err)
+			continue
+		}
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			s.serveSession(logger, *usr, channel, requests)
+		}()
+	}
+	sessions.Wait()
+	logger.Info("SFTP connection closed", "duration_ms", float64(time.Since(start).Microseconds())/1000)
+}
+
+// serveSession serves the SFTP subsystem once it is requested. Shells,
+// commands and other subsystems are refused.
+func (s *Server) serveSession(logger *slog.Logger, usr common.User, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		var payload struct{ Name string }
+		if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != SUBSYSTEM {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+
+		h := &handlers{fs: s.opts.FileSystem(usr), user: usr, limits: s.opts.Limits, maxSize: s.opts.MaxUploadSize, logger: logger}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			logger.Warn("SFTP session failed", "error", err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// password accepts API keys as the password. The user name is ignored.
+// Failures count against the auth_failure limit of the client address.
+func (s *Server) password(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	ctx := context.Background()
+	ip := host(conn.RemoteAddr())
+	if !s.opts.Limits.Available(ctx, ratelimit.AUTH_FAILURE, ip) {
+		metrics.ObserveRateLimited(ratelimit.AUTH_FAILURE)
+		return nil, errAuthLimited
+	}
+
+	var usr *common.User
+	if strings.HasPrefix(string(password), auth.KEY_PREFIX) {
+		usr = s.opts.Users.KeyUser(ctx, auth.HashAPIKey(string(password)))
+	}
+	if usr == nil {
+		s.opts.Limits.Record(ctx, ratelimit.AUTH_FAILURE, ip)
+		return nil, errUnauthorized
+	}
+	return toPermissions(usr)
+}
+
+// publicKey accepts the public keys registered as keys. Unknown keys are not
+// counted as failures, since clients offer every key they hold and public
+// keys can not be guessed.
+func (s *Server) publicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	usr := s.opts.Users.KeyUser(context.Background(), auth.HashPublicKey(key))
+	if usr == nil {
+		return nil, errUnauthorized
+	}
+	return toPermissions(usr)
+}
+
+func toPermissions(usr *common.User) (*ssh.Permissions, error) {
+	raw, err := json.Marshal(usr)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{USER_EXTENSION: string(raw)}}, nil
+}
+
+func fromPermissions(permissions *ssh.Permissions) (*common.User, error) {
+	if permissions == nil {
+		return nil, errUnauthorized
+	}
+	usr := &common.User{}
+	if err := json.Unmarshal([]byte(permissions.Extensions[USER_EXTENSION]), usr); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+func host(addr net.Addr) string {
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return h
+}
+
+// idleConn pushes the deadline of the connection back on every read and
+// write.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
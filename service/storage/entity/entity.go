@@ -3,10 +3,10 @@ package entity
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/vjsamuel/uploadly/service/logging"
 	"github.com/vjsamuel/uploadly/service/common"
 	s "github.com/vjsamuel/uploadly/service/storage"
 )
@@ -19,35 +19,37 @@ const (
 type entityStore struct {
 	projectId string
 	client    *datastore.Client
-	ctx       context.Context
 }
 
-func NewEntityStorage(projectId string, ctx context.Context) s.Storage {
+func NewEntityStorage(projectId string, ctx context.Context) s.MetadataStore {
 	client, err := datastore.NewClient(ctx, projectId)
 	if err != nil {
-		log.Printf("Error instantiating object store client: %v", err)
+		logging.From(ctx).ErrorContext(ctx, "Error instantiating datastore client", "error", err)
 		return nil
 	}
 
-	return &entityStore{client: client, projectId: projectId, ctx: ctx}
+	return &entityStore{client: client, projectId: projectId}
 }
 
-func (e *entityStore) Get(holder common.Holder) (interface{}, error) {
-	parent := e.createAndGetParent(holder)
+func (e *entityStore) Get(ctx context.Context, holder common.Holder) (*common.Response, error) {
+	parent := e.createAndGetParent(ctx, holder)
 	if parent == nil {
 		return nil, fmt.Errorf("Unable to get parent")
 	}
 	recordKey := datastore.NameKey(entity_kind, holder.File, parent)
 
 	entity := common.Entity{}
-	err := e.client.Get(e.ctx, recordKey, &entity)
+	err := e.client.Get(ctx, recordKey, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, s.ErrNotFound
+	}
 	if err != nil {
-		log.Printf("Record get failed with error: %v", err)
+		logging.From(ctx).ErrorContext(ctx, "Record get failed", "error", err)
 		return nil, err
 
 	}
 
-	resp := common.Response{
+	resp := &common.Response{
 		File: holder.File,
 		Size: entity.Size,
 		Type: entity.Type,
@@ -59,7 +61,7 @@ func (e *entityStore) Get(holder common.Holder) (interface{}, error) {
 	return resp, nil
 }
 
-func (e *entityStore) Insert(holder common.Holder) error {
+func (e *entityStore) Insert(ctx context.Context, holder common.Holder) error {
 	record := common.Entity{
 		Size: holder.Size,
 		Type: holder.ContentType,
@@ -69,17 +71,19 @@ func (e *entityStore) Insert(holder common.Holder) error {
 		Description: holder.Description,
 	}
 
-	return e.insertRecord(record, holder)
+	return e.insertRecord(ctx, record, holder)
 }
 
-func (e *entityStore) Update(holder common.Holder) error {
-	rawRecord, err := e.Get(holder)
+func (e *entityStore) Update(ctx context.Context, holder common.Holder) error {
+	record, err := e.Get(ctx, holder)
+	if err == s.ErrNotFound {
+		return err
+	}
 	if err != nil {
-		log.Printf("Unable to find entry to update due to error: %v\n", err)
+		logging.From(ctx).ErrorContext(ctx, "Unable to find entry to update", "error", err)
 		return fmt.Errorf("Unable to find entry to update")
 	}
 
-	record, _ := rawRecord.(common.Response)
 	newRecord := common.Entity{
 		Version: record.Version + 1,
 		LastModified: time.Now(),
@@ -88,42 +92,43 @@ func (e *entityStore) Update(holder common.Holder) error {
 		Type: holder.ContentType,
 		Description: holder.Description,
 	}
-	return e.insertRecord(newRecord, holder)
+	return e.insertRecord(ctx, newRecord, holder)
 }
 
-func (e *entityStore) Delete(holder common.Holder) error {
-	parent := e.createAndGetParent(holder)
+func (e *entityStore) Delete(ctx context.Context, holder common.Holder) error {
+	parent := e.createAndGetParent(ctx, holder)
 	if parent == nil {
 		return fmt.Errorf("Unable to find user profile")
 	}
 	recordKey := datastore.NameKey(entity_kind, holder.File, parent)
 
-	err := e.client.Delete(e.ctx, recordKey)
+	err := e.client.Delete(ctx, recordKey)
 	if err != nil {
-		log.Printf("Record get delete with error: %v", err)
+		logging.From(ctx).ErrorContext(ctx, "Record delete failed", "error", err)
 	}
 	return err
 }
 
-func (e *entityStore) Exists(holder common.Holder) bool {
-	if entity, _ := e.Get(holder); entity != nil {
-		return true
-	}
+func (e *entityStore) Ping(ctx context.Context) error {
+	_, err := e.client.GetAll(ctx, datastore.NewQuery(parent_kind).KeysOnly().Limit(1), nil)
+	return err
+}
 
-	return false
+func (e *entityStore) Close() error {
+	return e.client.Close()
 }
 
-func (e *entityStore) List(holder common.Holder) (interface{}, error) {
-	parent := e.createAndGetParent(holder)
+func (e *entityStore) List(ctx context.Context, holder common.Holder) ([]common.Response, error) {
+	parent := e.createAndGetParent(ctx, holder)
 	if parent == nil {
 		return nil, fmt.Errorf("Unable to get parent")
 	}
 
 	query := datastore.NewQuery(entity_kind).Ancestor(parent)
 	entities := []common.Entity{}
-	keys, err := e.client.GetAll(e.ctx, query, &entities)
+	keys, err := e.client.GetAll(ctx, query, &entities)
 	if err != nil {
-		log.Println("Unable to get list of entries due to error:", err)
+		logging.From(ctx).ErrorContext(ctx, "Unable to get list of entries", "error", err)
 		return nil, err
 	}
 
@@ -144,31 +149,45 @@ func (e *entityStore) List(holder common.Holder) (interface{}, error) {
 	return resp, nil
 }
 
-func (e *entityStore) createAndGetParent(holder common.Holder) *datastore.Key {
+func (e *entityStore) createAndGetParent(ctx context.Context, holder common.Holder) *datastore.Key {
 	parent := datastore.NameKey(parent_kind, holder.GetProfileID(), nil)
 	profile := common.Profile{}
-	if err := e.client.Get(e.ctx, parent, &profile); err != nil {
-		// Profile does not exist, create it
-		profile = holder.GetProfile()
-		_, err := e.client.Put(e.ctx, parent, &profile)
-		if err != nil {
-			log.Printf("Parent record insert failed with error: %v", err)
-			return nil
+	err := e.client.Get(ctx, parent, &profile)
+	if err == nil {
+		return parent
+	}
+	if err != datastore.ErrNoSuchEntity {
+		logging.From(ctx).ErrorContext(ctx, "Parent record get failed", "error", err)
+		return nil
+	}
+
+	// Profile does not exist, create it unless another request just did, so
+	// that an existing profile and its state are never overwritten
+	_, err = e.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(parent, &common.Profile{}); err != datastore.ErrNoSuchEntity {
+			return err
 		}
+		profile = holder.GetProfile()
+		_, err := tx.Put(parent, &profile)
+		return err
+	})
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Parent record insert failed", "error", err)
+		return nil
 	}
 	return parent
 }
 
-func (e *entityStore) insertRecord(record common.Entity, holder common.Holder) error {
-	parent := e.createAndGetParent(holder)
+func (e *entityStore) insertRecord(ctx context.Context, record common.Entity, holder common.Holder) error {
+	parent := e.createAndGetParent(ctx, holder)
 	if parent == nil {
 		return fmt.Errorf("Unable to find user profile")
 	}
 
 	recordKey := datastore.NameKey(entity_kind, holder.File, parent)
-	_, err := e.client.Put(e.ctx, recordKey, &record)
+	_, err := e.client.Put(ctx, recordKey, &record)
 	if err != nil {
-		log.Printf("Record insert failed with error: %v", err)
+		logging.From(ctx).ErrorContext(ctx, "Record insert failed", "error", err)
 		return err
 	}
 
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// Operation describes a single call on a store or cache.
+type Operation struct {
+	// Backend serving the call, such as gcs, datastore or memcache
+	Backend string
+	// Name of the call, such as get, list or insert
+	Name string
+	// Set for cache reads, where ErrNotFound is a miss rather than a failure
+	Lookup bool
+}
+
+// Observer is notified of every operation on an instrumented store. The
+// returned context is used for the call and the returned func is called with
+// its result once the call is done.
+type Observer interface {
+	Observe(context.Context, Operation) (context.Context, func(error))
+}
+
+type instrumentedObjectStore struct {
+	store     ObjectStore
+	backend   string
+	observers []Observer
+}
+
+// InstrumentObjectStore reports every operation of the store to the observers.
+func InstrumentObjectStore(store ObjectStore, backend string, observers ...Observer) ObjectStore {
+	return &instrumentedObjectStore{store: store, backend: backend, observers: observers}
+}
+
+func (i *instrumentedObjectStore) Reader(ctx context.Context, holder common.Holder) (io.ReadCloser, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "reader"})
+	reader, err := i.store.Reader(ctx, holder)
+	done(err)
+	return reader, err
+}
+
+func (i *instrumentedObjectStore) Writer(ctx context.Context, holder common.Holder) (io.WriteCloser, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "writer"})
+	writer, err := i.store.Writer(ctx, holder)
+	done(err)
+	return writer, err
+}
+
+func (i *instrumentedObjectStore) Attrs(ctx context.Context, holder common.Holder) (*ObjectAttrs, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "attrs"})
+	attrs, err := i.store.Attrs(ctx, holder)
+	done(err)
+	return attrs, err
+}
+
+func (i *instrumentedObjectStore) List(ctx context.Context, holder common.Holder) ([]ObjectAttrs, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "list"})
+	attrs, err := i.store.List(ctx, holder)
+	done(err)
+	return attrs, err
+}
+
+func (i *instrumentedObjectStore) Delete(ctx context.Context, holder common.Holder) error {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "delete"})
+	err := i.store.Delete(ctx, holder)
+	done(err)
+	return err
+}
+
+// Ping is not observed so that health checks do not skew the metrics.
+func (i *instrumentedObjectStore) Ping(ctx context.Context) error {
+	return i.store.Ping(ctx)
+}
+
+func (i *instrumentedObjectStore) Close() error {
+	return i.store.Close()
+}
+
+type instrumentedMetadataStore struct {
+	store     MetadataStore
+	backend   string
+	observers []Observer
+}
+
+// InstrumentMetadataStore reports every operation of the store to the
+// observers.
+func InstrumentMetadataStore(store MetadataStore, backend string, observers ...Observer) MetadataStore {
+	return &instrumentedMetadataStore{store: store, backend: backend, observers: observers}
+}
+
+func (i *instrumentedMetadataStore) Get(ctx context.Context, holder common.Holder) (*common.Response, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "get"})
+	resp, err := i.store.Get(ctx, holder)
+	done(err)
+	return resp, err
+}
+
+func (i *instrumentedMetadataStore) List(ctx context.Context, holder common.Holder) ([]common.Response, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "list"})
+	resp, err := i.store.List(ctx, holder)
+	done(err)
+	return resp, err
+}
+
+func (i *instrumentedMetadataStore) Insert(ctx context.Context, holder common.Holder) error {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "insert"})
+	err := i.store.Insert(ctx, holder)
+	done(err)
+	return err
+}
+
+func (i *instrumentedMetadataStore) Update(ctx context.Context, holder common.Holder) error {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "update"})
+	err := i.store.Update(ctx, holder)
+	done(err)
+	return err
+}
+
+func (i *instrumentedMetadataStore) Delete(ctx context.Context, holder common.Holder) error {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "delete"})
+	err := i.store.Delete(ctx, holder)
+	done(err)
+	return err
+}
+
+func (i *instrumentedMetadataStore) Ping(ctx context.Context) error {
+	return i.store.Ping(ctx)
+}
+
+func (i *instrumentedMetadataStore) Close() error {
+	return i.store.Close()
+}
+
+type instrumentedCache struct {
+	cache     Cache
+	backend   string
+	observers []Observer
+}
+
+// InstrumentCache reports every operation of the cache to the observers.
+func InstrumentCache(cache Cache, backend string, observers ...Observer) Cache {
+	return &instrumentedCache{cache: cache, backend: backend, observers: observers}
+}
+
+func (i *instrumentedCache) Get(ctx context.Context, holder common.Holder) ([]byte, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "get", Lookup: true})
+	value, err := i.cache.Get(ctx, holder)
+	done(err)
+	return value, err
+}
+
+func (i *instrumentedCache) Set(ctx context.Context, holder common.Holder, value []byte) error {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "set"})
+	err := i.cache.Set(ctx, holder, value)
+	done(err)
+	return err
+}
+
+func (i *instrumentedCache) Delete(ctx context.Context, holder common.Holder) error {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "delete"})
+	err := i.cache.Delete(ctx, holder)
+	done(err)
+	return err
+}
+
+func (i *instrumentedCache) FileVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "file_version"})
+	version, err := i.cache.FileVersion(ctx, holder)
+	done(err)
+	return version, err
+}
+
+func (i *instrumentedCache) ListVersion(ctx context.Context, holder common.Holder) (uint64, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "list_version"})
+	version, err := i.cache.ListVersion(ctx, holder)
+	done(err)
+	return version, err
+}
+
+func (i *instrumentedCache) GetList(ctx context.Context, holder common.Holder, version uint64) ([]byte, error) {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "get_list", Lookup: true})
+	value, err := i.cache.GetList(ctx, holder, version)
+	done(err)
+	return value, err
+}
+
+func (i *instrumentedCache) SetList(ctx context.Context, holder common.Holder, version uint64, value []byte) error {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "set_list"})
+	err := i.cache.SetList(ctx, holder, version, value)
+	done(err)
+	return err
+}
+
+func (i *instrumentedCache) DeleteList(ctx context.Context, holder common.Holder) error {
+	ctx, done := observe(ctx, i.observers, Operation{Backend: i.backend, Name: "delete_list"})
+	err := i.cache.DeleteList(ctx, holder)
+	done(err)
+	return err
+}
+
+func (i *instrumentedCache) Ping(ctx context.Context) error {
+	return i.cache.Ping(ctx)
+}
+
+func observe(ctx context.Context, observers []Observer, op Operation) (context.Context, func(error)) {
+	dones := make([]func(error), 0, len(observers))
+	for _, observer := range observers {
+		var done func(error)
+		ctx, done = observer.Observe(ctx, op)
+		dones = append(dones, done)
+	}
+
+	return ctx, func(err error) {
+		// Finish in reverse so nested observers such as spans end in order
+		for i := len(dones) - 1; i >= 0; i-- {
+			dones[i](err)
+		}
+	}
+}
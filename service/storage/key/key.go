@@ -0,0 +1,200 @@
+package key
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/common"
+	s "github.com/vjsamuel/uploadly/service/storage"
+)
+
+const (
+	parent_kind = "Profile"
+	key_kind    = "APIKey"
+)
+
+type KeyStore struct {
+	projectId string
+	client    *datastore.Client
+}
+
+func NewKeyStorage(projectId string, ctx context.Context) *KeyStore {
+	client, err := datastore.NewClient(ctx, projectId)
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Error instantiating key store client", "error", err)
+		return nil
+	}
+
+	return &KeyStore{client: client, projectId: projectId}
+}
+
+func (k *KeyStore) Get(ctx context.Context, holder common.Holder) (*common.KeyResponse, error) {
+	record := common.APIKey{}
+	err := k.client.Get(ctx, k.getRecordKey(holder), &record)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, s.ErrNotFound
+	}
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Key get failed", "error", err)
+		return nil, err
+	}
+
+	resp := toResponse(holder.File, record)
+	return &resp, nil
+}
+
+func (k *KeyStore) Insert(ctx context.Context, holder common.Holder, record common.APIKey) error {
+	parent := k.createAndGetParent(ctx, holder)
+	if parent == nil {
+		return fmt.Errorf("Unable to find user profile")
+	}
+
+	recordKey := datastore.NameKey(key_kind, holder.File, parent)
+	_, err := k.client.Put(ctx, recordKey, &record)
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Key insert failed", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// Touch marks the key as used by setting its last used time to now.
+func (k *KeyStore) Touch(ctx context.Context, holder common.Holder) error {
+	recordKey := k.getRecordKey(holder)
+	_, err := k.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		record := common.APIKey{}
+		if err := tx.Get(recordKey, &record); err != nil {
+			return err
+		}
+		record.LastUsed = time.Now()
+		_, err := tx.Put(recordKey, &record)
+		return err
+	})
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Key update failed", "error", err)
+	}
+	return err
+}
+
+func (k *KeyStore) Delete(ctx context.Context, holder common.Holder) error {
+	err := k.client.Delete(ctx, k.getRecordKey(holder))
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Key delete failed", "error", err)
+	}
+	return err
+}
+
+func (k *KeyStore) Close() error {
+	return k.client.Close()
+}
+
+func (k *KeyStore) List(ctx context.Context, holder common.Holder) ([]common.KeyResponse, error) {
+	parent := datastore.NameKey(parent_kind, holder.GetProfileID(), nil)
+
+	query := datastore.NewQuery(key_kind).Ancestor(parent)
+	records := []common.APIKey{}
+	keys, err := k.client.GetAll(ctx, query, &records)
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Unable to get list of keys", "error", err)
+		return nil, err
+	}
+
+	resp := []common.KeyResponse{}
+	for i, record := range records {
+		resp = append(resp, toResponse(keys[i].Name, record))
+	}
+
+	return resp, nil
+}
+
+// Lookup finds the key with the given hash and returns the user that owns it.
+// The name of the key is set on the returned holder's File.
+func (k *KeyStore) Lookup(ctx context.Context, hash string) (*common.Holder, *common.APIKey, error) {
+	query := datastore.NewQuery(key_kind).Filter("hash =", hash).Limit(1)
+	records := []common.APIKey{}
+	keys, err := k.client.GetAll(ctx, query, &records)
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Unable to look up key", "error", err)
+		return nil, nil, err
+	}
+
+	if len(keys) == 0 || keys[0].Parent == nil {
+		return nil, nil, s.ErrNotFound
+	}
+
+	profile := common.Profile{}
+	if err := k.client.Get(ctx, keys[0].Parent, &profile); err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Unable to get profile for key", "error", err)
+		return nil, nil, err
+	}
+
+	holder := &common.Holder{
+		File: keys[0].Name,
+		User: common.User{
+			FirstName: profile.FirstName,
+			LastName:  profile.LastName,
+			Profile:   keys[0].Parent.Name,
+			APIKey:    true,
+		},
+	}
+	return holder, &records[0], nil
+}
+
+func (k *KeyStore) getRecordKey(holder common.Holder) *datastore.Key {
+	parent := datastore.NameKey(parent_kind, holder.GetProfileID(), nil)
+	return datastore.NameKey(key_kind, holder.File, parent)
+}
+
+func (k *KeyStore) createAndGetParent(ctx context.Context, holder common.Holder) *datastore.Key {
+	parent := datastore.NameKey(parent_kind, holder.GetProfileID(), nil)
+	profile := common.Profile{}
+	err := k.client.Get(ctx, parent, &profile)
+	if err == nil {
+		return parent
+	}
+	if err != datastore.ErrNoSuchEntity {
+		logging.From(ctx).ErrorContext(ctx, "Parent record get failed", "error", err)
+		return nil
+	}
+
+	// Profile does not exist, create it unless another request just did, so
+	// that an existing profile and its state are never overwritten
+	_, err = k.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(parent, &common.Profile{}); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		profile = holder.GetProfile()
+		_, err := tx.Put(parent, &profile)
+		return err
+	})
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Parent record insert failed", "error", err)
+		return nil
+	}
+	return parent
+}
+
+func toResponse(name string, record common.APIKey) common.KeyResponse {
+	resp := common.KeyResponse{
+		Name:        name,
+		Scopes:      record.Scopes,
+		Created:     record.Created,
+		Fingerprint: record.Fingerprint,
+	}
+	if len(resp.Scopes) == 0 {
+		resp.Scopes = common.Scopes
+	}
+	if !record.Expiry.IsZero() {
+		expiry := record.Expiry
+		resp.Expiry = &expiry
+	}
+	if !record.LastUsed.IsZero() {
+		lastUsed := record.LastUsed
+		resp.LastUsed = &lastUsed
+	}
+	return resp
+}
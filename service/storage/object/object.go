@@ -3,10 +3,11 @@ package object
 import (
 	"context"
 	"fmt"
-	"log"
 	"io"
+	"strings"
 
 	"cloud.google.com/go/storage"
+	"github.com/vjsamuel/uploadly/service/logging"
 	s "github.com/vjsamuel/uploadly/service/storage"
 	"github.com/vjsamuel/uploadly/service/common"
 	"google.golang.org/api/iterator"
@@ -16,13 +17,12 @@ type objectStore struct {
 	bucket    string
 	projectId string
 	client    *storage.Client
-	ctx       context.Context
 }
 
-func NewObjectStorage(bucket string, projectId string, ctx context.Context) s.Storage {
+func NewObjectStorage(bucket string, projectId string, ctx context.Context) s.ObjectStore {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		log.Printf("Error instantiating object store client: %v", err)
+		logging.From(ctx).ErrorContext(ctx, "Error instantiating object store client", "error", err)
 		return nil
 	}
 
@@ -30,20 +30,18 @@ func NewObjectStorage(bucket string, projectId string, ctx context.Context) s.St
 	if _, err := buck.Attrs(ctx); err != nil {
 		e := buck.Create(ctx, projectId, nil)
 		if e != nil {
-			log.Fatal("Unable to create bucket due to error: ", err)
+			logging.From(ctx).ErrorContext(ctx, "Unable to create bucket", "bucket", bucket, "error", e)
+			return nil
 		}
 	}
-	return &objectStore{bucket: bucket, client: client, projectId: projectId, ctx: ctx}
+	return &objectStore{bucket: bucket, client: client, projectId: projectId}
 }
 
-func (o *objectStore) Get(holder common.Holder) (interface{}, error) {
-	if o.Exists(holder) == false {
-		return nil, nil
+func (o *objectStore) Reader(ctx context.Context, holder common.Holder) (io.ReadCloser, error) {
+	reader, err := o.getObject(holder).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, s.ErrNotFound
 	}
-	id := holder.GetProfileID()
-	buck := o.client.Bucket(o.bucket)
-	obj := buck.Object(fmt.Sprintf("%s/%s", id, holder.File))
-	reader, err := obj.NewReader(o.ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -51,78 +49,78 @@ func (o *objectStore) Get(holder common.Holder) (interface{}, error) {
 	return reader, nil
 }
 
-func (o *objectStore) Insert(holder common.Holder) error {
-	id := holder.GetProfileID()
-	buck := o.client.Bucket(o.bucket)
-	obj := buck.Object(fmt.Sprintf("%s/%s", id, holder.File))
+func (o *objectStore) Writer(ctx context.Context, holder common.Holder) (io.WriteCloser, error) {
+	writer := o.getObject(holder).NewWriter(ctx)
+	writer.ContentType = holder.ContentType
+	return writer, nil
+}
 
-	writer := obj.NewWriter(o.ctx)
-	reader, ok := holder.Object.(io.Reader)
-	if !ok {
-		return fmt.Errorf("Unable to get Reader for input object")
+func (o *objectStore) Attrs(ctx context.Context, holder common.Holder) (*s.ObjectAttrs, error) {
+	attrs, err := o.getObject(holder).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, s.ErrNotFound
 	}
-	_, err := io.Copy(writer, reader)
 	if err != nil {
-		return fmt.Errorf("Unable to write object due to error: %v", err)
+		return nil, err
 	}
-	writer.Close()
 
-	return nil
+	return toAttrs(holder.File, attrs), nil
 }
 
-func (o *objectStore) Update(holder common.Holder) error {
-	return o.Insert(holder)
-}
-
-func (o *objectStore) Delete(holder common.Holder) error {
-	if o.Exists(holder) == false {
-		return nil
+func (o *objectStore) Delete(ctx context.Context, holder common.Holder) error {
+	err := o.getObject(holder).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return s.ErrNotFound
 	}
-	id := holder.GetProfileID()
-	buck := o.client.Bucket(o.bucket)
-	obj := buck.Object(fmt.Sprintf("%s/%s", id, holder.File))
-
-	err := obj.Delete(o.ctx)
 	return err
 }
 
-func (o *objectStore) Exists(holder common.Holder) bool {
-	id := holder.GetProfileID()
-	buck := o.client.Bucket(o.bucket)
-	obj := buck.Object(fmt.Sprintf("%s/%s", id, holder.File))
+func (o *objectStore) Ping(ctx context.Context) error {
+	_, err := o.client.Bucket(o.bucket).Attrs(ctx)
+	return err
+}
 
-	if attr, _ := obj.Attrs(o.ctx); attr != nil {
-		return true
-	}
-	return false
+func (o *objectStore) Close() error {
+	return o.client.Close()
 }
 
-func (o *objectStore) List(holder common.Holder) (interface{}, error) {
+func (o *objectStore) List(ctx context.Context, holder common.Holder) ([]s.ObjectAttrs, error) {
 	id := holder.GetProfileID()
 	buck := o.client.Bucket(o.bucket)
 
-	it := buck.Objects(o.ctx, &storage.Query{
-		Prefix: id,
+	prefix := fmt.Sprintf("%s/", id)
+	it := buck.Objects(ctx, &storage.Query{
+		Prefix: prefix,
 	})
 
-	resps := []common.Response{}
+	attrs := []s.ObjectAttrs{}
 	for {
-		attrs, err := it.Next()
+		attr, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		resps = append(resps, common.Response{
-			Version: 1,
-			LastModified: attrs.Updated,
-			UploadTime: attrs.Created,
-			Size: attrs.Size,
-			File: attrs.Name,
-			Type: attrs.ContentType,
-		})
+		attrs = append(attrs, *toAttrs(strings.TrimPrefix(attr.Name, prefix), attr))
 	}
 
-	return resps, nil
+	return attrs, nil
+}
+
+func (o *objectStore) getObject(holder common.Holder) *storage.ObjectHandle {
+	id := holder.GetProfileID()
+	buck := o.client.Bucket(o.bucket)
+	return buck.Object(fmt.Sprintf("%s/%s", id, holder.File))
+}
+
+func toAttrs(name string, attrs *storage.ObjectAttrs) *s.ObjectAttrs {
+	return &s.ObjectAttrs{
+		Name:        name,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		MD5:         attrs.MD5,
+		Created:     attrs.Created,
+		Updated:     attrs.Updated,
+	}
 }
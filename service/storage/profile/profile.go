@@ -0,0 +1,135 @@
+package profile
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/common"
+	s "github.com/vjsamuel/uploadly/service/storage"
+)
+
+const (
+	parent_kind = "Profile"
+	entity_kind = "File"
+)
+
+type ProfileStore struct {
+	projectId string
+	client    *datastore.Client
+}
+
+func NewProfileStorage(projectId string, ctx context.Context) *ProfileStore {
+	client, err := datastore.NewClient(ctx, projectId)
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Error instantiating profile store client", "error", err)
+		return nil
+	}
+
+	return &ProfileStore{client: client, projectId: projectId}
+}
+
+func (p *ProfileStore) Get(ctx context.Context, holder common.Holder) (*common.UserResponse, error) {
+	profile := common.Profile{}
+	err := p.client.Get(ctx, p.getRecordKey(holder), &profile)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, s.ErrNotFound
+	}
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Profile get failed", "error", err)
+		return nil, err
+	}
+
+	resp := toResponse(holder.GetProfileID(), profile)
+	return &resp, nil
+}
+
+func (p *ProfileStore) List(ctx context.Context) ([]common.UserResponse, error) {
+	query := datastore.NewQuery(parent_kind)
+	profiles := []common.Profile{}
+	keys, err := p.client.GetAll(ctx, query, &profiles)
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Unable to get list of profiles", "error", err)
+		return nil, err
+	}
+
+	resp := []common.UserResponse{}
+	for i, profile := range profiles {
+		resp = append(resp, toResponse(keys[i].Name, profile))
+	}
+
+	return resp, nil
+}
+
+func (p *ProfileStore) SetDisabled(ctx context.Context, holder common.Holder, disabled bool) error {
+	recordKey := p.getRecordKey(holder)
+	_, err := p.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		profile := common.Profile{}
+		if err := tx.Get(recordKey, &profile); err == datastore.ErrNoSuchEntity {
+			return s.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		profile.Disabled = disabled
+		_, err := tx.Put(recordKey, &profile)
+		return err
+	})
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Profile update failed", "error", err)
+	}
+	return err
+}
+
+func (p *ProfileStore) Close() error {
+	return p.client.Close()
+}
+
+// Disabled reports whether the profile has been disabled. Profiles that do not
+// exist yet are not disabled.
+func (p *ProfileStore) Disabled(ctx context.Context, holder common.Holder) (bool, error) {
+	profile := common.Profile{}
+	err := p.client.Get(ctx, p.getRecordKey(holder), &profile)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Profile get failed", "error", err)
+		return false, err
+	}
+
+	return profile.Disabled, nil
+}
+
+// Usage returns the number of files and the total bytes stored by the profile.
+func (p *ProfileStore) Usage(ctx context.Context, holder common.Holder) (*common.UsageResponse, error) {
+	query := datastore.NewQuery(entity_kind).Ancestor(p.getRecordKey(holder))
+	entities := []common.Entity{}
+	_, err := p.client.GetAll(ctx, query, &entities)
+	if err != nil {
+		logging.From(ctx).ErrorContext(ctx, "Unable to get usage of profile", "error", err)
+		return nil, err
+	}
+
+	usage := &common.UsageResponse{
+		Profile: holder.GetProfileID(),
+		Files:   len(entities),
+	}
+	for _, entity := range entities {
+		usage.Size += entity.Size
+	}
+
+	return usage, nil
+}
+
+func (p *ProfileStore) getRecordKey(holder common.Holder) *datastore.Key {
+	return datastore.NameKey(parent_kind, holder.GetProfileID(), nil)
+}
+
+func toResponse(id string, profile common.Profile) common.UserResponse {
+	return common.UserResponse{
+		Profile:   id,
+		FirstName: profile.FirstName,
+		LastName:  profile.LastName,
+		Disabled:  profile.Disabled,
+	}
+}
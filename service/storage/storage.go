@@ -1,12 +1,95 @@
 package storage
 
-import "github.com/vjsamuel/uploadly/service/common"
-
-type Storage interface {
-	Get(common.Holder) (interface{}, error)
-	List(common.Holder) (interface{}, error)
-	Insert(common.Holder) error
-	Update(common.Holder) error
-	Delete(common.Holder) error
-	Exists(common.Holder) bool
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// ErrNotFound is returned when the object, record or cache entry of the holder
+// does not exist.
+var ErrNotFound = errors.New("not found")
+
+type ObjectAttrs struct {
+	Name        string
+	Size        int64
+	ContentType string
+	// MD5 of the contents, when the backend knows it
+	MD5         []byte
+	Created     time.Time
+	Updated     time.Time
+}
+
+// ObjectStore holds the contents of the files.
+type ObjectStore interface {
+	Reader(context.Context, common.Holder) (io.ReadCloser, error)
+	Writer(context.Context, common.Holder) (io.WriteCloser, error)
+	Attrs(context.Context, common.Holder) (*ObjectAttrs, error)
+	List(context.Context, common.Holder) ([]ObjectAttrs, error)
+	Delete(context.Context, common.Holder) error
+	// Ping checks that the backend can be reached
+	Ping(context.Context) error
+	Close() error
+}
+
+// MetadataStore holds the metadata of the files.
+type MetadataStore interface {
+	Get(context.Context, common.Holder) (*common.Response, error)
+	List(context.Context, common.Holder) ([]common.Response, error)
+	Insert(context.Context, common.Holder) error
+	Update(context.Context, common.Holder) error
+	Delete(context.Context, common.Holder) error
+	// Ping checks that the backend can be reached
+	Ping(context.Context) error
+	Close() error
+}
+
+// KeyStore holds the hashed API keys of the profiles.
+type KeyStore interface {
+	Get(context.Context, common.Holder) (*common.KeyResponse, error)
+	List(context.Context, common.Holder) ([]common.KeyResponse, error)
+	Insert(context.Context, common.Holder, common.APIKey) error
+	// Touch records that the key of the holder was just used
+	Touch(context.Context, common.Holder) error
+	Delete(context.Context, common.Holder) error
+	// Lookup finds the key with the given hash along with its owner
+	Lookup(ctx context.Context, hash string) (*common.Holder, *common.APIKey, error)
+	Close() error
+}
+
+// ProfileStore holds the profiles of the users that have stored files.
+type ProfileStore interface {
+	Get(context.Context, common.Holder) (*common.UserResponse, error)
+	List(context.Context) ([]common.UserResponse, error)
+	SetDisabled(ctx context.Context, holder common.Holder, disabled bool) error
+	Disabled(context.Context, common.Holder) (bool, error)
+	Usage(context.Context, common.Holder) (*common.UsageResponse, error)
+	Close() error
+}
+
+// Cache holds serialized responses of single files and of file listings.
+// Listings are cached per version of the listing of a profile, and files keep
+// a version too, so that a response read before a change and cached after it
+// can be told apart and is never served.
+type Cache interface {
+	Get(context.Context, common.Holder) ([]byte, error)
+	Set(context.Context, common.Holder, []byte) error
+	// Delete removes the file of the holder and moves it to a new version
+	Delete(context.Context, common.Holder) error
+	// FileVersion returns the current version of the file. It must be read
+	// before the file is read from the metadata store
+	FileVersion(context.Context, common.Holder) (uint64, error)
+	// ListVersion returns the current version of the listing of the profile.
+	// It must be read before the listing is read from the metadata store
+	ListVersion(context.Context, common.Holder) (uint64, error)
+	GetList(ctx context.Context, holder common.Holder, version uint64) ([]byte, error)
+	SetList(ctx context.Context, holder common.Holder, version uint64, value []byte) error
+	// DeleteList moves the listing of the profile to a new version, leaving
+	// the listings cached for earlier ones unreachable
+	DeleteList(context.Context, common.Holder) error
+	// Ping checks that the backend can be reached
+	Ping(context.Context) error
 }
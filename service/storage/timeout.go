@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// Timeouts bounds how long a single storage operation may take. A zero value
+// leaves the deadline of the incoming context untouched.
+type Timeouts struct {
+	// Timeout for reads, attrs and listings
+	Read time.Duration
+	// Timeout for writes, inserts, updates and deletes
+	Write time.Duration
+}
+
+type timeoutObjectStore struct {
+	store    ObjectStore
+	timeouts Timeouts
+}
+
+// ObjectStoreWithTimeouts wraps the store so that every operation runs with
+// the configured timeout applied to the context passed by the caller. Readers
+// and writers are only bounded by it while they are opened.
+func ObjectStoreWithTimeouts(store ObjectStore, timeouts Timeouts) ObjectStore {
+	return &timeoutObjectStore{store: store, timeouts: timeouts}
+}
+
+// Reader applies the read timeout to opening the reader only. Reading the
+// stream is bounded by the context of the caller, so that large downloads are
+// not cut off.
+func (t *timeoutObjectStore) Reader(ctx context.Context, holder common.Holder) (io.ReadCloser, error) {
+	ctx, cancel, opened := withOpenTimeout(ctx, t.timeouts.Read)
+	reader, err := t.store.Reader(ctx, holder)
+	if !opened() {
+		if err == nil {
+			reader.Close()
+		}
+		cancel()
+		return nil, context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Readers keep using the context until they are closed
+	return &cancelReader{ReadCloser: reader, cancel: cancel}, nil
+}
+
+// Writer applies the write timeout to opening the writer only. Writing the
+// stream is bounded by the context of the caller, so that large uploads are
+// not cut off.
+func (t *timeoutObjectStore) Writer(ctx context.Context, holder common.Holder) (io.WriteCloser, error) {
+	ctx, cancel, opened := withOpenTimeout(ctx, t.timeouts.Write)
+	writer, err := t.store.Writer(ctx, holder)
+	if !opened() {
+		if err == nil {
+			writer.Close()
+		}
+		cancel()
+		return nil, context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &cancelWriter{WriteCloser: writer, cancel: cancel}, nil
+}
+
+func (t *timeoutObjectStore) Attrs(ctx context.Context, holder common.Holder) (*ObjectAttrs, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Read)
+	defer cancel()
+	return t.store.Attrs(ctx, holder)
+}
+
+func (t *timeoutObjectStore) List(ctx context.Context, holder common.Holder) ([]ObjectAttrs, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Read)
+	defer cancel()
+	return t.store.List(ctx, holder)
+}
+
+func (t *timeoutObjectStore) Delete(ctx context.Context, holder common.Holder) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Write)
+	defer cancel()
+	return t.store.Delete(ctx, holder)
+}
+
+func (t *timeoutObjectStore) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Read)
+	defer cancel()
+	return t.store.Ping(ctx)
+}
+
+func (t *timeoutObjectStore) Close() error {
+	return t.store.Close()
+}
+
+type timeoutMetadataStore struct {
+	store    MetadataStore
+	timeouts Timeouts
+}
+
+// MetadataStoreWithTimeouts wraps the store so that every operation runs with
+// the configured timeout applied to the context passed by the caller.
+func MetadataStoreWithTimeouts(store MetadataStore, timeouts Timeouts) MetadataStore {
+	return &timeoutMetadataStore{store: store, timeouts: timeouts}
+}
+
+func (t *timeoutMetadataStore) Get(ctx context.Context, holder common.Holder) (*common.Response, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Read)
+	defer cancel()
+	return t.store.Get(ctx, holder)
+}
+
+func (t *timeoutMetadataStore) List(ctx context.Context, holder common.Holder) ([]common.Response, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Read)
+	defer cancel()
+	return t.store.List(ctx, holder)
+}
+
+func (t *timeoutMetadataStore) Insert(ctx context.Context, holder common.Holder) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Write)
+	defer cancel()
+	return t.store.Insert(ctx, holder)
+}
+
+func (t *timeoutMetadataStore) Update(ctx context.Context, holder common.Holder) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Write)
+	defer cancel()
+	return t.store.Update(ctx, holder)
+}
+
+func (t *timeoutMetadataStore) Delete(ctx context.Context, holder common.Holder) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Write)
+	defer cancel()
+	return t.store.Delete(ctx, holder)
+}
+
+func (t *timeoutMetadataStore) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Read)
+	defer cancel()
+	return t.store.Ping(ctx)
+}
+
+func (t *timeoutMetadataStore) Close() error {
+	return t.store.Close()
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// withOpenTimeout returns a context that is cancelled when the timeout passes
+// before opened is called. opened stops the timeout and reports whether it was
+// called in time; the stream then only ends with the context of the caller.
+func withOpenTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, func() bool) {
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	cancel := func() { cancelCause(nil) }
+	if timeout <= 0 {
+		return ctx, cancel, func() bool { return true }
+	}
+
+	timer := time.AfterFunc(timeout, func() { cancelCause(context.DeadlineExceeded) })
+	return ctx, cancel, timer.Stop
+}
+
+type cancelReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+type cancelWriter struct {
+	io.WriteCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelWriter) Close() error {
+	defer c.cancel()
+	return c.WriteCloser.Close()
+}
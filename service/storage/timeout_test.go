@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/common"
+)
+
+// blockingStore blocks every call for delay, or until its context is done.
+// Its streams fail once the context they were opened with is done, as the
+// streams of Cloud Storage do.
+type blockingStore struct {
+	delay time.Duration
+}
+
+func (b *blockingStore) wait(ctx context.Context) error {
+	select {
+	case <-time.After(b.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *blockingStore) Reader(ctx context.Context, holder common.Holder) (io.ReadCloser, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &stream{ctx: ctx}, nil
+}
+
+func (b *blockingStore) Writer(ctx context.Context, holder common.Holder) (io.WriteCloser, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &stream{ctx: ctx}, nil
+}
+
+func (b *blockingStore) Attrs(ctx context.Context, holder common.Holder) (*ObjectAttrs, error) {
+	return &ObjectAttrs{}, b.wait(ctx)
+}
+
+func (b *blockingStore) List(ctx context.Context, holder common.Holder) ([]ObjectAttrs, error) {
+	return nil, b.wait(ctx)
+}
+
+func (b *blockingStore) Delete(ctx context.Context, holder common.Holder) error {
+	return b.wait(ctx)
+}
+
+func (b *blockingStore) Ping(ctx context.Context) error {
+	return b.wait(ctx)
+}
+
+func (b *blockingStore) Close() error {
+	return nil
+}
+
+// blockingRecords is the metadata store counterpart of blockingStore.
+type blockingRecords struct {
+	blockingStore
+}
+
+func (b *blockingRecords) Get(ctx context.Context, holder common.Holder) (*common.Response, error) {
+	return &common.Response{}, b.wait(ctx)
+}
+
+func (b *blockingRecords) List(ctx context.Context, holder common.Holder) ([]common.Response, error) {
+	return nil, b.wait(ctx)
+}
+
+func (b *blockingRecords) Insert(ctx context.Context, holder common.Holder) error {
+	return b.wait(ctx)
+}
+
+func (b *blockingRecords) Update(ctx context.Context, holder common.Holder) error {
+	return b.wait(ctx)
+}
+
+type stream struct {
+	ctx    context.Context
+	closed bool
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return copy(p, "data"), nil
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *stream) Close() error {
+	s.closed = true
+	return s.ctx.Err()
+}
+
+var holder = common.Holder{File: "file.txt", User: common.User{Profile: "profile"}}
+
+func TestReaderOpenTimesOut(t *testing.T) {
+	store := ObjectStoreWithTimeouts(&blockingStore{delay: time.Second}, Timeouts{Read: 10 * time.Millisecond})
+
+	start := time.Now()
+	_, err := store.Reader(context.Background(), holder)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("opening was not cancelled, took %v", elapsed)
+	}
+}
+
+func TestWriterOpenTimesOut(t *testing.T) {
+	store := ObjectStoreWithTimeouts(&blockingStore{delay: time.Second}, Timeouts{Write: 10 * time.Millisecond})
+
+	if _, err := store.Writer(context.Background(), holder); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestStreamsOutliveTimeout(t *testing.T) {
+	timeout := 10 * time.Millisecond
+	store := ObjectStoreWithTimeouts(&blockingStore{}, Timeouts{Read: timeout, Write: timeout})
+
+	reader, err := store.Reader(context.Background(), holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := store.Writer(context.Background(), holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * timeout)
+	if _, err := reader.Read(make([]byte, 4)); err != nil {
+		t.Errorf("reading after the timeout failed: %v", err)
+	}
+	if _, err := writer.Write([]byte("data")); err != nil {
+		t.Errorf("writing after the timeout failed: %v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("closing the reader failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Errorf("closing the writer failed: %v", err)
+	}
+}
+
+func TestStreamsEndWithCaller(t *testing.T) {
+	store := ObjectStoreWithTimeouts(&blockingStore{}, Timeouts{Read: time.Minute, Write: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := store.Reader(ctx, holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := store.Writer(ctx, holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := reader.Read(make([]byte, 4)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected reading to be cancelled, got %v", err)
+	}
+	if _, err := writer.Write([]byte("data")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected writing to be cancelled, got %v", err)
+	}
+}
+
+func TestOpenedStreamIsClosedAfterTimeout(t *testing.T) {
+	// Opening takes longer than the timeout, but the store does not notice
+	inner := &slowOpenStore{delay: 50 * time.Millisecond}
+	store := ObjectStoreWithTimeouts(inner, Timeouts{Read: 10 * time.Millisecond})
+
+	if _, err := store.Reader(context.Background(), holder); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if inner.opened == nil || !inner.opened.closed {
+		t.Error("the reader opened too late was not closed")
+	}
+}
+
+// slowOpenStore opens readers after delay regardless of their context.
+type slowOpenStore struct {
+	blockingStore
+	delay  time.Duration
+	opened *stream
+}
+
+func (s *slowOpenStore) Reader(ctx context.Context, holder common.Holder) (io.ReadCloser, error) {
+	time.Sleep(s.delay)
+	s.opened = &stream{ctx: context.Background()}
+	return s.opened, nil
+}
+
+func TestOperationsAreCancelled(t *testing.T) {
+	blocking := &blockingStore{delay: time.Minute}
+	objects := ObjectStoreWithTimeouts(blocking, Timeouts{})
+	metadata := MetadataStoreWithTimeouts(&blockingRecords{*blocking}, Timeouts{})
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	for name, ctx := range map[string]context.Context{"cancelled": cancelled, "expired": expired} {
+		want := ctx.Err()
+		calls := map[string]func() error{
+			"object reader": func() error { _, err := objects.Reader(ctx, holder); return err },
+			"object writer": func() error { _, err := objects.Writer(ctx, holder); return err },
+			"object attrs":  func() error { _, err := objects.Attrs(ctx, holder); return err },
+			"object delete": func() error { return objects.Delete(ctx, holder) },
+			"record get":    func() error { _, err := metadata.Get(ctx, holder); return err },
+			"record list":   func() error { _, err := metadata.List(ctx, holder); return err },
+			"record insert": func() error { return metadata.Insert(ctx, holder) },
+			"record delete": func() error { return metadata.Delete(ctx, holder) },
+		}
+		for call, fn := range calls {
+			if err := fn(); !errors.Is(err, want) {
+				t.Errorf("%s with %s context: expected %v, got %v", call, name, want, err)
+			}
+		}
+	}
+}
+
+func TestOperationsTimeOut(t *testing.T) {
+	blocking := &blockingStore{delay: time.Minute}
+	timeouts := Timeouts{Read: 10 * time.Millisecond, Write: 10 * time.Millisecond}
+	objects := ObjectStoreWithTimeouts(blocking, timeouts)
+	metadata := MetadataStoreWithTimeouts(&blockingRecords{*blocking}, timeouts)
+
+	calls := map[string]func() error{
+		"object attrs":  func() error { _, err := objects.Attrs(context.Background(), holder); return err },
+		"object list":   func() error { _, err := objects.List(context.Background(), holder); return err },
+		"record get":    func() error { _, err := metadata.Get(context.Background(), holder); return err },
+		"record update": func() error { return metadata.Update(context.Background(), holder) },
+	}
+	for call, fn := range calls {
+		if err := fn(); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected the deadline to be exceeded, got %v", call, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const name = "github.com/vjsamuel/uploadly/service"
+
+// Setup installs the global tracer provider exporting spans over OTLP. When no
+// endpoint is configured spans are not recorded. The returned func flushes
+// pending spans and must be called before exiting.
+func Setup(ctx context.Context, cfg config.TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create OTLP exporter: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("uploadly"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start begins a span named after the operation as a child of the span in ctx.
+func Start(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(name).Start(ctx, operation, trace.WithAttributes(attrs...))
+}
+
+// End records the error, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject writes the trace context of ctx into the carrier, such as the
+// attributes of a Pub/Sub message.
+func Inject(ctx context.Context, carrier map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(carrier))
+}
+
+// Middleware starts a span for every request routed by the router it is used
+// on, continuing the trace passed in the request headers.
+func Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(name).Start(ctx, fmt.Sprintf("%s %s", r.Method, route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+			))
+		defer span.End()
+
+		sw := common.NewStatusWriter(w)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.Status))
+		if sw.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.Status))
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+type storageObserver struct{}
+
+// StorageObserver starts a span for every storage operation.
+func StorageObserver() storage.Observer {
+	return storageObserver{}
+}
+
+func (storageObserver) Observe(ctx context.Context, op storage.Operation) (context.Context, func(error)) {
+	ctx, span := Start(ctx, fmt.Sprintf("%s.%s", op.Backend, op.Name),
+		attribute.String("storage.backend", op.Backend),
+		attribute.String("storage.operation", op.Name))
+
+	return ctx, func(err error) {
+		if op.Lookup {
+			span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+		}
+		// A missing entry is an expected outcome rather than a failure
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		End(span, err)
+	}
+}
@@ -0,0 +1,408 @@
+// Package uploadly serves the upload.ly API so that it can be embedded in
+// other services. Backends that are not passed in are created from the config
+// the same way the standalone service does.
+package uploadly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/cache"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/config"
+	"github.com/vjsamuel/uploadly/service/cors"
+	"github.com/vjsamuel/uploadly/service/dav"
+	"github.com/vjsamuel/uploadly/service/handler"
+	"github.com/vjsamuel/uploadly/service/health"
+	"github.com/vjsamuel/uploadly/service/logging"
+	"github.com/vjsamuel/uploadly/service/memcache"
+	"github.com/vjsamuel/uploadly/service/metrics"
+	"github.com/vjsamuel/uploadly/service/openapi"
+	"github.com/vjsamuel/uploadly/service/pubsub"
+	"github.com/vjsamuel/uploadly/service/ratelimit"
+	"github.com/vjsamuel/uploadly/service/rpc"
+	"github.com/vjsamuel/uploadly/service/s3"
+	"github.com/vjsamuel/uploadly/service/server"
+	"github.com/vjsamuel/uploadly/service/sftp"
+	"github.com/vjsamuel/uploadly/service/storage"
+	"github.com/vjsamuel/uploadly/service/storage/entity"
+	"github.com/vjsamuel/uploadly/service/storage/key"
+	"github.com/vjsamuel/uploadly/service/storage/object"
+	"github.com/vjsamuel/uploadly/service/storage/profile"
+	"github.com/vjsamuel/uploadly/service/tracing"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Options configures a Server. Backends left nil are created from Config.
+type Options struct {
+	// Settings of the service. Defaults to config.Default()
+	Config *config.Config
+
+	ObjectStore   storage.ObjectStore
+	MetadataStore storage.MetadataStore
+	Cache         storage.Cache
+	Publisher     handler.Publisher
+	KeyStore      storage.KeyStore
+	ProfileStore  storage.ProfileStore
+
+	// Guards the API. Defaults to Google ID tokens and API keys from KeyStore
+	Authenticator auth.Authenticator
+	// Receives everything logged while serving requests. Defaults to the
+	// default slog logger
+	Logger *slog.Logger
+	// Path the routes are served under, such as /uploadly
+	PathPrefix string
+}
+
+type Server struct {
+	cfg     *config.Config
+	handler *handler.Handler
+	auth    auth.Authenticator
+	limits  *ratelimit.Limits
+	checker *health.Checker
+	logger  *slog.Logger
+	prefix  string
+	// Backends created by NewServer, in the order they are closed
+	closers []func() error
+}
+
+// NewServer creates the backends that were not passed in and the handlers
+// serving the API from them.
+func NewServer(opts Options) (*Server, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = config.Default()
+	}
+
+	s := &Server{cfg: cfg, logger: opts.Logger, prefix: strings.TrimSuffix(opts.PathPrefix, "/")}
+	backends := handler.Backends{
+		Objects:   opts.ObjectStore,
+		Metadata:  opts.MetadataStore,
+		Cache:     opts.Cache,
+		Publisher: opts.Publisher,
+		Keys:      opts.KeyStore,
+		Profiles:  opts.ProfileStore,
+	}
+	if err := s.createBackends(&backends); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	var counter ratelimit.Counter
+	if cfg.RateLimit.Backend == "memcache" {
+		counter = memcache.NewMemcacheStorage(cfg.Memcache)
+	}
+	s.limits = ratelimit.NewLimits(cfg.RateLimit, counter)
+
+	s.auth = opts.Authenticator
+	if s.auth == nil {
+		users := cache.NewEvictableMap(cfg.TokenCache.Size, cfg.TokenCache.TTL.Duration())
+		s.auth = auth.NewAuthHandler(users, backends.Keys, backends.Profiles, cfg.AdminProfiles, s.limits)
+	}
+
+	h, err := handler.NewHandler(cfg, backends, s.auth)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.handler = h
+
+	s.checker = health.NewChecker(cfg.Timeouts.Health.Duration())
+	h.RegisterChecks(s.checker)
+	return s, nil
+}
+
+// Router returns a new router serving the API and the health probes under the
+// path prefix.
+func (s *Server) Router() *mux.Router {
+	r := mux.NewRouter()
+	s.Register(r)
+	return r
+}
+
+// Register adds the routes of the server under the path prefix to r, so that
+// it can be mounted on an existing router. The middleware of the server only
+// applies to its own routes.
+func (s *Server) Register(r *mux.Router) {
+	r = r.PathPrefix(s.prefix).Subrouter()
+	r.Use(tracing.Middleware, logging.Middleware(s.logger), metrics.Middleware)
+
+	h, a, limits := s.handler, s.auth, s.limits
+
+	// Authenticated requests are limited per profile
+	upload := func(fn http.HandlerFunc) http.HandlerFunc { return limits.Handler(ratelimit.UPLOAD, s.profile, fn) }
+	download := func(fn http.HandlerFunc) http.HandlerFunc { return limits.Handler(ratelimit.DOWNLOAD, s.profile, fn) }
+	meta := func(fn http.HandlerFunc) http.HandlerFunc { return limits.Handler(ratelimit.METADATA, s.profile, fn) }
+
+	v1 := r.PathPrefix("/api/v1").Subrouter()
+	v1.Use(cors.Middleware(s.cfg.CORS), limits.Middleware(ratelimit.GLOBAL, ratelimit.Global))
+	// Preflight requests only match a route, and so run the middleware, when
+	// OPTIONS is routed
+	v1.PathPrefix("/").HandlerFunc(cors.Preflight).Methods("OPTIONS")
+
+	v1.Path("/files").Handler(a.AuthorizedHandler(common.SCOPE_READ, cache.NoCacheHandler(meta(h.GetFiles)))).Methods("GET")
+	v1.Path("/files").Handler(a.AuthorizedHandler(common.SCOPE_WRITE, upload(h.UploadFile))).Methods("POST")
+	v1.Path("/files").Handler(a.AuthorizedHandler(common.SCOPE_WRITE, upload(h.UpdateFile))).Methods("PUT")
+
+	file := v1.PathPrefix("/file").Subrouter()
+	file.Path("/{name}").Handler(a.AuthorizedHandler(common.SCOPE_READ, download(h.GetFile))).Methods("GET")
+	file.Path("/{name}").Handler(a.AuthorizedHandler(common.SCOPE_DELETE, meta(h.DeleteFile))).Methods("DELETE")
+
+	v1.Path("/keys").Handler(a.AuthenticatedHandler(cache.NoCacheHandler(meta(h.GetKeys)))).Methods("GET")
+	v1.Path("/keys").Handler(a.AuthenticatedHandler(cache.NoCacheHandler(meta(h.CreateKey)))).Methods("POST")
+	v1.Path("/key/{name}").Handler(a.AuthenticatedHandler(meta(h.RevokeKey))).Methods("DELETE")
+
+	pages := v1.PathPrefix("/file/{name}").Subrouter()
+	pages.Path("/info").Handler(a.AuthorizedHandler(common.SCOPE_READ, cache.NoCacheHandler(meta(h.GetFileInfo)))).Methods("GET")
+
+	// The document of the API is public, and limited like the webapp
+	anonymous := func(h http.Handler) http.Handler {
+		return limits.Handler(ratelimit.ANONYMOUS, limits.ClientIP, h.ServeHTTP)
+	}
+	v1.Path("/openapi.json").Handler(anonymous(openapi.Handler(s.prefix))).Methods("GET")
+	v1.Path("/docs").Handler(anonymous(openapi.DocsHandler())).Methods("GET")
+	v1.Path("/docs/redoc.standalone.js").Handler(anonymous(openapi.DocsScriptHandler())).Methods("GET")
+
+	admin := v1.PathPrefix("/admin").Subrouter()
+	admin.Path("/users").Handler(a.AuthorizedHandler(common.SCOPE_ADMIN, cache.NoCacheHandler(meta(h.GetUsers)))).Methods("GET")
+	admin.Path("/user/{profile}/usage").Handler(a.AuthorizedHandler(common.SCOPE_ADMIN, cache.NoCacheHandler(meta(h.GetUserUsage)))).Methods("GET")
+	admin.Path("/user/{profile}/disable").Handler(a.AuthorizedHandler(common.SCOPE_ADMIN, meta(h.DisableUser))).Methods("POST")
+	admin.Path("/user/{profile}/enable").Handler(a.AuthorizedHandler(common.SCOPE_ADMIN, meta(h.EnableUser))).Methods("POST")
+
+	// WebDAV clients are challenged for Basic credentials, and limited like
+	// the API routes matching their methods
+	davLimits := func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "GET", "HEAD":
+				download(next.ServeHTTP)(w, r)
+			case "PUT":
+				upload(next.ServeHTTP)(w, r)
+			default:
+				meta(next.ServeHTTP)(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+	webdav := dav.BasicAuth(dav.Authorize(a, davLimits(h.DAV(s.prefix+"/dav"))))
+	r.PathPrefix("/dav/").Handler(limits.Middleware(ratelimit.GLOBAL, ratelimit.Global)(webdav))
+
+	r.Methods("GET").Path("/_ah/health").Handler(cache.NoCacheHandler(s.checker.Live))
+	r.Methods("GET").Path("/_ah/live").Handler(cache.NoCacheHandler(s.checker.Live))
+	r.Methods("GET").Path("/_ah/ready").Handler(cache.NoCacheHandler(s.checker.Ready))
+}
+
+// S3Router returns a router serving the S3 compatible API, to be served on a
+// listener of its own. It needs s3.signing_secret to be set and the
+// authenticator to validate API keys by their hash, as the default one does.
+func (s *Server) S3Router() (*mux.Router, error) {
+	if s.cfg.S3.SigningSecret == "" {
+		return nil, fmt.Errorf("s3.signing_secret must be set to serve the S3 API")
+	}
+	users, ok := s.auth.(s3.Users)
+	if !ok {
+		return nil, fmt.Errorf("the authenticator can not validate the access keys of the S3 API")
+	}
+	h, limits := s.handler.S3(s.cfg, users), s.limits
+
+	profile := func(r *http.Request) string {
+		if usr := s3.User(r); usr != nil {
+			return usr.Profile
+		}
+		return ""
+	}
+	limit := func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "GET", "HEAD":
+				limits.Handler(ratelimit.DOWNLOAD, profile, next.ServeHTTP)(w, r)
+			case "PUT":
+				limits.Handler(ratelimit.UPLOAD, profile, next.ServeHTTP)(w, r)
+			default:
+				limits.Handler(ratelimit.METADATA, profile, next.ServeHTTP)(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+
+	r := mux.NewRouter()
+	r.Use(tracing.Middleware, logging.Middleware(s.logger), metrics.Middleware, limits.Middleware(ratelimit.GLOBAL, ratelimit.Global))
+	r.PathPrefix("/").Handler(h.Authenticate(limit(h)))
+	return r, nil
+}
+
+// SFTPServer returns a server serving the files of each user over SFTP, with
+// the host key read from sftp.host_key. It needs the authenticator to validate
+// keys by their hash, as the default one does.
+func (s *Server) SFTPServer() (*sftp.Server, error) {
+	users, ok := s.auth.(sftp.Users)
+	if !ok {
+		return nil, fmt.Errorf("the authenticator can not validate the keys of SFTP users")
+	}
+	raw, err := os.ReadFile(s.cfg.SFTP.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the SFTP host key: %v", err)
+	}
+	hostKey, err := ssh.ParsePrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the SFTP host key: %v", err)
+	}
+
+	return sftp.NewServer(sftp.Options{
+		HostKey:       hostKey,
+		Users:         users,
+		FileSystem:    s.handler.FileSystem,
+		MaxUploadSize: s.cfg.Upload.MaxSize,
+		Limits:        s.limits,
+		IdleTimeout:   s.cfg.SFTP.IdleTimeout.Duration(),
+		Logger:        s.logger,
+	}), nil
+}
+
+// GRPCServer returns a gRPC server serving the files of each user, over TLS
+// when the server has a certificate.
+func (s *Server) GRPCServer() (*grpc.Server, error) {
+	tlsConfig, err := server.TLSConfig(s.cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+	var serverOpts []grpc.ServerOption
+	if tlsConfig != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	return rpc.NewServer(rpc.Options{
+		Files:         s.handler,
+		Authenticator: s.auth,
+		Limits:        s.limits,
+		MaxUploadSize: s.cfg.Upload.MaxSize,
+		ChunkSize:     s.cfg.GRPC.ChunkSize,
+		Logger:        s.logger,
+	}, serverOpts...), nil
+}
+
+// Limits returns the rate limits of the server, for applying them to routes
+// registered next to it.
+func (s *Server) Limits() *ratelimit.Limits {
+	return s.limits
+}
+
+// Close flushes pending publishes and closes the backends created by
+// NewServer. Backends passed in Options are left open. It must only be called
+// once no requests are in flight.
+func (s *Server) Close() error {
+	var errs []error
+	for _, close := range s.closers {
+		if err := close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.closers = nil
+	return errors.Join(errs...)
+}
+
+func (s *Server) profile(r *http.Request) string {
+	if usr := s.auth.User(r); usr != nil {
+		return usr.Profile
+	}
+	return ""
+}
+
+func (s *Server) createBackends(b *handler.Backends) error {
+	cfg := s.cfg
+	ctx := context.Background()
+
+	// The publisher is closed first so that pending messages are flushed
+	if b.Publisher == nil {
+		if err := s.require("publisher"); err != nil {
+			return err
+		}
+		p := pubsub.NewPubSub(cfg.ProjectID, cfg.Bucket, ctx)
+		if p == nil {
+			return fmt.Errorf("unable to create pubsub client")
+		}
+		b.Publisher = p
+		s.closers = append(s.closers, p.Close)
+	}
+
+	if b.Objects == nil {
+		if err := s.require("object store"); err != nil {
+			return err
+		}
+		o := object.NewObjectStorage(cfg.Bucket, cfg.ProjectID, ctx)
+		if o == nil {
+			return fmt.Errorf("unable to create cloud storage client")
+		}
+		b.Objects = o
+		s.closers = append(s.closers, o.Close)
+	}
+
+	if b.Metadata == nil {
+		if err := s.require("metadata store"); err != nil {
+			return err
+		}
+		e := entity.NewEntityStorage(cfg.ProjectID, ctx)
+		if e == nil {
+			return fmt.Errorf("unable to create datastore client")
+		}
+		b.Metadata = e
+		s.closers = append(s.closers, e.Close)
+	}
+
+	if b.Keys == nil {
+		if err := s.require("key store"); err != nil {
+			return err
+		}
+		k := key.NewKeyStorage(cfg.ProjectID, ctx)
+		if k == nil {
+			return fmt.Errorf("unable to create key store client")
+		}
+		b.Keys = k
+		s.closers = append(s.closers, k.Close)
+	}
+
+	if b.Profiles == nil {
+		if err := s.require("profile store"); err != nil {
+			return err
+		}
+		p := profile.NewProfileStorage(cfg.ProjectID, ctx)
+		if p == nil {
+			return fmt.Errorf("unable to create profile store client")
+		}
+		b.Profiles = p
+		s.closers = append(s.closers, p.Close)
+	}
+
+	if b.Cache == nil {
+		switch cfg.Cache.Backend {
+		case "local":
+			b.Cache = cache.NewLRU(cfg.Cache.Size, cfg.Cache.LocalTTL.Duration())
+		case "tiered":
+			local := cache.NewLRU(cfg.Cache.Size, cfg.Cache.LocalTTL.Duration())
+			b.Cache = cache.NewTiered(local, memcache.NewMemcacheStorage(cfg.Memcache))
+		case "none":
+			b.Cache = cache.NewNone(cfg.Cache.Size)
+		default:
+			b.Cache = memcache.NewMemcacheStorage(cfg.Memcache)
+		}
+	}
+	return nil
+}
+
+// require reports an error when the Google Cloud settings needed to create a
+// default backend are missing.
+func (s *Server) require(backend string) error {
+	if s.cfg.ProjectID == "" || s.cfg.Bucket == "" {
+		return fmt.Errorf("project_id and bucket must be set to create the default %s", backend)
+	}
+	return nil
+}
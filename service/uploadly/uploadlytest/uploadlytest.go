@@ -0,0 +1,315 @@
+// Package uploadlytest provides in-memory backends and an authenticator for
+// serving the API in tests without Google Cloud.
+package uploadlytest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vjsamuel/uploadly/service/apierror"
+	"github.com/vjsamuel/uploadly/service/auth"
+	"github.com/vjsamuel/uploadly/service/cache"
+	"github.com/vjsamuel/uploadly/service/common"
+	"github.com/vjsamuel/uploadly/service/storage"
+	"github.com/vjsamuel/uploadly/service/uploadly"
+)
+
+// Store holds the contents and the metadata of the files in memory. Published
+// files are written to it right away, as the upload function would.
+type Store struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	records  map[string]common.Response
+	disabled map[string]bool
+}
+
+func NewStore() *Store {
+	return &Store{objects: map[string][]byte{}, records: map[string]common.Response{}, disabled: map[string]bool{}}
+}
+
+// Options returns options serving the API from the store, with no cache and
+// users authenticated by their token.
+func (s *Store) Options(tokens map[string]common.User) uploadly.Options {
+	return uploadly.Options{
+		ObjectStore:   Objects{s},
+		MetadataStore: Records{s},
+		Cache:         cache.NewNone(1000),
+		Publisher:     Publisher{s},
+		KeyStore:      Keys{},
+		ProfileStore:  Profiles{s},
+		Authenticator: Tokens(tokens),
+	}
+}
+
+// Object returns the contents stored for the file of the holder.
+func (s *Store) Object(holder common.Holder) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key(holder)]
+	return data, ok
+}
+
+func key(holder common.Holder) string {
+	return holder.GetProfileID() + "/" + holder.File
+}
+
+// Objects is the object store of the Store.
+type Objects struct{ *Store }
+
+func (o Objects) Reader(ctx context.Context, holder common.Holder) (io.ReadCloser, error) {
+	data, ok := o.Object(holder)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (o Objects) Writer(ctx context.Context, holder common.Holder) (io.WriteCloser, error) {
+	return &writer{store: o.Store, key: key(holder), ctx: ctx}, nil
+}
+
+func (o Objects) Attrs(ctx context.Context, holder common.Holder) (*storage.ObjectAttrs, error) {
+	data, ok := o.Object(holder)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	sum := md5.Sum(data)
+	return &storage.ObjectAttrs{Name: holder.File, Size: int64(len(data)), MD5: sum[:]}, nil
+}
+
+func (o Objects) List(ctx context.Context, holder common.Holder) ([]storage.ObjectAttrs, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	prefix := holder.GetProfileID() + "/"
+	attrs := []storage.ObjectAttrs{}
+	for name, data := range o.objects {
+		if strings.HasPrefix(name, prefix) {
+			sum := md5.Sum(data)
+			attrs = append(attrs, storage.ObjectAttrs{Name: strings.TrimPrefix(name, prefix), Size: int64(len(data)), MD5: sum[:]})
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+	return attrs, nil
+}
+
+func (o Objects) Delete(ctx context.Context, holder common.Holder) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.objects[key(holder)]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(o.objects, key(holder))
+	return nil
+}
+
+func (o Objects) Ping(context.Context) error { return nil }
+
+func (o Objects) Close() error { return nil }
+
+// writer stores the contents once closed, unless its context was done.
+type writer struct {
+	bytes.Buffer
+	store *Store
+	key   string
+	ctx   context.Context
+}
+
+func (w *writer) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.objects[w.key] = w.Bytes()
+	return nil
+}
+
+// Records is the metadata store of the Store.
+type Records struct{ *Store }
+
+func (r Records) Get(ctx context.Context, holder common.Holder) (*common.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, ok := r.records[key(holder)]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &record, nil
+}
+
+func (r Records) List(ctx context.Context, holder common.Holder) ([]common.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prefix := holder.GetProfileID() + "/"
+	records := []common.Response{}
+	for name, record := range r.records {
+		if strings.HasPrefix(name, prefix) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].File < records[j].File })
+	return records, nil
+}
+
+func (r Records) Insert(ctx context.Context, holder common.Holder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.records[key(holder)] = common.Response{
+		File:         holder.File,
+		UploadTime:   now,
+		LastModified: now,
+		Version:      1,
+		Size:         holder.Size,
+		Type:         holder.ContentType,
+		Description:  holder.Description,
+	}
+	return nil
+}
+
+func (r Records) Update(ctx context.Context, holder common.Holder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, ok := r.records[key(holder)]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	record.Version++
+	record.LastModified = time.Now()
+	record.Size = holder.Size
+	record.Type = holder.ContentType
+	record.Description = holder.Description
+	r.records[key(holder)] = record
+	return nil
+}
+
+func (r Records) Delete(ctx context.Context, holder common.Holder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.records, key(holder))
+	return nil
+}
+
+func (r Records) Ping(context.Context) error { return nil }
+
+func (r Records) Close() error { return nil }
+
+// Publisher writes published files to the Store.
+type Publisher struct{ *Store }
+
+func (p Publisher) Publish(ctx context.Context, holder common.Holder, reader io.Reader) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.objects[key(holder)] = data
+	return nil
+}
+
+func (p Publisher) Ping(context.Context) error { return nil }
+
+func (p Publisher) Close() error { return nil }
+
+// Keys is a key store without keys.
+type Keys struct{}
+
+func (Keys) Get(context.Context, common.Holder) (*common.KeyResponse, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (Keys) List(context.Context, common.Holder) ([]common.KeyResponse, error) {
+	return []common.KeyResponse{}, nil
+}
+
+func (Keys) Insert(context.Context, common.Holder, common.APIKey) error { return nil }
+
+func (Keys) Touch(context.Context, common.Holder) error { return nil }
+
+func (Keys) Delete(context.Context, common.Holder) error { return storage.ErrNotFound }
+
+func (Keys) Lookup(context.Context, string) (*common.Holder, *common.APIKey, error) {
+	return nil, nil, storage.ErrNotFound
+}
+
+func (Keys) Close() error { return nil }
+
+// Profiles is the profile store of the Store.
+type Profiles struct{ *Store }
+
+func (p Profiles) Get(ctx context.Context, holder common.Holder) (*common.UserResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &common.UserResponse{Profile: holder.GetProfileID(), Disabled: p.disabled[holder.GetProfileID()]}, nil
+}
+
+func (p Profiles) List(context.Context) ([]common.UserResponse, error) {
+	return []common.UserResponse{}, nil
+}
+
+func (p Profiles) SetDisabled(ctx context.Context, holder common.Holder, disabled bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disabled[holder.GetProfileID()] = disabled
+	return nil
+}
+
+func (p Profiles) Disabled(ctx context.Context, holder common.Holder) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.disabled[holder.GetProfileID()], nil
+}
+
+func (p Profiles) Usage(ctx context.Context, holder common.Holder) (*common.UsageResponse, error) {
+	records, err := Records{p.Store}.List(ctx, holder)
+	if err != nil {
+		return nil, err
+	}
+	usage := &common.UsageResponse{Profile: holder.GetProfileID(), Files: len(records)}
+	for _, record := range records {
+		usage.Size += record.Size
+	}
+	return usage, nil
+}
+
+func (p Profiles) Close() error { return nil }
+
+// Tokens authenticates requests by the token they carry, granting the user it
+// maps to.
+type Tokens map[string]common.User
+
+func (t Tokens) User(r *http.Request) *common.User {
+	if usr, ok := t[r.Header.Get(auth.AUTH_TOKEN)]; ok {
+		return &usr
+	}
+	return nil
+}
+
+func (t Tokens) AuthenticatedHandler(handlerFunc http.HandlerFunc) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if t.User(r) == nil {
+			apierror.Write(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		handlerFunc(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func (t Tokens) AuthorizedHandler(scope string, handlerFunc http.HandlerFunc) http.Handler {
+	return t.AuthenticatedHandler(func(w http.ResponseWriter, r *http.Request) {
+		if !t.User(r).HasScope(scope) {
+			apierror.Write(w, r, http.StatusForbidden, "Missing scope "+scope)
+			return
+		}
+		handlerFunc(w, r)
+	})
+}
@@ -156,9 +156,9 @@ app.controller('UploadController', ['$scope', 'fileOps', 'fileMeta', 'User' ,fun
                 $scope.message = file.file.name + " uploaded successfully.";
                 $scope.show_success = true;
             }, function(error) {
-                if (error.status ==  403) {
+                if (error.status == 401 || error.status ==  403) {
                     $scope.message = file.file.name + " upload failed. Please login and try again.";
-                } else if (error.status == 400) {
+                } else if (error.status == 413) {
                     $scope.message = file.file.name + " upload failed as file is bigger than 10MB."
                 } else {
                     $scope.message = file.file.name + " upload failed. Please try again."